@@ -36,6 +36,7 @@ import (
 
 	"github.com/LiterMC/go-openbmclapi/internal/build"
 	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/storage"
 )
 
 const (
@@ -176,18 +177,44 @@ func (cr *Cluster) apiV0Status(rw http.ResponseWriter, req *http.Request) {
 		Prog  int64 `json:"prog"`
 		Total int64 `json:"total"`
 	}
+	type storageData struct {
+		Id              string                `json:"id"`
+		Type            string                `json:"type"`
+		Weight          uint                  `json:"weight"`
+		EffectiveWeight float64               `json:"effectiveWeight"`
+		Mode            string                `json:"mode"`
+		Health          storage.HealthStatus  `json:"health"`
+		Capacity        *storage.CapacityInfo `json:"capacity,omitempty"`
+	}
 	type statusData struct {
-		StartAt time.Time `json:"startAt"`
-		Stats   *Stats    `json:"stats"`
-		Enabled bool      `json:"enabled"`
-		IsSync  bool      `json:"isSync"`
-		Sync    *syncData `json:"sync,omitempty"`
+		StartAt  time.Time     `json:"startAt"`
+		Stats    *Stats        `json:"stats"`
+		Enabled  bool          `json:"enabled"`
+		IsSync   bool          `json:"isSync"`
+		Sync     *syncData     `json:"sync,omitempty"`
+		Storages []storageData `json:"storages"`
 	}
 	status := statusData{
-		StartAt: startTime,
-		Stats:   &cr.stats,
-		Enabled: cr.enabled.Load(),
-		IsSync:  cr.issync.Load(),
+		StartAt:  startTime,
+		Stats:    &cr.stats,
+		Enabled:  cr.enabled.Load(),
+		IsSync:   cr.issync.Load(),
+		Storages: make([]storageData, len(cr.storages)),
+	}
+	servingWeights := *cr.servingWeights.Load()
+	for i, opt := range cr.storageOpts {
+		status.Storages[i] = storageData{
+			Id:              opt.Id,
+			Type:            opt.Type,
+			Weight:          opt.Weight,
+			EffectiveWeight: (float64)(servingWeights[i]) / storage.WeightScale,
+			Mode:            opt.Mode,
+			Health:          cr.storageHealths[i].Status(),
+		}
+		if c := cr.storageCapacities[i]; c.Supported() {
+			info := c.Info()
+			status.Storages[i].Capacity = &info
+		}
 	}
 	if status.IsSync {
 		status.Sync = &syncData{
@@ -20,15 +20,14 @@
 package main
 
 import (
-	"compress/gzip"
-	"compress/zlib"
 	"context"
-	"crypto"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
@@ -36,6 +35,7 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"sort"
 	"strings"
 	"sync"
@@ -53,6 +53,7 @@ import (
 
 	gocache "github.com/LiterMC/go-openbmclapi/cache"
 	"github.com/LiterMC/go-openbmclapi/database"
+	"github.com/LiterMC/go-openbmclapi/filelist"
 	"github.com/LiterMC/go-openbmclapi/internal/build"
 	"github.com/LiterMC/go-openbmclapi/limited"
 	"github.com/LiterMC/go-openbmclapi/log"
@@ -60,6 +61,13 @@ import (
 	"github.com/LiterMC/go-openbmclapi/utils"
 )
 
+const (
+	// popularityHalfLife is how long it takes for an access count to be halved
+	popularityHalfLife = time.Hour * 6
+	// maxPopularityEntries limits the number of hashes to be counted
+	maxPopularityEntries = 1 << 20
+)
+
 type Cluster struct {
 	host          string   // not public host
 	publicHosts   []string // should not contains port, can be nil
@@ -76,11 +84,23 @@ type Cluster struct {
 	storages           []storage.Storage
 	storageWeights     []uint
 	storageTotalWeight uint
+	storageHealths     []*storage.StorageHealth
+	storageWindows     []*storage.ServeWindow
+	storageLimits      []*limited.RateController // nil if the storage is not limited
+	syncLimiter        *limited.RateController   // limits the download rate of the sync, nil means no limit
+	servingWeights     atomic.Pointer[[]uint]    // scaled by storage.WeightScale
+	storageCapacities  []*storage.StorageCapacity
+	minFreeSpace       int64
+	storageIndexes     []int
+	writableIndexes    []int // indexes of the storages in read-write mode
+	replication        int
+	draining           atomic.Bool
 	cache              gocache.Cache
 	apiHmacKey         []byte
 	hijackProxy        *HjProxy
 
 	stats          Stats
+	popularity     *utils.Popularity
 	hits, statHits atomic.Int32
 	hbts, statHbts atomic.Int64
 	issync         atomic.Bool
@@ -99,6 +119,9 @@ type Cluster struct {
 	downloading     map[string]chan error
 	filesetMux      sync.RWMutex
 	fileset         map[string]int64
+	filesetSynced   bool             // whether the fileset has been built from the storages, the manifest will not override it then
+	fileStorages    map[string][]int // indexes of the storages which hold the file, nil means all storages
+	lastFileList    []FileInfo       // the file list of the last successful sync, sorted by filelist.Sort
 	fileMapDB       database.DB
 	authTokenMux    sync.RWMutex
 	authToken       *ClusterToken
@@ -164,7 +187,8 @@ func NewCluster(
 		cachedCli: &http.Client{
 			Transport: cachedTransport,
 		},
-		tokens: NewTokenStorage(),
+		tokens:     NewTokenStorage(),
+		popularity: utils.NewPopularity(popularityHalfLife, maxPopularityEntries),
 
 		wsUpgrader: &websocket.Upgrader{
 			HandshakeTimeout: time.Minute,
@@ -173,21 +197,63 @@ func NewCluster(
 	close(cr.disabled)
 
 	cr.bufSlots = limited.NewBufSlots(cr.maxConn)
+	if rate := config.SyncLimit.DownloadRate; rate > 0 {
+		cr.syncLimiter = limited.NewRateController(0, rate*1024, 0)
+	}
 
 	{
 		var (
 			n   uint = 0
 			wgs      = make([]uint, len(storageOpts))
 			sts      = make([]storage.Storage, len(storageOpts))
+			hts      = make([]*storage.StorageHealth, len(storageOpts))
+			sws      = make([]*storage.ServeWindow, len(storageOpts))
+			lms      = make([]*limited.RateController, len(storageOpts))
+			cps      = make([]*storage.StorageCapacity, len(storageOpts))
+			ids      = make([]int, len(storageOpts))
+			wrs      = make([]int, 0, len(storageOpts))
 		)
+		maxFailures := 0
+		if config.StorageHealth.Enable {
+			maxFailures = config.StorageHealth.MaxFailures
+		}
+		window := time.Duration(config.AdaptiveWeight.Window) * time.Second
+		if window <= 0 {
+			window = time.Minute * 5
+		}
 		for i, s := range storageOpts {
 			sts[i] = storage.NewStorage(s)
 			wgs[i] = s.Weight
 			n += s.Weight
+			hts[i] = storage.NewStorageHealth(maxFailures)
+			sws[i] = storage.NewServeWindow(window, 30)
+			if l := s.ServeLimit; l.Enabled() {
+				lms[i] = limited.NewRateController(l.MaxConn, 0, l.UploadRate*1024)
+			}
+			cps[i] = storage.NewStorageCapacity(sts[i])
+			ids[i] = i
+			if s.Writable() {
+				wrs = append(wrs, i)
+			}
 		}
 		cr.storages = sts
 		cr.storageWeights = wgs
 		cr.storageTotalWeight = n
+		cr.storageHealths = hts
+		cr.storageWindows = sws
+		cr.storageLimits = lms
+		servingWeights := storage.AdaptWeights(wgs, make([]storage.WindowStats, len(wgs)), 1, 1, 0)
+		cr.servingWeights.Store(&servingWeights)
+		cr.storageCapacities = cps
+		if config.StorageCapacity.Enable {
+			cr.minFreeSpace = config.StorageCapacity.MinFreeBytes()
+		}
+		cr.storageIndexes = ids
+		cr.writableIndexes = wrs
+		cr.replication = len(sts)
+		if r := config.Replication; r > 0 && r < len(sts) {
+			cr.replication = r
+		}
 	}
 	return
 }
@@ -204,6 +270,16 @@ func (cr *Cluster) Init(ctx context.Context) (err error) {
 	for _, s := range cr.storages {
 		s.Init(vctx)
 	}
+	if config.StorageHealth.Enable {
+		go cr.runStorageProbes(ctx)
+	}
+	if config.AdaptiveWeight.Enable {
+		go cr.runAdaptiveWeights(ctx)
+	}
+	if config.StorageCapacity.Enable {
+		cr.refreshCapacities(ctx)
+		go cr.runCapacityRefresh(ctx)
+	}
 
 	// create data folder
 	os.MkdirAll(cr.dataDir, 0755)
@@ -221,6 +297,247 @@ func (cr *Cluster) allocBuf(ctx context.Context) (slotId int, buf []byte, free f
 	return cr.bufSlots.Alloc(ctx)
 }
 
+// forEachHealthyStorage iterates the candidate storages that are not marked as down, picking the start point by their serving weights.
+// If candidates is empty, all storages will be the candidates.
+// If all candidates are down, it will fallback to iterate all of them
+func (cr *Cluster) forEachHealthyStorage(candidates []int, cb func(i int) (done bool)) (done bool) {
+	if len(candidates) == 0 {
+		candidates = cr.storageIndexes
+	}
+	var (
+		indexes    = make([]int, 0, len(candidates))
+		weights    = make([]uint, 0, len(candidates))
+		allWeights = make([]uint, len(candidates))
+		total      uint
+		allTotal   uint
+		serving    = *cr.servingWeights.Load()
+	)
+	for j, i := range candidates {
+		w := serving[i]
+		allWeights[j] = w
+		allTotal += w
+		if cr.storageHealths[i].Healthy() {
+			indexes = append(indexes, i)
+			weights = append(weights, w)
+			total += w
+		}
+	}
+	if len(indexes) == 0 {
+		log.Debug("[health]: All candidate storages are down, trying all of them")
+		indexes, weights, total = candidates, allWeights, allTotal
+	}
+	return forEachFromRandomIndexWithPossibility(weights, total, func(j int) bool {
+		return cb(indexes[j])
+	})
+}
+
+// pickStorages chooses n storages from the candidates to place a new file with the given size.
+// Storages without enough free space are skipped, so less than n storages may be returned.
+// Healthy storages are preferred, and then storages are chosen randomly by their weights.
+// Storages with zero weight are only chosen when there is no other choice
+func (cr *Cluster) pickStorages(candidates []int, n int, size int64) []int {
+	roomy := candidates
+	for j, i := range candidates {
+		if !cr.storageHasRoom(i, size) {
+			// copy on the first full storage, so the candidates slice will not be modified
+			roomy = append(make([]int, 0, len(candidates)-1), candidates[:j]...)
+			for _, i := range candidates[j+1:] {
+				if cr.storageHasRoom(i, size) {
+					roomy = append(roomy, i)
+				}
+			}
+			break
+		}
+	}
+	candidates = roomy
+	if n >= len(candidates) {
+		return candidates
+	}
+	type candidate struct {
+		index   int
+		healthy bool
+		key     float64
+	}
+	cs := make([]candidate, len(candidates))
+	for j, i := range candidates {
+		c := candidate{
+			index:   i,
+			healthy: cr.storageHealths[i].Healthy(),
+			key:     -1,
+		}
+		if w := cr.storageWeights[i]; w > 0 {
+			// weighted random sampling without replacement (Efraimidis & Spirakis)
+			c.key = math.Pow(rand.Float64(), 1/(float64)(w))
+		}
+		cs[j] = c
+	}
+	sort.Slice(cs, func(a, b int) bool {
+		if cs[a].healthy != cs[b].healthy {
+			return cs[a].healthy
+		}
+		return cs[a].key > cs[b].key
+	})
+	picked := make([]int, n)
+	for j := range picked {
+		picked[j] = cs[j].index
+	}
+	sort.Ints(picked)
+	return picked
+}
+
+var errStorageFull = errors.New("Storage does not have enough free space")
+
+func (cr *Cluster) storageHasRoom(i int, size int64) bool {
+	return cr.storageCapacities[i].HasRoom(size, cr.minFreeSpace)
+}
+
+// createOnStorage writes the file to the i-th storage if it has enough free space
+func (cr *Cluster) createOnStorage(ctx context.Context, i int, hash string, size int64, r io.ReadSeeker) error {
+	if !cr.storageHasRoom(i, size) {
+		return errStorageFull
+	}
+	if err := cr.storages[i].Create(ctx, hash, r); err != nil {
+		return err
+	}
+	cr.storageCapacities[i].Consume(size)
+	return nil
+}
+
+// refreshCapacities refreshes the capacities of all storages.
+// Each storage has its own timeout, so an unresponsive storage will not block the startup and the syncs
+func (cr *Cluster) refreshCapacities(ctx context.Context) {
+	timeout := time.Duration(config.StorageCapacity.RefreshTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Second * 10
+	}
+	var wg sync.WaitGroup
+	for i, c := range cr.storageCapacities {
+		if !c.Supported() {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, c *storage.StorageCapacity) {
+			defer wg.Done()
+			tctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			hadRoom := c.HasRoom(0, cr.minFreeSpace)
+			if err := c.Refresh(tctx); err != nil {
+				log.Debugf("[capacity]: Cannot get capacity of storage [%d] %s: %v", i, cr.storages[i].String(), err)
+				return
+			}
+			if hasRoom := c.HasRoom(0, cr.minFreeSpace); hasRoom != hadRoom {
+				if hasRoom {
+					log.Infof("[capacity]: Storage [%d] %s has free space again", i, cr.storages[i].String())
+				} else {
+					log.Warnf("[capacity]: Storage [%d] %s is full, only %s left", i, cr.storages[i].String(), bytesToUnit((float64)(c.Info().Free)))
+				}
+			}
+		}(i, c)
+	}
+	wg.Wait()
+}
+
+func (cr *Cluster) runCapacityRefresh(ctx context.Context) {
+	interval := time.Duration(config.StorageCapacity.RefreshInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		cr.refreshCapacities(ctx)
+	}
+}
+
+func (cr *Cluster) reportStorageError(i int, err error) {
+	if !storage.IsHealthError(err) {
+		return
+	}
+	cr.storageWindows[i].Record(0, err)
+	if cr.storageHealths[i].OnFailure(err) {
+		log.Warnf("[health]: Storage [%d] %s is marked as down: %v", i, cr.storages[i].String(), err)
+	}
+}
+
+// runAdaptiveWeights periodically adjusts the serving weights by the recent serve latency and error rate of the storages
+func (cr *Cluster) runAdaptiveWeights(ctx context.Context) {
+	cfg := config.AdaptiveWeight
+	interval := time.Duration(cfg.UpdateInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Second * 10
+	}
+	minFactor, maxFactor := cfg.MinFactor, cfg.MaxFactor
+	if minFactor <= 0 {
+		minFactor = 0.2
+	}
+	if maxFactor < minFactor {
+		maxFactor = minFactor
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		stats := make([]storage.WindowStats, len(cr.storageWindows))
+		for i, w := range cr.storageWindows {
+			stats[i] = w.Stats()
+		}
+		weights := storage.AdaptWeights(cr.storageWeights, stats, minFactor, maxFactor, (int64)(cfg.MinRequests))
+		if old := cr.servingWeights.Swap(&weights); !slices.Equal(*old, weights) {
+			log.Debugf("[weight]: Serving weights changed to %v", weights)
+		}
+	}
+}
+
+func (cr *Cluster) runStorageProbes(ctx context.Context) {
+	interval := time.Duration(config.StorageHealth.ProbeInterval) * time.Second
+	if interval <= 0 {
+		interval = time.Second * 30
+	}
+	timeout := time.Duration(config.StorageHealth.ProbeTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = time.Second * 10
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		var wg sync.WaitGroup
+		for i, h := range cr.storageHealths {
+			if h.Healthy() {
+				continue
+			}
+			wg.Add(1)
+			go func(i int, h *storage.StorageHealth) {
+				defer wg.Done()
+				sto := cr.storages[i]
+				tctx, cancel := context.WithTimeout(ctx, timeout)
+				defer cancel()
+				start := time.Now()
+				err := storage.CheckHealth(tctx, sto)
+				if h.OnProbe(err, time.Since(start)) {
+					log.Infof("[health]: Storage [%d] %s is back online", i, sto.String())
+				} else if err != nil {
+					log.Debugf("[health]: Probe failed for storage [%d] %s: %v", i, sto.String(), err)
+				}
+			}(i, h)
+		}
+		wg.Wait()
+	}
+}
+
 func (cr *Cluster) Connect(ctx context.Context) bool {
 	cr.mux.Lock()
 	defer cr.mux.Unlock()
@@ -540,6 +857,14 @@ func (cr *Cluster) CachedFileSize(hash string) (size int64, ok bool) {
 	return
 }
 
+// CachedFileStorages returns the indexes of the storages which hold the file.
+// nil will be returned if the placement is unknown
+func (cr *Cluster) CachedFileStorages(hash string) []int {
+	cr.filesetMux.RLock()
+	defer cr.filesetMux.RUnlock()
+	return cr.fileStorages[hash]
+}
+
 type CertKeyPair struct {
 	Cert string `json:"cert"`
 	Key  string `json:"key"`
@@ -610,11 +935,7 @@ func (cr *Cluster) makeReqWithAuth(ctx context.Context, method string, relpath s
 	return
 }
 
-type FileInfo struct {
-	Path string `json:"path" avro:"path"`
-	Hash string `json:"hash" avro:"hash"`
-	Size int64  `json:"size" avro:"size"`
-}
+type FileInfo = filelist.FileInfo
 
 // from <https://github.com/bangbang93/openbmclapi/blob/master/src/cluster.ts>
 var fileListSchema = avro.MustParse(`{
@@ -700,11 +1021,15 @@ func (cr *Cluster) SyncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 		return false
 	}
 
-	sort.Slice(files, func(i, j int) bool { return files[i].Hash < files[j].Hash })
-	if cr.syncFiles(ctx, files, heavyCheck) == nil {
+	filelist.Sort(files)
+	placement, err := cr.syncFiles(ctx, files, heavyCheck)
+	if err == nil {
+		files = filelist.Synced(files, placement)
 		fileset := make(map[string]int64, len(files))
+		fileStorages := make(map[string][]int, len(files))
 		for _, f := range files {
 			fileset[f.Hash] = f.Size
+			fileStorages[f.Hash] = placement[f.Hash]
 			if config.Hijack.Enable && !strings.HasPrefix(f.Path, "/openbmclapi/download/") {
 				cr.fileMapDB.Set(database.Record{
 					Path: f.Path,
@@ -715,9 +1040,18 @@ func (cr *Cluster) SyncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 		}
 		cr.filesetMux.Lock()
 		cr.fileset = fileset
+		cr.fileStorages = fileStorages
+		cr.filesetSynced = true
+		cr.lastFileList = files
 		cr.filesetMux.Unlock()
+		if err := cr.saveFilesetManifest(files, fileStorages); err != nil {
+			log.Errorf("Cannot save fileset manifest: %v", err)
+		}
 	}
 	cr.issync.Store(false)
+	if err == nil {
+		go cr.drainStorages(ctx)
+	}
 
 	return true
 }
@@ -725,27 +1059,36 @@ func (cr *Cluster) SyncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 type fileInfoWithTargets struct {
 	FileInfo
 	tgMux   sync.Mutex
-	targets []storage.Storage
+	targets []int  // indexes of the storages which the file should be written to
+	holders []int  // indexes of the storages which already have the file
+	demand  uint32 // the access count when the sync started
 }
 
+// maxStatCheckFiles is the max number of files that will be checked one by one,
+// the storage will be walked if there are more files to check
+const maxStatCheckFiles = 1024
+
+// checkFileFor checks the files on the storage, and adds the missing ones to the map.
+// If the storage cannot be listed, the error will be returned and no file will be marked as missing
 func (cr *Cluster) checkFileFor(
 	ctx context.Context,
-	sto storage.Storage, files []FileInfo,
+	stoIndex int, files []FileInfo,
 	heavy bool,
 	missing *SyncMap[string, *fileInfoWithTargets],
 	pg *mpb.Progress,
-) {
+) error {
+	sto := cr.storages[stoIndex]
 	var missingCount atomic.Int32
 	addMissing := func(f FileInfo) {
 		missingCount.Add(1)
 		if info, has := missing.GetOrSet(f.Hash, func() *fileInfoWithTargets {
 			return &fileInfoWithTargets{
 				FileInfo: f,
-				targets:  []storage.Storage{sto},
+				targets:  []int{stoIndex},
 			}
 		}); has {
 			info.tgMux.Lock()
-			info.targets = append(info.targets, sto)
+			info.targets = append(info.targets, stoIndex)
 			info.tgMux.Unlock()
 		}
 	}
@@ -795,13 +1138,28 @@ func (cr *Cluster) checkFileFor(
 	defer bar.Wait()
 	defer bar.Abort(true)
 
-	bar.SetTotal(0x100, false)
-
 	sizeMap := make(map[string]int64, len(files))
-	{
+	if len(files) <= maxStatCheckFiles {
+		// only a few files, stat them instead of walking the whole storage
+		bar.SetTotal((int64)(len(files)), false)
+		for _, f := range files {
+			start := time.Now()
+			if f.Size != 0 {
+				size, err := sto.Size(ctx, f.Hash)
+				if err == nil {
+					sizeMap[f.Hash] = size
+				} else if !errors.Is(err, os.ErrNotExist) {
+					log.Errorf("Cannot stat files on %s, skipped checking it: %v", sto.String(), err)
+					return err
+				}
+			}
+			bar.EwmaIncrement(time.Since(start))
+		}
+	} else {
+		bar.SetTotal(0x100, false)
 		start := time.Now()
 		var checkedMp [256]bool
-		sto.WalkDir(func(hash string, size int64) error {
+		if err := sto.WalkDir(ctx, func(hash string, size int64) error {
 			if n := utils.HexTo256(hash); !checkedMp[n] {
 				checkedMp[n] = true
 				now := time.Now()
@@ -810,14 +1168,17 @@ func (cr *Cluster) checkFileFor(
 			}
 			sizeMap[hash] = size
 			return nil
-		})
+		}); err != nil {
+			log.Errorf("Cannot list files on %s, skipped checking it: %v", sto.String(), err)
+			return err
+		}
 	}
 
 	bar.SetCurrent(0)
 	bar.SetTotal((int64)(len(files)), false)
 	for _, f := range files {
 		if ctx.Err() != nil {
-			return
+			return ctx.Err()
 		}
 		start := time.Now()
 		hash := f.Hash
@@ -832,18 +1193,18 @@ func (cr *Cluster) checkFileFor(
 				log.Warnf("Found modified file: size of %q is %d, expect %d", hash, size, f.Size)
 				addMissing(f)
 			} else if heavy {
-				hashMethod, err := getHashMethod(len(hash))
+				hashMethod, err := utils.GetHashMethod(len(hash))
 				if err != nil {
 					log.Errorf("Unknown hash method for %q", hash)
 				} else {
 					_, buf, free := slots.Alloc(ctx)
 					if buf == nil {
-						return
+						return ctx.Err()
 					}
 					go func(f FileInfo, buf []byte, free func()) {
 						defer free()
 						miss := true
-						r, err := sto.Open(hash)
+						r, err := sto.Open(ctx, hash)
 						if err != nil {
 							log.Errorf("Could not open %q: %v", hash, err)
 						} else {
@@ -879,38 +1240,95 @@ func (cr *Cluster) checkFileFor(
 
 	bar.SetTotal(-1, true)
 	log.Infof("File check finished for %s, missing %d files", sto.String(), missingCount.Load())
-	return
+	return nil
 }
 
+// CheckFiles checks the files on all storages.
+// It returns the files that do not have enough replicas, with the storages they should be written to,
+// and the indexes of the storages which hold each file.
+// Storages which cannot be listed are neither counted as holders nor written to
 func (cr *Cluster) CheckFiles(
 	ctx context.Context,
 	files []FileInfo,
 	heavyCheck bool,
 	pg *mpb.Progress,
-) (map[string]*fileInfoWithTargets, error) {
-	missingMap := NewSyncMap[string, *fileInfoWithTargets]()
+) (map[string]*fileInfoWithTargets, map[string][]int, error) {
+	lackMap := NewSyncMap[string, *fileInfoWithTargets]()
 	done := make(chan struct{}, 0)
+	checkErrs := make([]error, len(cr.storages))
 
-	for _, s := range cr.storages {
-		go func(s storage.Storage) {
+	for i := range cr.storages {
+		go func(i int) {
 			defer func() {
 				select {
 				case done <- struct{}{}:
 				case <-ctx.Done():
 				}
 			}()
-			cr.checkFileFor(ctx, s, files, heavyCheck, missingMap, pg)
-		}(s)
+			checkErrs[i] = cr.checkFileFor(ctx, i, files, heavyCheck, lackMap, pg)
+		}(i)
 	}
 	for i := len(cr.storages); i > 0; i-- {
 		select {
 		case <-done:
 		case <-ctx.Done():
 			log.Warn("File sync interrupted")
-			return nil, ctx.Err()
+			return nil, nil, ctx.Err()
+		}
+	}
+
+	checked := make([]int, 0, len(cr.storages))
+	for i, err := range checkErrs {
+		if err == nil {
+			checked = append(checked, i)
 		}
 	}
-	return missingMap.m, nil
+	if len(checked) == 0 {
+		return nil, nil, fmt.Errorf("Cannot check files on any storage: %w", errors.Join(checkErrs...))
+	}
+
+	missingMap := make(map[string]*fileInfoWithTargets)
+	placement := make(map[string][]int, len(files))
+	noRoom := 0
+	for _, f := range files {
+		info, ok := lackMap.m[f.Hash]
+		if !ok {
+			placement[f.Hash] = checked
+			continue
+		}
+		lacks := make(map[int]struct{}, len(info.targets))
+		for _, i := range info.targets {
+			lacks[i] = struct{}{}
+		}
+		holders := make([]int, 0, len(checked)-len(lacks))
+		candidates := make([]int, 0, len(lacks))
+		for _, i := range checked {
+			if _, ok := lacks[i]; ok {
+				// read-only and drain storages will never receive new files
+				if cr.storageOpts[i].Writable() {
+					candidates = append(candidates, i)
+				}
+			} else {
+				holders = append(holders, i)
+			}
+		}
+		placement[f.Hash] = holders
+		replication := min(cr.replication, len(holders)+len(candidates))
+		if len(holders) >= replication {
+			continue
+		}
+		info.holders = holders
+		info.targets = cr.pickStorages(candidates, replication-len(holders), f.Size)
+		if len(info.targets) == 0 {
+			noRoom++
+			continue
+		}
+		missingMap[f.Hash] = info
+	}
+	if noRoom > 0 {
+		log.Errorf("%d files cannot be synchronized, because all storages which lack them are full", noRoom)
+	}
+	return missingMap, placement, nil
 }
 
 func (cr *Cluster) SetFilesetByExists(ctx context.Context, files []FileInfo) error {
@@ -919,25 +1337,32 @@ func (cr *Cluster) SetFilesetByExists(ctx context.Context, files []FileInfo) err
 	log.SetLogOutput(pg)
 	defer log.SetLogOutput(nil)
 
-	missingMap, err := cr.CheckFiles(ctx, files, false, pg)
+	_, placement, err := cr.CheckFiles(ctx, files, false, pg)
 	if err != nil {
 		return err
 	}
 	fileset := make(map[string]int64, len(files))
-	stoCount := len(cr.storages)
+	fileStorages := make(map[string][]int, len(files))
 	for _, f := range files {
-		if t, ok := missingMap[f.Hash]; !ok || len(t.targets) < stoCount {
+		if holders := placement[f.Hash]; len(holders) > 0 {
 			fileset[f.Hash] = f.Size
+			fileStorages[f.Hash] = holders
 		}
 	}
 
-	cr.mux.Lock()
+	cr.filesetMux.Lock()
 	cr.fileset = fileset
-	cr.mux.Unlock()
+	cr.fileStorages = fileStorages
+	cr.filesetSynced = true
+	cr.filesetMux.Unlock()
+	if err := cr.saveFilesetManifest(files, fileStorages); err != nil {
+		log.Errorf("Cannot save fileset manifest: %v", err)
+	}
 	return nil
 }
 
-func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck bool) error {
+// syncFiles downloads the missing files, and returns the indexes of the storages which hold each file
+func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck bool) (placement map[string][]int, err error) {
 	pg := mpb.New(mpb.WithRefreshRate(time.Second), mpb.WithAutoRefresh(), mpb.WithWidth(140))
 	defer pg.Shutdown()
 	log.SetLogOutput(pg)
@@ -946,25 +1371,39 @@ func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 	cr.syncProg.Store(0)
 	cr.syncTotal.Store(-1)
 
-	missingMap, err := cr.CheckFiles(ctx, files, heavyCheck, pg)
+	if config.StorageCapacity.Enable {
+		cr.refreshCapacities(ctx)
+	}
+	missingMap, placement, err := cr.CheckFiles(ctx, files, heavyCheck, pg)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	missing := make([]*fileInfoWithTargets, 0, len(missingMap))
 	for _, f := range missingMap {
+		f.demand = cr.popularity.Count(f.Hash)
 		missing = append(missing, f)
 	}
+	// fetch the files requested recently first
+	slices.SortFunc(missing, func(a, b *fileInfoWithTargets) int {
+		if a.demand != b.demand {
+			if a.demand > b.demand {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Hash, b.Hash)
+	})
 	totalFiles := len(missing)
 	if totalFiles == 0 {
 		log.Info("All files were synchronized")
-		return nil
+		return placement, nil
 	}
 
 	cr.syncTotal.Store((int64)(totalFiles))
 
 	ccfg, err := cr.GetConfig(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	syncCfg := ccfg.Sync
 	log.Infof("Sync config: %#v", syncCfg)
@@ -974,7 +1413,12 @@ func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 	var stats syncStats
 	stats.pg = pg
 	stats.noOpen = syncCfg.Source == "center"
-	stats.slots = limited.NewBufSlots(syncCfg.Concurrency)
+	concurrency := syncCfg.Concurrency
+	if maxConn := config.SyncLimit.MaxConn; maxConn > 0 && concurrency > maxConn {
+		log.Infof("Sync concurrency is limited from %d to %d", concurrency, maxConn)
+		concurrency = maxConn
+	}
+	stats.slots = limited.NewBufSlots(concurrency)
 	stats.totalFiles = totalFiles
 	for _, f := range missing {
 		stats.totalSize += f.Size
@@ -1004,12 +1448,19 @@ func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 	log.Infof("Starting sync files, count: %d, total: %s", totalFiles, bytesToUnit((float64)(stats.totalSize)))
 	start := time.Now()
 
+	dispatched := 0
 	for _, f := range missing {
+		if !config.SyncLimit.InWindow(time.Now()) {
+			// the left files will be synchronized in the next window, or be downloaded on demand
+			log.Warnf("Sync window closed, %d files are left to be synchronized", len(missing)-dispatched)
+			break
+		}
+		dispatched++
 		log.Debugf("File %s is for %v", f.Hash, f.targets)
 		pathRes, err := cr.fetchFile(ctx, &stats, f.FileInfo)
 		if err != nil {
 			log.Warn("File sync interrupted")
-			return err
+			return nil, err
 		}
 		go func(f *fileInfoWithTargets, pathRes <-chan string) {
 			defer func() {
@@ -1035,16 +1486,18 @@ func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 						return
 					}
 					defer srcFd.Close()
-					for _, target := range f.targets {
+					for _, i := range f.targets {
+						target := cr.storages[i]
 						if _, err = srcFd.Seek(0, io.SeekStart); err != nil {
 							log.Errorf("Cannot seek file %q to start: %v", path, err)
 							continue
 						}
-						err := target.Create(f.Hash, srcFd)
+						err := cr.createOnStorage(ctx, i, f.Hash, f.Size, srcFd)
 						if err != nil {
 							log.Errorf("Cannot create %s/%s: %v", target.String(), f.Hash, err)
 							continue
 						}
+						f.holders = append(f.holders, i)
 					}
 				}
 			case <-ctx.Done():
@@ -1052,42 +1505,56 @@ func (cr *Cluster) syncFiles(ctx context.Context, files []FileInfo, heavyCheck b
 			}
 		}(f, pathRes)
 	}
-	for i := len(missing); i > 0; i-- {
+	for i := dispatched; i > 0; i-- {
 		select {
 		case <-done:
 		case <-ctx.Done():
 			log.Warn("File sync interrupted")
-			return ctx.Err()
+			return nil, ctx.Err()
 		}
 	}
 
 	use := time.Since(start)
+	if dispatched < len(missing) {
+		stats.totalBar.Abort(false)
+	}
 	pg.Wait()
 
+	for _, f := range missing {
+		placement[f.Hash] = f.holders
+	}
+
+	if dispatched < len(missing) {
+		log.Infof("Sync paused, %d / %d files were fetched, use time: %v", dispatched, len(missing), use)
+		return placement, nil
+	}
 	log.Infof("All files were synchronized, use time: %v, %s/s", use, bytesToUnit((float64)(stats.totalSize)/use.Seconds()))
-	return nil
+	return placement, nil
 }
 
-func (cr *Cluster) Gc() {
-	for _, s := range cr.storages {
-		cr.gcFor(s)
+func (cr *Cluster) Gc(ctx context.Context) {
+	for i, s := range cr.storages {
+		if cr.storageOpts[i].Mode == storage.ModeReadOnly {
+			continue
+		}
+		cr.gcFor(ctx, s)
 	}
 }
 
-func (cr *Cluster) gcFor(s storage.Storage) {
+func (cr *Cluster) gcFor(ctx context.Context, s storage.Storage) {
 	log.Info("Starting garbage collector for", s.String())
-	err := s.WalkDir(func(hash string, _ int64) error {
+	err := s.WalkDir(ctx, func(hash string, _ int64) error {
 		if cr.issync.Load() {
 			return context.Canceled
 		}
 		if _, ok := cr.CachedFileSize(hash); !ok {
 			log.Info("Found outdated file:", hash)
-			s.Remove(hash)
+			s.Remove(ctx, hash)
 		}
 		return nil
 	})
 	if err != nil {
-		if err == context.Canceled {
+		if errors.Is(err, context.Canceled) {
 			log.Warn("Garbage collector interrupted at", s.String())
 		} else {
 			log.Errorf("Garbage collector error: %v", err)
@@ -1141,17 +1608,41 @@ func (cr *Cluster) fetchFile(ctx context.Context, stats *syncStats, f FileInfo)
 		)
 		defer bar.Abort(true)
 
+		hashMethod, err := utils.GetHashMethod(len(f.Hash))
+		if err != nil {
+			log.Errorf("Download error %s:\n\t%s", f.Path, err)
+			stats.failCount.Add(1)
+			return
+		}
+		part, err := utils.NewPartialDownload(hashMethod)
+		if err != nil {
+			log.Errorf("Cannot create temporary file for %s: %v", f.Path, err)
+			stats.failCount.Add(1)
+			return
+		}
+		downloaded := false
+		defer func() {
+			if !downloaded {
+				part.Remove()
+			}
+		}()
+
 		noOpen := stats.noOpen
 		interval := time.Second
 		for {
-			bar.SetCurrent(0)
-			hashMethod, err := getHashMethod(len(f.Hash))
-			if err == nil {
-				var path string
-				if path, err = cr.fetchFileWithBuf(ctx, f, hashMethod, buf, noOpen, func(r io.Reader) io.Reader {
-					return ProxyReader(r, bar, stats.totalBar, &stats.lastInc)
-				}); err == nil {
-					pathRes <- path
+			// the downloaded part is kept, and the download will be resumed from it
+			bar.SetCurrent(part.Written())
+			if err = cr.fetchFileWithBuf(ctx, f, part, buf, noOpen, func(r io.Reader) io.Reader {
+				r = ProxyReader(r, bar, stats.totalBar, &stats.lastInc)
+				if cr.syncLimiter != nil {
+					// the reader does not hold a slot, so it must not be closed
+					r = cr.syncLimiter.NewReader(r)
+				}
+				return r
+			}); err == nil {
+				if err = part.Close(); err == nil {
+					downloaded = true
+					pathRes <- part.Path()
 					stats.okCount.Add(1)
 					log.Infof("Downloaded %s [%s] %.2f%%", f.Path,
 						bytesToUnit((float64)(f.Size)),
@@ -1185,18 +1676,20 @@ var noOpenQuery = url.Values{
 	"noopen": {"1"},
 }
 
+// fetchFileWithBuf downloads the file into part.
+// If part already has some data, the download will be resumed with a Range request,
+// and it will restart from the beginning if the server does not support it.
+// The downloaded data is kept in part when the transfer is interrupted, but it is discarded if the check failed
 func (cr *Cluster) fetchFileWithBuf(
 	ctx context.Context, f FileInfo,
-	hashMethod crypto.Hash, buf []byte,
+	part *utils.PartialDownload, buf []byte,
 	noOpen bool,
 	wrapper func(io.Reader) io.Reader,
-) (path string, err error) {
+) (err error) {
 	var (
 		query url.Values = nil
 		req   *http.Request
 		res   *http.Response
-		fd    *os.File
-		r     io.Reader
 	)
 	if noOpen {
 		query = noOpenQuery
@@ -1204,7 +1697,10 @@ func (cr *Cluster) fetchFileWithBuf(
 	if req, err = cr.makeReqWithAuth(ctx, http.MethodGet, f.Path, query); err != nil {
 		return
 	}
-	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	if part.Written() > 0 {
+		log.Debugf("Resuming download %s from byte %d", f.Path, part.Written())
+	}
+	part.PrepareRequest(req)
 	if res, err = cr.client.Do(req); err != nil {
 		return
 	}
@@ -1212,61 +1708,10 @@ func (cr *Cluster) fetchFileWithBuf(
 	if err = ctx.Err(); err != nil {
 		return
 	}
-	if res.StatusCode != http.StatusOK {
-		err = ErrorFromRedirect(utils.NewHTTPStatusErrorFromResponse(res), res)
-		return
-	}
-	switch ce := strings.ToLower(res.Header.Get("Content-Encoding")); ce {
-	case "":
-		r = res.Body
-	case "gzip":
-		if r, err = gzip.NewReader(res.Body); err != nil {
-			err = ErrorFromRedirect(err, res)
-			return
-		}
-	case "deflate":
-		if r, err = zlib.NewReader(res.Body); err != nil {
-			err = ErrorFromRedirect(err, res)
-			return
-		}
-	default:
-		err = ErrorFromRedirect(fmt.Errorf("Unexpected Content-Encoding %q", ce), res)
-		return
-	}
-	if wrapper != nil {
-		r = wrapper(r)
-	}
-
-	hw := hashMethod.New()
-
-	if fd, err = os.CreateTemp("", "*.downloading"); err != nil {
-		return
-	}
-	path = fd.Name()
-	defer func(path string) {
-		if err != nil {
-			os.Remove(path)
-		}
-	}(path)
-
-	_, err = io.CopyBuffer(io.MultiWriter(hw, fd), r, buf)
-	stat, err2 := fd.Stat()
-	fd.Close()
-	if err != nil {
+	if err = part.ReadResponse(res, f.Size, f.Hash, buf, wrapper); err != nil {
 		err = ErrorFromRedirect(err, res)
 		return
 	}
-	if err2 != nil {
-		err = err2
-		return
-	}
-	if t := stat.Size(); f.Size >= 0 && t != f.Size {
-		err = ErrorFromRedirect(fmt.Errorf("File size wrong, got %d, expect %d", t, f.Size), res)
-		return
-	} else if hs := hex.EncodeToString(hw.Sum(buf[:0])); hs != f.Hash {
-		err = ErrorFromRedirect(fmt.Errorf("File hash not match, got %s, expect %s", hs, f.Hash), res)
-		return
-	}
 	return
 }
 
@@ -1283,7 +1728,7 @@ func (cr *Cluster) lockDownloading(target string) (chan error, bool) {
 }
 
 func (cr *Cluster) DownloadFile(ctx context.Context, hash string) (err error) {
-	hashMethod, err := getHashMethod(len(hash))
+	hashMethod, err := utils.GetHashMethod(len(hash))
 	if err != nil {
 		return
 	}
@@ -1303,6 +1748,8 @@ func (cr *Cluster) DownloadFile(ctx context.Context, hash string) (err error) {
 	done, ok := cr.lockDownloading(hash)
 	if !ok {
 		go func() {
+			// do not use the named result, it may be set by the caller's select at the same time
+			var err error
 			defer func() {
 				done <- err
 			}()
@@ -1332,10 +1779,19 @@ func (cr *Cluster) DownloadFile(ctx context.Context, hash string) (err error) {
 			}()
 			defer cancel()
 
-			path, err := cr.fetchFileWithBuf(ctx, f, hashMethod, buf, true, nil)
-			if err != nil {
+			var part *utils.PartialDownload
+			if part, err = utils.NewPartialDownload(hashMethod); err != nil {
+				return
+			}
+			if err = cr.fetchFileWithBuf(ctx, f, part, buf, true, nil); err != nil {
+				part.Remove()
+				return
+			}
+			if err = part.Close(); err != nil {
+				part.Remove()
 				return
 			}
+			path := part.Path()
 			defer os.Remove(path)
 			var srcFd *os.File
 			if srcFd, err = os.Open(path); err != nil {
@@ -1348,19 +1804,29 @@ func (cr *Cluster) DownloadFile(ctx context.Context, hash string) (err error) {
 			}
 			size := stat.Size()
 
-			for _, target := range cr.storages {
+			var holders []int
+			for _, i := range cr.pickStorages(cr.writableIndexes, cr.replication, size) {
+				target := cr.storages[i]
 				if _, err = srcFd.Seek(0, io.SeekStart); err != nil {
 					log.Errorf("Cannot seek file %q: %v", path, err)
 					return
 				}
-				if err := target.Create(hash, srcFd); err != nil {
+				if err := cr.createOnStorage(ctx, i, hash, size, srcFd); err != nil {
 					log.Errorf("Cannot create %q: %v", target.String(), err)
 					continue
 				}
+				holders = append(holders, i)
+			}
+			if len(holders) == 0 {
+				err = fmt.Errorf("Cannot save %s to any storage", hash)
+				return
 			}
 
 			cr.filesetMux.Lock()
 			cr.fileset[hash] = size
+			if cr.fileStorages != nil {
+				cr.fileStorages[hash] = holders
+			}
 			cr.filesetMux.Unlock()
 		}()
 	}
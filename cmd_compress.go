@@ -20,7 +20,6 @@
 package main
 
 import (
-	"compress/gzip"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -28,14 +27,25 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/LiterMC/go-openbmclapi/storage"
 	"github.com/LiterMC/go-openbmclapi/utils"
 )
 
+func parseCompressorOption(value string) storage.Compressor {
+	c, err := storage.ParseCompressor(value)
+	if err != nil || c == storage.NullCompressor {
+		fmt.Printf("Unknown algorithm %q, must be one of zstd,br,gzip,zlib\n", value)
+		os.Exit(2)
+	}
+	return c
+}
+
 func cmdZipCache(args []string) {
 	flagVerbose := false
 	flagAll := false
 	flagOverwrite := false
 	flagKeep := false
+	algorithm := storage.GzipCompressor
 	for _, a := range args {
 		a = strings.ToLower(a)
 		if len(a) > 0 && a[0] == '-' {
@@ -61,6 +71,10 @@ func cmdZipCache(args []string) {
 				continue
 			}
 		}
+		if value, ok := strings.CutPrefix(a, "algorithm="); ok {
+			algorithm = parseCompressorOption(value)
+			continue
+		}
 		switch a {
 		case "verbose", "v":
 			flagVerbose = true
@@ -77,12 +91,13 @@ func cmdZipCache(args []string) {
 	}
 	cacheDir := filepath.Join(baseDir, "cache")
 	fmt.Printf("Cache directory = %q\n", cacheDir)
+	fmt.Printf("Algorithm = %s\n", algorithm)
 	err := utils.WalkCacheDir(cacheDir, func(hash string, _ int64) (_ error) {
 		path := filepath.Join(cacheDir, hash[0:2], hash)
-		if strings.HasSuffix(path, ".gz") {
+		if _, ok := storage.CompressorByExt(path); ok || strings.HasSuffix(path, ".tmp") {
 			return
 		}
-		target := path + ".gz"
+		target := path + algorithm.Ext()
 		if !flagOverwrite {
 			if _, err := os.Stat(target); err == nil {
 				return
@@ -109,11 +124,15 @@ func cmdZipCache(args []string) {
 				fmt.Printf("Error: could not create %q: %v\n", tmpPath, err)
 				return
 			}
-			defer dstFd.Close()
-			w := gzip.NewWriter(dstFd)
-			defer w.Close()
-
-			if _, err = io.Copy(w, srcFd); err != nil {
+			w := algorithm.WrapWriter(dstFd)
+			_, err = io.Copy(w, srcFd)
+			if e := w.Close(); e != nil && err == nil {
+				err = e
+			}
+			if e := dstFd.Close(); e != nil && err == nil {
+				err = e
+			}
+			if err != nil {
 				os.Remove(tmpPath)
 				fmt.Printf("Error: could not compress %q: %v\n", path, err)
 				return
@@ -125,6 +144,7 @@ func cmdZipCache(args []string) {
 				return
 			}
 			if !flagKeep {
+				srcFd.Close()
 				os.Remove(path)
 			}
 		}
@@ -140,6 +160,7 @@ func cmdUnzipCache(args []string) {
 	flagVerbose := false
 	flagOverwrite := false
 	flagKeep := false
+	var algorithms []storage.Compressor
 	for _, a := range args {
 		a = strings.ToLower(a)
 		if len(a) > 0 && a[0] == '-' {
@@ -163,6 +184,10 @@ func cmdUnzipCache(args []string) {
 				continue
 			}
 		}
+		if value, ok := strings.CutPrefix(a, "algorithm="); ok {
+			algorithms = append(algorithms, parseCompressorOption(value))
+			continue
+		}
 		switch a {
 		case "verbose", "v":
 			flagVerbose = true
@@ -175,17 +200,31 @@ func cmdUnzipCache(args []string) {
 			os.Exit(2)
 		}
 	}
+	if len(algorithms) == 0 {
+		algorithms = storage.Compressors
+	}
 	cacheDir := filepath.Join(baseDir, "cache")
 	fmt.Printf("Cache directory = %q\n", cacheDir)
 	var hashBuf [64]byte
-	err := utils.WalkCacheDir(cacheDir, func(hash string, _ int64) (_ error) {
-		path := filepath.Join(cacheDir, hash[0:2], hash)
-		target, ok := strings.CutSuffix(path, ".gz")
+	err := utils.WalkCacheDir(cacheDir, func(name string, _ int64) (_ error) {
+		path := filepath.Join(cacheDir, name[0:2], name)
+		var (
+			algorithm storage.Compressor
+			hash      string
+			ok        bool
+		)
+		for _, c := range algorithms {
+			if hash, ok = strings.CutSuffix(name, c.Ext()); ok {
+				algorithm = c
+				break
+			}
+		}
 		if !ok {
 			return
 		}
+		target := path[:len(path)-len(algorithm.Ext())]
 
-		hashMethod, err := getHashMethod(len(hash))
+		hashMethod, err := utils.GetHashMethod(len(hash))
 		if err != nil {
 			return
 		}
@@ -212,21 +251,33 @@ func cmdUnzipCache(args []string) {
 			return
 		}
 		defer dstFd.Close()
-		r, err := gzip.NewReader(srcFd)
+		r, err := algorithm.WrapReader(srcFd)
 		if err != nil {
+			dstFd.Close()
+			os.Remove(tmpPath)
 			fmt.Printf("Error: could not decompress %q: %v\n", path, err)
 			return
 		}
+		if closer, ok := r.(io.Closer); ok {
+			defer closer.Close()
+		}
 		if _, err = io.Copy(io.MultiWriter(dstFd, hw), r); err != nil {
+			dstFd.Close()
 			os.Remove(tmpPath)
 			fmt.Printf("Error: could not decompress %q: %v\n", path, err)
 			return
 		}
 		if hs := hex.EncodeToString(hw.Sum(hashBuf[:0])); hs != hash {
+			dstFd.Close()
 			os.Remove(tmpPath)
 			fmt.Printf("Error: hash (%s) incorrect for %q. Got %s, want %s\n", hashMethod, path, hs, hash)
 			return
 		}
+		if err = dstFd.Close(); err != nil {
+			os.Remove(tmpPath)
+			fmt.Printf("Error: could not write %q: %v\n", tmpPath, err)
+			return
+		}
 		os.Remove(target)
 		if err = os.Rename(tmpPath, target); err != nil {
 			os.Remove(tmpPath)
@@ -234,6 +285,7 @@ func cmdUnzipCache(args []string) {
 			return
 		}
 		if !flagKeep {
+			srcFd.Close()
 			os.Remove(path)
 		}
 		return
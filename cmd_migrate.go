@@ -0,0 +1,231 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vbauerster/mpb/v8"
+	"github.com/vbauerster/mpb/v8/decor"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/storage"
+)
+
+func printMigrateUsage() {
+	fmt.Println("Usage: migrate [options ...] <source id> <destination id>")
+	fmt.Println("  Options:")
+	fmt.Println("    " + "--delete | -d : Remove the source objects after they are copied and verified")
+	fmt.Println("    " + "--concurrency=<n> : Max number of objects to be copied at the same time")
+}
+
+func cmdMigrate(args []string) {
+	flagDelete := false
+	concurrency := 0
+	ids := make([]string, 0, 2)
+	for _, a := range args {
+		if value, ok := strings.CutPrefix(a, "--concurrency="); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				fmt.Printf("Invalid concurrency %q\n", value)
+				os.Exit(2)
+			}
+			concurrency = n
+			continue
+		}
+		switch a {
+		case "-d", "--delete":
+			flagDelete = true
+		default:
+			if strings.HasPrefix(a, "-") {
+				fmt.Printf("Unknown option %q\n", a)
+				printMigrateUsage()
+				os.Exit(2)
+			}
+			ids = append(ids, a)
+		}
+	}
+	if len(ids) != 2 {
+		printMigrateUsage()
+		os.Exit(2)
+	}
+
+	config = readConfig()
+
+	srcOpt, dstOpt := findStorageOption(ids[0]), findStorageOption(ids[1])
+	if err := storage.CheckMigrateTarget(srcOpt, dstOpt); err != nil {
+		log.Errorf("Cannot migrate from %q to %q: %v", ids[0], ids[1], err)
+		os.Exit(2)
+	}
+
+	ctx := context.Background()
+	src := initStorage(ctx, srcOpt)
+	dst := initStorage(ctx, dstOpt)
+	if src.String() == dst.String() {
+		log.Errorf("Storage %q and %q are the same storage %s", ids[0], ids[1], src.String())
+		os.Exit(2)
+	}
+	log.Infof("From: %s", src.String())
+	log.Infof("To: %s", dst.String())
+
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0) * 4
+	}
+
+	srcFiles, err := storage.ListFiles(ctx, src)
+	if err != nil {
+		log.Errorf("Cannot walk %s: %v", src.String(), err)
+		os.Exit(2)
+	}
+	dstFiles, err := storage.ListFiles(ctx, dst)
+	if err != nil {
+		log.Errorf("Cannot walk %s: %v", dst.String(), err)
+		os.Exit(2)
+	}
+
+	// Objects that already exist at the destination with the same size were copied by a previous run,
+	// so they only need to be verified and removed when deleting is enabled
+	jobs, totalSize := storage.PlanMigrate(srcFiles, dstFiles, flagDelete)
+	log.Infof("%d objects at source, %d objects at destination, %d objects need to be migrated",
+		len(srcFiles), len(dstFiles), len(jobs))
+	if len(jobs) == 0 {
+		return
+	}
+
+	var (
+		barUnit decor.SizeB1024
+		wg      sync.WaitGroup
+
+		doneFiles, failedFiles atomic.Int64
+	)
+	pg := mpb.New(mpb.WithWaitGroup(&wg), mpb.WithRefreshRate(time.Second), mpb.WithAutoRefresh())
+	log.SetLogOutput(pg)
+
+	lastInc := new(atomic.Int64)
+	lastInc.Store(time.Now().UnixNano())
+	totalBar := pg.AddBar(totalSize,
+		mpb.BarRemoveOnComplete(),
+		mpb.BarPriority(concurrency),
+		mpb.PrependDecorators(
+			decor.Name("Total Migrated: "),
+			decor.NewPercentage("%.2f"),
+		),
+		mpb.AppendDecorators(
+			decor.Any(func(decor.Statistics) string {
+				return fmt.Sprintf("(%d / %d) ", doneFiles.Load(), len(jobs))
+			}),
+			decor.Counters(barUnit, "(%.1f / %.1f) "),
+			decor.EwmaSpeed(barUnit, "%.1f ", 30),
+			decor.OnComplete(
+				decor.EwmaETA(decor.ET_STYLE_GO, 30), "done",
+			),
+		),
+	)
+
+	slots := make(chan int, concurrency)
+	for i := 0; i < concurrency; i++ {
+		slots <- i
+	}
+	for _, job := range jobs {
+		slot := <-slots
+		var bar *mpb.Bar
+		if !job.Exists {
+			bar = pg.AddBar(job.Size,
+				mpb.BarPriority(slot),
+				mpb.PrependDecorators(
+					decor.Name(fmt.Sprintf("> Migrating %s", job.Hash), decor.WCSyncSpaceR),
+				),
+				mpb.AppendDecorators(
+					decor.NewPercentage("%d", decor.WCSyncSpace),
+					decor.Counters(barUnit, "(%.1f / %.1f)", decor.WCSyncSpace),
+					decor.EwmaSpeed(barUnit, "%.1f", 10, decor.WCSyncSpace),
+					decor.OnComplete(
+						decor.EwmaETA(decor.ET_STYLE_GO, 10, decor.WCSyncSpace), "done",
+					),
+				),
+			)
+		}
+		wg.Add(1)
+		go func(slot int, bar *mpb.Bar, job storage.MigrateJob) {
+			defer func() { slots <- slot }()
+			defer wg.Done()
+			defer doneFiles.Add(1)
+			if bar != nil {
+				defer func() {
+					bar.Abort(true)
+					if need := job.Size - bar.Current(); need > 0 {
+						totalBar.IncrInt64(need)
+					}
+				}()
+			}
+
+			proxy := func(r io.ReadSeeker) io.ReadSeeker {
+				if bar == nil {
+					return r
+				}
+				return ProxyReadSeeker(r, bar, totalBar, lastInc)
+			}
+			if err := storage.MigrateObject(ctx, src, dst, job, flagDelete, proxy); err != nil {
+				failedFiles.Add(1)
+				log.Errorf("Cannot migrate %s: %v", job.Hash, err)
+				return
+			}
+			log.Debugf("Object %s migrated to %s", job.Hash, dst.String())
+		}(slot, bar, job)
+	}
+
+	pg.Wait()
+	log.SetLogOutput(nil)
+
+	if failed := failedFiles.Load(); failed > 0 {
+		log.Errorf("%d of %d objects failed to migrate, run the command again to retry them", failed, len(jobs))
+		os.Exit(1)
+	}
+	log.Infof("All %d objects are migrated to %s", len(jobs), dst.String())
+}
+
+func findStorageOption(id string) *storage.StorageOption {
+	for i := range config.Storages {
+		if config.Storages[i].Id == id {
+			return &config.Storages[i]
+		}
+	}
+	log.Errorf("Storage %q is not found in the config", id)
+	os.Exit(1)
+	return nil
+}
+
+func initStorage(ctx context.Context, opt *storage.StorageOption) storage.Storage {
+	s := storage.NewStorage(*opt)
+	if err := s.Init(ctx); err != nil {
+		log.Errorf("Cannot initialize %s: %v", s.String(), err)
+		os.Exit(1)
+	}
+	return s
+}
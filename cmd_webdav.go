@@ -112,7 +112,7 @@ func cmdUploadWebdav(args []string) {
 		localFiles  = make(map[string]int64)
 		webdavFiles = make([][]fileInfo, len(webdavs))
 	)
-	local.WalkDir(func(hash string, size int64) error {
+	local.WalkDir(ctx, func(hash string, size int64) error {
 		localFiles[hash] = size
 		return nil
 	})
@@ -137,7 +137,7 @@ func cmdUploadWebdav(args []string) {
 	for i, s := range webdavs {
 		start := time.Now()
 		fileSet := make(map[string]int64)
-		err := s.WalkDir(func(hash string, size int64) error {
+		err := s.WalkDir(ctx, func(hash string, size int64) error {
 			fileSet[hash] = size
 			now := time.Now()
 			webdavBar.EwmaIncrement(now.Sub(start))
@@ -234,7 +234,7 @@ func cmdUploadWebdav(args []string) {
 				bar.SetTotal(size, false)
 
 				log.Debugf("Uploading %s/%s", s.String(), hash)
-				err := s.Create(hash, ProxyReadSeeker(fd, bar, totalBar, lastInc))
+				err := s.Create(ctx, hash, ProxyReadSeeker(fd, bar, totalBar, lastInc))
 				uploadedFiles.Add(1)
 				if err != nil {
 					log.Errorf("Cannot create %s at %s: %v", hash, s.String(), err)
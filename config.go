@@ -27,6 +27,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 
@@ -68,6 +69,54 @@ type ServeLimitConfig struct {
 	UploadRate int  `yaml:"upload-rate"`
 }
 
+type SyncLimitConfig struct {
+	MaxConn      int                 `yaml:"max-conn"`
+	DownloadRate int                 `yaml:"download-rate"`
+	Windows      []utils.DailyWindow `yaml:"windows"`
+}
+
+// InWindow reports whether bulk sync may run at the time.
+// It is always true if there is no window
+func (c *SyncLimitConfig) InWindow(t time.Time) bool {
+	if len(c.Windows) == 0 {
+		return true
+	}
+	for _, w := range c.Windows {
+		if w.Contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+type StorageHealthConfig struct {
+	Enable        bool `yaml:"enable"`
+	MaxFailures   int  `yaml:"max-failures"`
+	ProbeInterval int  `yaml:"probe-interval"`
+	ProbeTimeout  int  `yaml:"probe-timeout"`
+}
+
+type AdaptiveWeightConfig struct {
+	Enable         bool    `yaml:"enable"`
+	Window         int     `yaml:"window"`
+	UpdateInterval int     `yaml:"update-interval"`
+	MinFactor      float64 `yaml:"min-factor"`
+	MaxFactor      float64 `yaml:"max-factor"`
+	MinRequests    int     `yaml:"min-requests"`
+}
+
+type StorageCapacityConfig struct {
+	Enable          bool `yaml:"enable"`
+	MinFree         int  `yaml:"min-free"`
+	RefreshInterval int  `yaml:"refresh-interval"`
+	RefreshTimeout  int  `yaml:"refresh-timeout"`
+}
+
+// MinFreeBytes returns the space in bytes that should be kept free on each storage
+func (c StorageCapacityConfig) MinFreeBytes() int64 {
+	return (int64)(c.MinFree) * 1024 * 1024
+}
+
 type HijackConfig struct {
 	Enable           bool       `yaml:"enable"`
 	EnableLocalCache bool       `yaml:"enable-local-cache"`
@@ -136,14 +185,19 @@ type Config struct {
 	OnlyGcWhenStart      bool   `yaml:"only-gc-when-start"`
 	DownloadMaxConn      int    `yaml:"download-max-conn"`
 
-	Certificates []CertificateConfig            `yaml:"certificates"`
-	Cache        CacheConfig                    `yaml:"cache"`
-	ServeLimit   ServeLimitConfig               `yaml:"serve-limit"`
-	Dashboard    DashboardConfig                `yaml:"dashboard"`
-	Hijack       HijackConfig                   `yaml:"hijack"`
-	Storages     []storage.StorageOption        `yaml:"storages"`
-	WebdavUsers  map[string]*storage.WebDavUser `yaml:"webdav-users"`
-	Advanced     AdvancedConfig                 `yaml:"advanced"`
+	Certificates    []CertificateConfig            `yaml:"certificates"`
+	Cache           CacheConfig                    `yaml:"cache"`
+	ServeLimit      ServeLimitConfig               `yaml:"serve-limit"`
+	SyncLimit       SyncLimitConfig                `yaml:"sync-limit"`
+	Dashboard       DashboardConfig                `yaml:"dashboard"`
+	Hijack          HijackConfig                   `yaml:"hijack"`
+	StorageHealth   StorageHealthConfig            `yaml:"storage-health"`
+	StorageCapacity StorageCapacityConfig          `yaml:"storage-capacity"`
+	AdaptiveWeight  AdaptiveWeightConfig           `yaml:"adaptive-weight"`
+	Replication     int                            `yaml:"replication"`
+	Storages        []storage.StorageOption        `yaml:"storages"`
+	WebdavUsers     map[string]*storage.WebDavUser `yaml:"webdav-users"`
+	Advanced        AdvancedConfig                 `yaml:"advanced"`
 }
 
 func (cfg *Config) applyWebManifest(manifest map[string]any) {
@@ -187,6 +241,12 @@ var defaultConfig = Config{
 		UploadRate: 1024 * 12, // 12MB
 	},
 
+	SyncLimit: SyncLimitConfig{
+		MaxConn:      0,
+		DownloadRate: 0,
+		Windows:      []utils.DailyWindow{},
+	},
+
 	Dashboard: DashboardConfig{
 		Enable:       true,
 		PwaName:      "GoOpenBmclApi Dashboard",
@@ -207,7 +267,31 @@ var defaultConfig = Config{
 		},
 	},
 
-	Storages: nil,
+	StorageHealth: StorageHealthConfig{
+		Enable:        true,
+		MaxFailures:   3,
+		ProbeInterval: 30,
+		ProbeTimeout:  10,
+	},
+
+	StorageCapacity: StorageCapacityConfig{
+		Enable:          true,
+		MinFree:         1024,
+		RefreshInterval: 60,
+		RefreshTimeout:  10,
+	},
+
+	AdaptiveWeight: AdaptiveWeightConfig{
+		Enable:         false,
+		Window:         300,
+		UpdateInterval: 10,
+		MinFactor:      0.2,
+		MaxFactor:      5,
+		MinRequests:    20,
+	},
+
+	Replication: 0,
+	Storages:    nil,
 
 	WebdavUsers: map[string]*storage.WebDavUser{},
 
@@ -224,6 +308,38 @@ var defaultConfig = Config{
 	},
 }
 
+func (cfg *Config) resolveStorageOption(data any) (err error) {
+	switch opt := data.(type) {
+	case *storage.WebDavStorageOption:
+		if alias := opt.Alias; alias != "" {
+			user, ok := cfg.WebdavUsers[alias]
+			if !ok {
+				log.Errorf("Web dav user %q does not exists", alias)
+				osExit(1)
+			}
+			opt.AliasUser = user
+			var end *url.URL
+			if end, err = url.Parse(opt.AliasUser.EndPoint); err != nil {
+				return
+			}
+			if opt.EndPoint != "" {
+				var full *url.URL
+				if full, err = end.Parse(opt.EndPoint); err != nil {
+					return
+				}
+				opt.FullEndPoint = full.String()
+			} else {
+				opt.FullEndPoint = opt.AliasUser.EndPoint
+			}
+		} else {
+			opt.FullEndPoint = opt.EndPoint
+		}
+	case *storage.TieredStorageOption:
+		return cfg.resolveStorageOption(opt.Backend.Data)
+	}
+	return nil
+}
+
 func migrateConfig(data []byte, config *Config) {
 	var oldConfig map[string]any
 	if err := yaml.Unmarshal(data, &oldConfig); err != nil {
@@ -357,6 +473,7 @@ func readConfig() (config Config) {
 						Id:     "local",
 						Type:   storage.StorageLocal,
 						Weight: 100,
+						Mode:   storage.ModeReadWrite,
 					},
 					Data: &storage.LocalStorageOption{
 						CachePath: "cache",
@@ -372,7 +489,11 @@ func readConfig() (config Config) {
 			}
 		}
 		ids := make(map[string]int, len(config.Storages))
+		writable := 0
 		for i, s := range config.Storages {
+			if s.Writable() {
+				writable++
+			}
 			if s.Id == "" {
 				s.Id = fmt.Sprintf("storage-%d", i)
 				config.Storages[i].Id = s.Id
@@ -383,34 +504,14 @@ func readConfig() (config Config) {
 			}
 			ids[s.Id] = i
 		}
+		if writable == 0 {
+			log.Warn("There is no writable storage, new files cannot be synchronized")
+		}
 	}
 
 	for _, so := range config.Storages {
-		switch opt := so.Data.(type) {
-		case *storage.WebDavStorageOption:
-			if alias := opt.Alias; alias != "" {
-				user, ok := config.WebdavUsers[alias]
-				if !ok {
-					log.Errorf("Web dav user %q does not exists", alias)
-					osExit(1)
-				}
-				opt.AliasUser = user
-				var end *url.URL
-				if end, err = url.Parse(opt.AliasUser.EndPoint); err != nil {
-					return
-				}
-				if opt.EndPoint != "" {
-					var full *url.URL
-					if full, err = end.Parse(opt.EndPoint); err != nil {
-						return
-					}
-					opt.FullEndPoint = full.String()
-				} else {
-					opt.FullEndPoint = opt.AliasUser.EndPoint
-				}
-			} else {
-				opt.FullEndPoint = opt.EndPoint
-			}
+		if err = config.resolveStorageOption(so.Data); err != nil {
+			return
 		}
 	}
 
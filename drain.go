@@ -0,0 +1,207 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/storage"
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+// drainStorages migrates the files on the storages in drain mode to the writable storages.
+// It stops when a sync task starts, and will continue after the sync finished
+func (cr *Cluster) drainStorages(ctx context.Context) {
+	if !cr.draining.CompareAndSwap(false, true) {
+		return
+	}
+	defer cr.draining.Store(false)
+
+	for i, opt := range cr.storageOpts {
+		if opt.Mode != storage.ModeDrain {
+			continue
+		}
+		if err := cr.drainStorage(ctx, i); err != nil {
+			if errors.Is(err, context.Canceled) {
+				log.Warnf("Drain interrupted at %s", cr.storages[i].String())
+				return
+			}
+			log.Errorf("Cannot drain %s: %v", cr.storages[i].String(), err)
+		}
+	}
+}
+
+func (cr *Cluster) drainStorage(ctx context.Context, index int) error {
+	sto := cr.storages[index]
+	var hashes []string
+	if err := sto.WalkDir(ctx, func(hash string, _ int64) error {
+		hashes = append(hashes, hash)
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(hashes) == 0 {
+		log.Infof("Storage [%d] %s has been drained, it can be removed from the config now", index, sto.String())
+		return nil
+	}
+
+	log.Infof("Draining %d files from storage [%d] %s", len(hashes), index, sto.String())
+	var migrated, outdated, failed int
+	for _, hash := range hashes {
+		if ctx.Err() != nil || cr.issync.Load() {
+			return context.Canceled
+		}
+		size, ok := cr.CachedFileSize(hash)
+		if ok {
+			added, err := cr.migrateFile(ctx, index, hash, size)
+			if err != nil {
+				log.Errorf("Cannot migrate %s from %s: %v", hash, sto.String(), err)
+				failed++
+				continue
+			}
+			cr.updateFileStorages(hash, added, -1)
+		}
+		if err := sto.Remove(ctx, hash); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("Cannot remove %s from %s: %v", hash, sto.String(), err)
+			failed++
+			continue
+		}
+		cr.updateFileStorages(hash, nil, index)
+		if ok {
+			migrated++
+		} else {
+			outdated++
+		}
+	}
+	log.Infof("Drain finished for %s: %d files migrated, %d outdated files removed, %d files failed", sto.String(), migrated, outdated, failed)
+	return nil
+}
+
+// migrateFile copies the file from the drain storage to the writable storages until it has enough replicas.
+// It returns the indexes of the storages which the file has been written to
+func (cr *Cluster) migrateFile(ctx context.Context, from int, hash string, size int64) (added []int, err error) {
+	holders := cr.CachedFileStorages(hash)
+	if len(holders) == 0 {
+		holders = cr.storageIndexes
+	}
+	durable := 0
+	for _, i := range holders {
+		if cr.storageOpts[i].Mode != storage.ModeDrain {
+			durable++
+		}
+	}
+	candidates := make([]int, 0, len(cr.writableIndexes))
+	for _, i := range cr.writableIndexes {
+		if !slices.Contains(holders, i) {
+			candidates = append(candidates, i)
+		}
+	}
+	replication := min(cr.replication, durable+len(candidates))
+	if durable >= replication {
+		return nil, nil
+	}
+	targets := cr.pickStorages(candidates, replication-durable, size)
+	if len(targets) == 0 {
+		if durable > 0 {
+			return nil, nil
+		}
+		return nil, errors.New("No storage can hold the file")
+	}
+
+	hashMethod, err := utils.GetHashMethod(len(hash))
+	if err != nil {
+		return
+	}
+	r, err := cr.storages[from].Open(ctx, hash)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	fd, err := os.CreateTemp("", "*.draining")
+	if err != nil {
+		return
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+
+	hw := hashMethod.New()
+	if _, err = io.Copy(io.MultiWriter(fd, hw), r); err != nil {
+		return
+	}
+	if hs := hex.EncodeToString(hw.Sum(nil)); hs != hash {
+		return nil, fmt.Errorf("File hash mismatch, got %s", hs)
+	}
+
+	for _, i := range targets {
+		if ctx.Err() != nil {
+			return added, ctx.Err()
+		}
+		if _, err = fd.Seek(0, io.SeekStart); err != nil {
+			return
+		}
+		if err := cr.createOnStorage(ctx, i, hash, size, fd); err != nil {
+			log.Errorf("Cannot create %s/%s: %v", cr.storages[i].String(), hash, err)
+			continue
+		}
+		added = append(added, i)
+	}
+	if len(added) == 0 && durable == 0 {
+		return nil, errors.New("Cannot write the file to any storage")
+	}
+	return added, nil
+}
+
+// updateFileStorages records that the file has been written to the added storages,
+// and has been removed from the removed storage if it is not negative
+func (cr *Cluster) updateFileStorages(hash string, added []int, removed int) {
+	if len(added) == 0 && removed < 0 {
+		return
+	}
+	cr.filesetMux.Lock()
+	defer cr.filesetMux.Unlock()
+	if cr.fileStorages == nil {
+		return
+	}
+	old, ok := cr.fileStorages[hash]
+	if !ok {
+		return
+	}
+	if len(old) == 0 {
+		old = cr.storageIndexes
+	}
+	// the slices may be shared, so always create a new one
+	holders := make([]int, 0, len(old)+len(added))
+	for _, i := range old {
+		if i != removed && !slices.Contains(added, i) {
+			holders = append(holders, i)
+		}
+	}
+	holders = append(holders, added...)
+	sort.Ints(holders)
+	cr.fileStorages[hash] = holders
+}
@@ -0,0 +1,124 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package filelist compares the file lists of the syncs
+package filelist
+
+import (
+	"slices"
+	"strings"
+)
+
+type FileInfo struct {
+	Path string `json:"path" avro:"path"`
+	Hash string `json:"hash" avro:"hash"`
+	Size int64  `json:"size" avro:"size"`
+}
+
+func compareFile(a, b FileInfo) int {
+	if c := strings.Compare(a.Hash, b.Hash); c != 0 {
+		return c
+	}
+	return strings.Compare(a.Path, b.Path)
+}
+
+// Sort sorts the files by hash, and then by path since a hash may appear more than once
+func Sort(files []FileInfo) {
+	slices.SortFunc(files, compareFile)
+}
+
+// Synced returns the files which are held by at least one storage.
+// The files failed to download are left out, so they will be downloaded on demand and be retried in the next sync
+func Synced(files []FileInfo, placement map[string][]int) []FileInfo {
+	var synced []FileInfo
+	for i, f := range files {
+		if holders, ok := placement[f.Hash]; ok && len(holders) == 0 {
+			if synced == nil {
+				synced = make([]FileInfo, i, len(files))
+				copy(synced, files[:i])
+			}
+			continue
+		}
+		if synced != nil {
+			synced = append(synced, f)
+		}
+	}
+	if synced == nil {
+		return files
+	}
+	return synced
+}
+
+// Diff is the difference between two file lists
+type Diff struct {
+	Added   []FileInfo
+	Changed []FileInfo // the files whose size have changed
+	Removed []FileInfo
+}
+
+// Compare compares the file lists by hash and path, both of them must be sorted by Sort.
+// A file moved to another path is reported as removed from the old path and added to the new one
+func Compare(old, cur []FileInfo) (d Diff) {
+	i, j := 0, 0
+	for i < len(old) && j < len(cur) {
+		o, c := old[i], cur[j]
+		switch compareFile(o, c) {
+		case -1:
+			d.Removed = append(d.Removed, o)
+			i++
+		case 1:
+			d.Added = append(d.Added, c)
+			j++
+		default:
+			if o.Size != c.Size {
+				d.Changed = append(d.Changed, c)
+			}
+			i++
+			j++
+		}
+	}
+	d.Removed = append(d.Removed, old[i:]...)
+	d.Added = append(d.Added, cur[j:]...)
+	return
+}
+
+// Apply builds the fileset and the storage holders of files, which is the file list after the sync.
+// The holders of a file are taken from placement if it is synced, otherwise from prev.
+// It also returns the holders of the removed hashes which are no longer used by any path,
+// and the holders will be nil if they are unknown
+func (d Diff) Apply(files []FileInfo, placement, prev map[string][]int) (fileset map[string]int64, holders, removed map[string][]int) {
+	fileset = make(map[string]int64, len(files))
+	holders = make(map[string][]int, len(files))
+	for _, f := range files {
+		fileset[f.Hash] = f.Size
+		if h, ok := placement[f.Hash]; ok {
+			holders[f.Hash] = h
+		} else {
+			holders[f.Hash] = prev[f.Hash]
+		}
+	}
+	removed = make(map[string][]int, len(d.Removed))
+	for _, f := range d.Removed {
+		// the hash may still be used by another path
+		if _, ok := fileset[f.Hash]; !ok {
+			removed[f.Hash] = prev[f.Hash]
+		}
+	}
+	return
+}
@@ -0,0 +1,120 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filelist_test
+
+import (
+	"slices"
+	"testing"
+
+	. "github.com/LiterMC/go-openbmclapi/filelist"
+)
+
+func sorted(files ...FileInfo) []FileInfo {
+	Sort(files)
+	return files
+}
+
+func TestCompare(t *testing.T) {
+	var (
+		a1 = FileInfo{Path: "/a", Hash: "aa", Size: 1}
+		b1 = FileInfo{Path: "/b", Hash: "aa", Size: 1}
+		c2 = FileInfo{Path: "/c", Hash: "cc", Size: 2}
+		c3 = FileInfo{Path: "/c", Hash: "cc", Size: 3}
+		d4 = FileInfo{Path: "/d", Hash: "dd", Size: 4}
+	)
+	var data = []struct {
+		Name     string
+		Old, Cur []FileInfo
+		Diff     Diff
+	}{
+		{"same", sorted(a1, c2), sorted(c2, a1), Diff{}},
+		{"added and removed", sorted(a1, c2), sorted(c2, d4), Diff{Added: []FileInfo{d4}, Removed: []FileInfo{a1}}},
+		{"size changed", sorted(a1, c2), sorted(a1, c3), Diff{Changed: []FileInfo{c3}}},
+		{"duplicated hash removed", sorted(a1, b1, c2), sorted(b1, c2), Diff{Removed: []FileInfo{a1}}},
+		{"duplicated hash added", sorted(b1), sorted(a1, b1), Diff{Added: []FileInfo{a1}}},
+		{"hash moved", sorted(a1, c2), sorted(b1, c2), Diff{Added: []FileInfo{b1}, Removed: []FileInfo{a1}}},
+		{"from empty", nil, sorted(a1, b1), Diff{Added: []FileInfo{a1, b1}}},
+		{"to empty", sorted(a1, b1), nil, Diff{Removed: []FileInfo{a1, b1}}},
+	}
+	for _, d := range data {
+		got := Compare(d.Old, d.Cur)
+		if !slices.Equal(got.Added, d.Diff.Added) || !slices.Equal(got.Changed, d.Diff.Changed) || !slices.Equal(got.Removed, d.Diff.Removed) {
+			t.Errorf("%s: expected %+v, got %+v", d.Name, d.Diff, got)
+		}
+	}
+}
+
+func TestDiffApply(t *testing.T) {
+	var (
+		a = FileInfo{Path: "/a", Hash: "aa", Size: 1}
+		b = FileInfo{Path: "/b", Hash: "aa", Size: 1}
+		c = FileInfo{Path: "/c", Hash: "cc", Size: 2}
+		d = FileInfo{Path: "/d", Hash: "dd", Size: 4}
+		e = FileInfo{Path: "/e", Hash: "ee", Size: 5}
+	)
+	old := sorted(a, b, c, d)
+	cur := sorted(b, e)
+	prev := map[string][]int{
+		"aa": {0},
+		"cc": {0, 1},
+		// "dd" is unknown to the storages
+	}
+	placement := map[string][]int{
+		"ee": {1},
+	}
+	fileset, holders, removed := Compare(old, cur).Apply(cur, placement, prev)
+
+	if len(fileset) != 2 || fileset["aa"] != 1 || fileset["ee"] != 5 {
+		t.Errorf("Unexpected fileset %v", fileset)
+	}
+	if len(holders) != 2 || !slices.Equal(holders["aa"], []int{0}) || !slices.Equal(holders["ee"], []int{1}) {
+		t.Errorf("Unexpected holders %v", holders)
+	}
+	if _, ok := removed["aa"]; ok {
+		t.Errorf("Hash aa is still used by path /b, it should not be removed")
+	}
+	if h, ok := removed["cc"]; !ok || !slices.Equal(h, []int{0, 1}) {
+		t.Errorf("Hash cc should be removed from storages [0 1], got %v, %v", h, ok)
+	}
+	if h, ok := removed["dd"]; !ok || h != nil {
+		t.Errorf("Hash dd should be removed with unknown storages, got %v, %v", h, ok)
+	}
+	if len(removed) != 2 {
+		t.Errorf("Unexpected removed %v", removed)
+	}
+}
+
+func TestSynced(t *testing.T) {
+	var (
+		a = FileInfo{Path: "/a", Hash: "aa", Size: 1}
+		c = FileInfo{Path: "/c", Hash: "cc", Size: 2}
+		d = FileInfo{Path: "/d", Hash: "dd", Size: 4}
+	)
+	files := sorted(a, c, d)
+	if got := Synced(files, map[string][]int{"aa": {0}}); !slices.Equal(got, files) {
+		t.Errorf("Files not in placement should be kept, got %v", got)
+	}
+	if got := Synced(files, map[string][]int{"cc": {}}); !slices.Equal(got, []FileInfo{a, d}) {
+		t.Errorf("Files failed to download should be left out, got %v", got)
+	}
+	if !slices.Equal(files, []FileInfo{a, c, d}) {
+		t.Errorf("The origin list should not be modified, got %v", files)
+	}
+}
@@ -0,0 +1,144 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filelist
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Manifest is the last verified fileset and the storages which hold each file
+type Manifest struct {
+	Time time.Time `json:"time"`
+	// Storages are the ids of the storages, the indexes in Files refer to this list
+	// so the manifest can still be used after the storages are reordered
+	Storages []string       `json:"storages"`
+	Files    []ManifestFile `json:"files"`
+}
+
+type ManifestFile struct {
+	Hash     string `json:"h"`
+	Size     int64  `json:"s"`
+	Path     string `json:"p,omitempty"` // only recorded when it is not the default download path
+	Storages []int  `json:"st"`
+}
+
+// NewManifest records the files which have holders in fileStorages.
+// The files with an empty holder list are recorded as held by defaultHolders
+func NewManifest(storages []string, files []FileInfo, fileStorages map[string][]int, defaultHolders []int) *Manifest {
+	m := &Manifest{
+		Time:     time.Now(),
+		Storages: storages,
+		Files:    make([]ManifestFile, 0, len(fileStorages)),
+	}
+	for _, f := range files {
+		holders, ok := fileStorages[f.Hash]
+		if !ok {
+			continue
+		}
+		if len(holders) == 0 {
+			holders = defaultHolders
+		}
+		mf := ManifestFile{
+			Hash:     f.Hash,
+			Size:     f.Size,
+			Storages: holders,
+		}
+		if !strings.HasPrefix(f.Path, "/openbmclapi/download/") {
+			mf.Path = f.Path
+		}
+		m.Files = append(m.Files, mf)
+	}
+	return m
+}
+
+// DecodeManifest decodes a gzipped manifest
+func DecodeManifest(r io.Reader) (*Manifest, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	m := new(Manifest)
+	if err := json.NewDecoder(zr).Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Encode encodes the manifest with gzip
+func (m *Manifest) Encode(w io.Writer) error {
+	zw := gzip.NewWriter(w)
+	if err := json.NewEncoder(zw).Encode(m); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// Placement maps the recorded holders to the indexes in storages.
+// The holders that no longer exist are dropped, and so are the files left without any holder.
+// The files which have a custom path are returned as records
+func (m *Manifest) Placement(storages []string) (fileset map[string]int64, fileStorages map[string][]int, records []FileInfo, err error) {
+	indexes := make(map[string]int, len(storages))
+	for i, id := range storages {
+		indexes[id] = i
+	}
+	// maps the storage indexes in the manifest to the current indexes, -1 if the storage is removed
+	mapping := make([]int, len(m.Storages))
+	for i, id := range m.Storages {
+		if j, ok := indexes[id]; ok {
+			mapping[i] = j
+		} else {
+			mapping[i] = -1
+		}
+	}
+
+	fileset = make(map[string]int64, len(m.Files))
+	fileStorages = make(map[string][]int, len(m.Files))
+	for _, f := range m.Files {
+		holders := make([]int, 0, len(f.Storages))
+		for _, i := range f.Storages {
+			if i < 0 || i >= len(mapping) {
+				return nil, nil, nil, errors.New("Storage index out of range")
+			}
+			if j := mapping[i]; j >= 0 {
+				holders = append(holders, j)
+			}
+		}
+		if len(holders) == 0 {
+			continue
+		}
+		sort.Ints(holders)
+		fileset[f.Hash] = f.Size
+		fileStorages[f.Hash] = holders
+		if f.Path != "" {
+			records = append(records, FileInfo{
+				Path: f.Path,
+				Hash: f.Hash,
+				Size: f.Size,
+			})
+		}
+	}
+	return
+}
@@ -0,0 +1,101 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package filelist_test
+
+import (
+	"bytes"
+	"maps"
+	"slices"
+	"testing"
+
+	. "github.com/LiterMC/go-openbmclapi/filelist"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	var (
+		a = FileInfo{Path: "/openbmclapi/download/aa", Hash: "aa", Size: 1}
+		b = FileInfo{Path: "/custom/b", Hash: "bb", Size: 2}
+		c = FileInfo{Path: "/openbmclapi/download/cc", Hash: "cc", Size: 3}
+		d = FileInfo{Path: "/openbmclapi/download/dd", Hash: "dd", Size: 4}
+		e = FileInfo{Path: "/openbmclapi/download/ee", Hash: "ee", Size: 5}
+	)
+	files := sorted(a, b, c, d, e)
+	fileStorages := map[string][]int{
+		"aa": {0, 2},
+		"bb": {1},
+		"cc": nil, // held by all storages
+		"dd": {0},
+		// "ee" failed to sync
+	}
+	saved := NewManifest([]string{"s0", "s1", "s2"}, files, fileStorages, []int{0, 1, 2})
+
+	var buf bytes.Buffer
+	if err := saved.Encode(&buf); err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	loaded, err := DecodeManifest(&buf)
+	if err != nil {
+		t.Fatalf("DecodeManifest: %v", err)
+	}
+	if !loaded.Time.Equal(saved.Time) {
+		t.Errorf("Expected time %v, got %v", saved.Time, loaded.Time)
+	}
+
+	// s0 is removed and the others are reordered
+	fileset, holders, records, err := loaded.Placement([]string{"s2", "new", "s1"})
+	if err != nil {
+		t.Fatalf("Placement: %v", err)
+	}
+	expectFileset := map[string]int64{"aa": 1, "bb": 2, "cc": 3}
+	if !maps.Equal(fileset, expectFileset) {
+		t.Errorf("Expected fileset %v, got %v", expectFileset, fileset)
+	}
+	expectHolders := map[string][]int{"aa": {0}, "bb": {2}, "cc": {0, 2}}
+	if !maps.EqualFunc(holders, expectHolders, slices.Equal[[]int]) {
+		t.Errorf("Expected holders %v, got %v", expectHolders, holders)
+	}
+	if !slices.Equal(records, []FileInfo{b}) {
+		t.Errorf("Only the custom path should be recorded, got %v", records)
+	}
+
+	// the same storages should get the same placement back
+	fileset, holders, _, err = loaded.Placement([]string{"s0", "s1", "s2"})
+	if err != nil {
+		t.Fatalf("Placement: %v", err)
+	}
+	expectFileset = map[string]int64{"aa": 1, "bb": 2, "cc": 3, "dd": 4}
+	if !maps.Equal(fileset, expectFileset) {
+		t.Errorf("Expected fileset %v, got %v", expectFileset, fileset)
+	}
+	expectHolders = map[string][]int{"aa": {0, 2}, "bb": {1}, "cc": {0, 1, 2}, "dd": {0}}
+	if !maps.EqualFunc(holders, expectHolders, slices.Equal[[]int]) {
+		t.Errorf("Expected holders %v, got %v", expectHolders, holders)
+	}
+}
+
+func TestManifestBadIndex(t *testing.T) {
+	m := &Manifest{
+		Storages: []string{"s0"},
+		Files:    []ManifestFile{{Hash: "aa", Size: 1, Storages: []int{1}}},
+	}
+	if _, _, _, err := m.Placement([]string{"s0"}); err == nil {
+		t.Errorf("Placement should fail for an out of range storage index")
+	}
+}
@@ -4,6 +4,7 @@ go 1.21.6
 
 require (
 	github.com/LiterMC/socket.io v0.2.4
+	github.com/andybalholm/brotli v1.1.0
 	github.com/golang-jwt/jwt/v5 v5.2.0
 	github.com/gregjones/httpcache v0.0.0-20190611155906-901d90724c79
 	github.com/hamba/avro/v2 v2.18.0
@@ -12,6 +13,8 @@ require (
 	github.com/redis/go-redis/v9 v9.4.0
 	github.com/studio-b12/gowebdav v0.9.0
 	github.com/vbauerster/mpb/v8 v8.7.2
+	golang.org/x/net v0.21.0
+	golang.org/x/sys v0.17.0
 	gopkg.in/yaml.v3 v3.0.1
 )
 
@@ -27,6 +30,4 @@ require (
 	github.com/modern-go/concurrent v0.0.0-20180306012644-bacd9c7ef1dd // indirect
 	github.com/modern-go/reflect2 v1.0.2 // indirect
 	github.com/rivo/uniseg v0.4.4 // indirect
-	golang.org/x/net v0.21.0 // indirect
-	golang.org/x/sys v0.17.0 // indirect
 )
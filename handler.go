@@ -28,6 +28,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/textproto"
@@ -55,6 +56,7 @@ type statusResponseWriter struct {
 }
 
 var _ http.Hijacker = (*statusResponseWriter)(nil)
+var _ io.ReaderFrom = (*statusResponseWriter)(nil)
 
 func (w *statusResponseWriter) WriteHeader(status int) {
 	if w.status == 0 {
@@ -69,6 +71,18 @@ func (w *statusResponseWriter) Write(buf []byte) (n int, err error) {
 	return
 }
 
+// ReadFrom passes r to the underlying writer,
+// so files can be sent with sendfile(2) when the connection supports it
+func (w *statusResponseWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, r)
+	}
+	w.wrote += n
+	return
+}
+
 func (w *statusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	h, ok := w.ResponseWriter.(http.Hijacker)
 	if ok {
@@ -77,6 +91,68 @@ func (w *statusResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return nil, nil, errors.New("ResponseWriter is not http.Hijacker")
 }
 
+// limitedResponseWriter limits the write rate of the response body.
+// It does not implement io.ReaderFrom, so the body will always pass through the limiter
+type limitedResponseWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (w *limitedResponseWriter) Write(buf []byte) (int, error) {
+	return w.w.Write(buf)
+}
+
+func (w *limitedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// firstByteResponseWriter records when the response is started,
+// so the latency of storages which redirect and which send the file can be compared
+type firstByteResponseWriter struct {
+	http.ResponseWriter
+	start time.Time
+	ttfb  time.Duration
+}
+
+var _ io.ReaderFrom = (*firstByteResponseWriter)(nil)
+
+func (w *firstByteResponseWriter) mark() {
+	if w.ttfb == 0 {
+		w.ttfb = max(time.Since(w.start), 1)
+	}
+}
+
+func (w *firstByteResponseWriter) WriteHeader(status int) {
+	w.mark()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *firstByteResponseWriter) Write(buf []byte) (int, error) {
+	w.mark()
+	return w.ResponseWriter.Write(buf)
+}
+
+func (w *firstByteResponseWriter) ReadFrom(r io.Reader) (int64, error) {
+	w.mark()
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(w.ResponseWriter, r)
+}
+
+func (w *firstByteResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Latency returns the time to the first byte of the response,
+// or the time since start if nothing has been written yet
+func (w *firstByteResponseWriter) Latency() time.Duration {
+	if w.ttfb == 0 {
+		return time.Since(w.start)
+	}
+	return w.ttfb
+}
+
 const (
 	RealAddrCtxKey       = "handle.real.addr"
 	RealPathCtxKey       = "handle.real.path"
@@ -450,6 +526,9 @@ func (cr *Cluster) handleDownload(rw http.ResponseWriter, req *http.Request, has
 		}
 	}
 
+	// the files missing in the fileset are counted as well, so they can be synchronized first
+	cr.popularity.Hit(hash)
+
 	var err error
 	// check if file was indexed in the fileset
 	size, ok := cr.CachedFileSize(hash)
@@ -459,17 +538,33 @@ func (cr *Cluster) handleDownload(rw http.ResponseWriter, req *http.Request, has
 			return
 		}
 	}
-	var sto storage.Storage
-	forEachFromRandomIndexWithPossibility(cr.storageWeights, cr.storageTotalWeight, func(i int) bool {
+	var (
+		sto  storage.Storage
+		busy []int
+	)
+	serve := func(i int) bool {
 		sto = cr.storages[i]
 		log.Debugf("[handler]: Checking %s on storage [%d] %s ...", hash, i, sto.String())
 
-		sz, er := sto.ServeDownload(rw, req, hash, size)
+		w := rw
+		if limit := cr.storageLimits[i]; limit != nil {
+			lw := limit.NewWriter(rw)
+			defer lw.Close()
+			w = &limitedResponseWriter{ResponseWriter: rw, w: lw}
+		}
+		fw := &firstByteResponseWriter{ResponseWriter: w, start: time.Now()}
+		sz, er := sto.ServeDownload(fw, req, hash, size)
 		if er != nil {
 			log.Debugf("[handler]: File %s failed on storage [%d] %s: %v", hash, i, sto.String(), er)
+			cr.reportStorageError(i, er)
 			err = er
 			return false
 		}
+		err = nil
+		// use the time to first byte, so storages are not ranked by the size of the files they served
+		latency := fw.Latency()
+		cr.storageHealths[i].OnSuccess(latency)
+		cr.storageWindows[i].Record(latency, nil)
 		if sz >= 0 {
 			if keepaliveRec {
 				cr.hits.Add(1)
@@ -480,7 +575,26 @@ func (cr *Cluster) handleDownload(rw http.ResponseWriter, req *http.Request, has
 			}
 		}
 		return true
+	}
+	done := cr.forEachHealthyStorage(cr.CachedFileStorages(hash), func(i int) bool {
+		if limit := cr.storageLimits[i]; limit != nil && !limit.TryAcquire() {
+			log.Debugf("[handler]: Storage [%d] %s reached its serve limit, trying the next one", i, cr.storages[i].String())
+			busy = append(busy, i)
+			return false
+		}
+		return serve(i)
 	})
+	// all the available storages are busy, wait for them in the same order
+	for _, i := range busy {
+		if done {
+			break
+		}
+		if !cr.storageLimits[i].AcquireWithContext(req.Context()) {
+			err = req.Context().Err()
+			break
+		}
+		done = serve(i)
+	}
 	if sto != nil {
 		SetAccessInfo(req, "storage", sto.String())
 	}
@@ -47,6 +47,7 @@ func printHelp() {
 	fmt.Println("      " + "all | a : Compress all files")
 	fmt.Println("      " + "overwrite | o : Overwrite compressed file even if it exists")
 	fmt.Println("      " + "keep | k : Keep uncompressed file")
+	fmt.Println("      " + "algorithm=<zstd|br|gzip|zlib> : Compression algorithm, default is gzip")
 	fmt.Println()
 	fmt.Println("  unzip-cache [options ...]")
 	fmt.Println("  \t" + "Decompress the cache directory")
@@ -55,7 +56,16 @@ func printHelp() {
 	fmt.Println("      " + "verbose | v : Show decompressing files")
 	fmt.Println("      " + "overwrite | o : Overwrite uncompressed file even if it exists")
 	fmt.Println("      " + "keep | k : Keep compressed file")
+	fmt.Println("      " + "algorithm=<zstd|br|gzip|zlib> : Only decompress files with the algorithm, default is all")
 	fmt.Println()
 	fmt.Println("  upload-webdav")
 	fmt.Println("  \t" + "Upload objects from local storage to webdav storage")
+	fmt.Println()
+	fmt.Println("  migrate [options ...] <source id> <destination id>")
+	fmt.Println("  \t" + "Copy objects between two storages in the config, and verify them after copied")
+	fmt.Println("  \t" + "The objects already exist at the destination will be skipped, so it can be resumed after interrupted")
+	fmt.Println()
+	fmt.Println("    Options:")
+	fmt.Println("      " + "--delete | -d : Remove the source objects after they are copied and verified")
+	fmt.Println("      " + "--concurrency=<n> : Max number of objects to be copied at the same time, default is 4 times of the CPU count")
 }
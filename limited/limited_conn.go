@@ -205,6 +205,38 @@ func (l *RateController) preWrite(n int) (int, time.Duration) {
 	return n, 0
 }
 
+// WriteExhausted reports whether the write rate of the current second has been used up
+func (l *RateController) WriteExhausted() bool {
+	if l.writeRate <= 0 {
+		return false
+	}
+	l.wmux.Lock()
+	defer l.wmux.Unlock()
+	return time.Since(l.lastWrite) < time.Second && l.wroteCount >= l.writeRate
+}
+
+// TryAcquire acquires a slot without waiting.
+// It fails if the controller is closed, there is no free slot, or the write rate has been used up
+func (l *RateController) TryAcquire() bool {
+	if l.closed.Load() || l.WriteExhausted() {
+		return false
+	}
+	return l.Semaphore.TryAcquire()
+}
+
+// NewWriter wraps w with the write rate of the controller.
+// The writer releases a slot when it is closed, so a slot must be acquired before calling NewWriter
+func (l *RateController) NewWriter(w io.Writer) *LimitedWriter {
+	return &LimitedWriter{Writer: w, controller: l}
+}
+
+// NewReader wraps r with the read rate of the controller.
+// The reader releases a slot when it is closed, so either a slot is acquired before calling NewReader,
+// or the reader must not be closed
+func (l *RateController) NewReader(r io.Reader) *LimitedReader {
+	return &LimitedReader{Reader: r, controller: l}
+}
+
 // Close will interrupted the incoming operations
 // it will not close or interrupt the proxied connections and its operations
 func (l *RateController) Close() error {
@@ -378,6 +410,7 @@ type LimitedConn struct {
 }
 
 var _ net.Conn = (*LimitedConn)(nil)
+var _ io.ReaderFrom = (*LimitedConn)(nil)
 
 func (c *LimitedConn) Read(buf []byte) (n int, err error) {
 	if !c.readAfter.IsZero() {
@@ -412,26 +445,9 @@ func (c *LimitedConn) Write(buf []byte) (n int, err error) {
 	}
 	var n0 int
 	for n < len(buf) {
-		if !c.writeAfter.IsZero() {
-			now := time.Now()
-			if dur := c.writeAfter.Sub(now); dur > 0 {
-				if !c.writeDeadline.IsZero() {
-					if deadDur := c.writeDeadline.Sub(now); deadDur < dur {
-						if deadDur > 0 {
-							time.Sleep(deadDur)
-						}
-						err = os.ErrDeadlineExceeded
-						return
-					}
-				}
-				time.Sleep(dur)
-			}
-		}
-		m, dur := c.controller.preWrite(len(buf) - n)
-		if dur > 0 {
-			c.writeAfter = time.Now().Add(dur)
-		} else {
-			c.writeAfter = time.Time{}
+		var m int
+		if m, err = c.preWrite(len(buf) - n); err != nil {
+			return
 		}
 		if m > 0 {
 			n0, err = c.Conn.Write(buf[n : n+m])
@@ -444,6 +460,89 @@ func (c *LimitedConn) Write(buf []byte) (n int, err error) {
 	return
 }
 
+// preWrite waits until the connection is allowed to write, and returns how many bytes can be written
+func (c *LimitedConn) preWrite(n int) (int, error) {
+	if !c.writeAfter.IsZero() {
+		now := time.Now()
+		if dur := c.writeAfter.Sub(now); dur > 0 {
+			if !c.writeDeadline.IsZero() {
+				if deadDur := c.writeDeadline.Sub(now); deadDur < dur {
+					if deadDur > 0 {
+						time.Sleep(deadDur)
+					}
+					return 0, os.ErrDeadlineExceeded
+				}
+			}
+			time.Sleep(dur)
+		}
+	}
+	m, dur := c.controller.preWrite(n)
+	if dur > 0 {
+		c.writeAfter = time.Now().Add(dur)
+	} else {
+		c.writeAfter = time.Time{}
+	}
+	return m, nil
+}
+
+// readFromChunkSize is the max size that passed to the underlying ReadFrom at once
+// when the write rate is limited and the size of the reader is unknown
+const readFromChunkSize = 1024 * 1024
+
+// ReadFrom implements io.ReaderFrom.
+// If the underlying connection implements io.ReaderFrom (e.g. *net.TCPConn),
+// the data will be passed to it in rate limited chunks, so sendfile(2) or splice(2) can still be used
+func (c *LimitedConn) ReadFrom(r io.Reader) (n int64, err error) {
+	rf, ok := c.Conn.(io.ReaderFrom)
+	if !ok {
+		return io.Copy(writerOnly{c}, r)
+	}
+	// unwrap the limited reader, so the underlying connection can still see the file
+	remain := (int64)(-1)
+	lr, limited := r.(*io.LimitedReader)
+	if limited {
+		r, remain = lr.R, lr.N
+		defer func() { lr.N = remain }()
+	}
+	if c.controller.WriteRate() <= 0 {
+		if limited {
+			n, err = rf.ReadFrom(&io.LimitedReader{R: r, N: remain})
+			remain -= n
+			return
+		}
+		return rf.ReadFrom(r)
+	}
+	for remain != 0 {
+		chunk := (int64)(readFromChunkSize)
+		if limited && remain < chunk {
+			chunk = remain
+		}
+		var m int
+		if m, err = c.preWrite((int)(chunk)); err != nil {
+			return
+		}
+		if m <= 0 {
+			continue
+		}
+		var n0 int64
+		n0, err = rf.ReadFrom(&io.LimitedReader{R: r, N: (int64)(m)})
+		n += n0
+		if limited {
+			remain -= n0
+		}
+		if err != nil || n0 < (int64)(m) {
+			// EOF or error
+			return
+		}
+	}
+	return
+}
+
+// writerOnly hides the ReadFrom method to avoid recursion
+type writerOnly struct {
+	io.Writer
+}
+
 func (c *LimitedConn) Close() error {
 	if c.closed.CompareAndSwap(false, true) {
 		c.controller.Release()
@@ -22,9 +22,12 @@ package limited
 import (
 	"testing"
 
+	"bytes"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"time"
 )
 
 type pipeListener struct {
@@ -148,3 +151,121 @@ func TestLimitedListener(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestLimitedConnReadFrom(t *testing.T) {
+	data := make([]byte, 384*1024)
+	for i := range data {
+		data[i] = (byte)(i * 7)
+	}
+	fd, err := os.CreateTemp(t.TempDir(), "readfrom")
+	if err != nil {
+		t.Fatalf("Cannot create temp file: %v", err)
+	}
+	defer fd.Close()
+	if _, err := fd.Write(data); err != nil {
+		t.Fatalf("Cannot write temp file: %v", err)
+	}
+
+	for _, rate := range []int{0, 256 * 1024} {
+		tl, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Cannot listen: %v", err)
+		}
+		l := NewLimitedListener(tl, 1, 0, rate)
+
+		received := make(chan []byte, 1)
+		go func() {
+			conn, err := net.Dial("tcp", tl.Addr().String())
+			if err != nil {
+				received <- nil
+				return
+			}
+			defer conn.Close()
+			buf, _ := io.ReadAll(conn)
+			received <- buf
+		}()
+
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatalf("Cannot accept: %v", err)
+		}
+		if _, err := fd.Seek(0, io.SeekStart); err != nil {
+			t.Fatalf("Cannot seek: %v", err)
+		}
+		const limit = 320 * 1024
+		lr := &io.LimitedReader{R: fd, N: limit}
+		start := time.Now()
+		n, err := conn.(io.ReaderFrom).ReadFrom(lr)
+		used := time.Since(start)
+		conn.Close()
+		l.Close()
+		if err != nil {
+			t.Errorf("ReadFrom error with rate %d: %v", rate, err)
+		}
+		if n != limit || lr.N != 0 {
+			t.Errorf("Expected %d bytes to be sent, got %d, %d remain", limit, n, lr.N)
+		}
+		if buf := <-received; !bytes.Equal(buf, data[:limit]) {
+			t.Errorf("Received data mismatch with rate %d, got %d bytes", rate, len(buf))
+		}
+		if rate > 0 && used < time.Second*9/10 {
+			t.Errorf("ReadFrom is not rate limited, sent %d bytes in %v", n, used)
+		}
+	}
+}
+
+func TestRateControllerTryAcquire(t *testing.T) {
+	l := NewRateController(2, 0, 0)
+	if !l.TryAcquire() || !l.TryAcquire() {
+		t.Fatalf("TryAcquire should succeed when there are free slots")
+	}
+	if l.TryAcquire() {
+		t.Fatalf("TryAcquire should fail when all slots are used")
+	}
+	l.Release()
+	if !l.TryAcquire() {
+		t.Errorf("TryAcquire should succeed after a slot is released")
+	}
+
+	l = NewRateController(0, 0, 1024)
+	if !l.TryAcquire() {
+		t.Fatalf("TryAcquire should succeed without a connection limit")
+	}
+	var buf bytes.Buffer
+	w := l.NewWriter(&buf)
+	if _, err := w.Write(make([]byte, 1024)); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	w.Close()
+	if !l.WriteExhausted() || l.TryAcquire() {
+		t.Errorf("TryAcquire should fail when the write rate is used up")
+	}
+	time.Sleep(time.Second)
+	if l.WriteExhausted() || !l.TryAcquire() {
+		t.Errorf("TryAcquire should succeed in the next second")
+	}
+	l.Close()
+	if l.TryAcquire() {
+		t.Errorf("TryAcquire should fail after the controller is closed")
+	}
+}
+
+func TestRateControllerNewReader(t *testing.T) {
+	const rate = 16 * 1024
+	l := NewRateController(1, rate, 0)
+	data := make([]byte, rate*2)
+	start := time.Now()
+	got, err := io.ReadAll(l.NewReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if len(got) != len(data) {
+		t.Errorf("Expected %d bytes, got %d", len(data), len(got))
+	}
+	if used := time.Since(start); used < time.Second/2 {
+		t.Errorf("Reading %d bytes at %d B/s should be limited, used %v", len(data), rate, used)
+	}
+	if l.Len() != 0 || !l.TryAcquire() {
+		t.Errorf("NewReader should not acquire a slot")
+	}
+}
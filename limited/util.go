@@ -102,6 +102,19 @@ func (s *Semaphore) Acquire() {
 	s.c <- struct{}{}
 }
 
+// TryAcquire acquires a slot without waiting, and reports whether it succeeded
+func (s *Semaphore) TryAcquire() bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s.c <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *Semaphore) AcquireWithContext(ctx context.Context) bool {
 	if s == nil {
 		return true
@@ -33,6 +33,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -41,6 +42,7 @@ import (
 	"github.com/LiterMC/go-openbmclapi/internal/build"
 	"github.com/LiterMC/go-openbmclapi/limited"
 	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/utils"
 )
 
 const ClusterServerURL = "https://openbmclapi.bangbang93.com"
@@ -79,6 +81,9 @@ func parseArgs() {
 		case "upload-webdav":
 			cmdUploadWebdav(os.Args[2:])
 			os.Exit(0)
+		case "migrate":
+			cmdMigrate(os.Args[2:])
+			os.Exit(0)
 		default:
 			fmt.Println("Unknown sub command:", subcmd)
 			printHelp()
@@ -202,10 +207,22 @@ START:
 	}
 
 	firstSyncDone := make(chan struct{}, 0)
+	var firstSyncOnce sync.Once
+	markFirstSyncDone := func() {
+		firstSyncOnce.Do(func() { close(firstSyncDone) })
+	}
 
 	go func(ctx context.Context) {
 		defer log.RecordPanic()
-		defer close(firstSyncDone)
+		defer markFirstSyncDone()
+		manifestLoaded, err := cluster.LoadFilesetManifest()
+		if err != nil {
+			log.Errorf("Cannot load fileset manifest: %v", err)
+		} else if manifestLoaded {
+			// the files will be checked by the first sync in background
+			log.Info("Fileset manifest loaded, the storages will be reconciled in background")
+			markFirstSyncDone()
+		}
 		log.Infof("Fetching file list")
 		fl, err := cluster.GetFileList(ctx)
 		if err != nil {
@@ -213,28 +230,46 @@ START:
 			if errors.Is(err, context.Canceled) {
 				return
 			}
-			if !config.Advanced.SkipFirstSync {
+			if !config.Advanced.SkipFirstSync && !manifestLoaded {
 				osExit(1)
 			}
 		}
-		checkCount := -1
+		// a full sync runs on the first interval and then once every heavy check interval,
+		// the syncs between them only check the changed files
+		fullSync := utils.Every{N: config.Advanced.HeavyCheckInterval}
 		heavyCheck := !config.Advanced.NoHeavyCheck
-		heavyCheckInterval := config.Advanced.HeavyCheckInterval
-		if heavyCheckInterval <= 0 {
+		if config.Advanced.HeavyCheckInterval <= 0 {
 			heavyCheck = false
 		}
 
-		if !config.Advanced.SkipFirstSync {
+		// the files are still checked outside the sync windows, only the downloads wait for the window
+		if !config.SyncLimit.InWindow(time.Now()) {
+			log.Info("Not in any sync window, the missing files will be downloaded on demand until the window opens")
+		}
+		if fl == nil {
+			// keep the loaded fileset until the next sync
+		} else if manifestLoaded {
+			// the loaded fileset is being served, so the storages are reconciled without blocking the syncs on schedule
+			if !config.Advanced.SkipFirstSync {
+				go func() {
+					defer log.RecordPanic()
+					cluster.SyncFiles(ctx, fl, false)
+					if !config.Advanced.NoGC && ctx.Err() == nil {
+						cluster.Gc(ctx)
+					}
+				}()
+			}
+		} else if !config.Advanced.SkipFirstSync {
 			cluster.SyncFiles(ctx, fl, false)
 
 			if !config.Advanced.NoGC {
-				go cluster.Gc()
+				go cluster.Gc(ctx)
 			}
 
 			if ctx.Err() != nil {
 				return
 			}
-		} else if fl != nil {
+		} else {
 			if err := cluster.SetFilesetByExists(ctx, fl); err != nil {
 				return
 			}
@@ -246,10 +281,14 @@ START:
 				log.Error("Cannot query cluster file list:", err)
 				return
 			}
-			checkCount = (checkCount + 1) % heavyCheckInterval
-			cluster.SyncFiles(ctx, fl, heavyCheck && checkCount == 0)
-			if !config.Advanced.NoGC && !config.OnlyGcWhenStart {
-				go cluster.Gc()
+			gc := !config.Advanced.NoGC && !config.OnlyGcWhenStart
+			if fullSync.Next() {
+				cluster.SyncFiles(ctx, fl, heavyCheck)
+				if gc {
+					go cluster.Gc(ctx)
+				}
+			} else if removed, ok := cluster.SyncFilesIncremental(ctx, fl); ok && gc {
+				go cluster.GcFiles(ctx, removed)
 			}
 		}, (time.Duration)(config.SyncInterval)*time.Minute)
 	}(ctx)
@@ -0,0 +1,94 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"time"
+
+	"github.com/LiterMC/go-openbmclapi/database"
+	"github.com/LiterMC/go-openbmclapi/filelist"
+	"github.com/LiterMC/go-openbmclapi/log"
+)
+
+const filesetManifestFileName = "fileset.json.gz"
+
+func (cr *Cluster) storageIds() []string {
+	ids := make([]string, len(cr.storageOpts))
+	for i, opt := range cr.storageOpts {
+		ids[i] = opt.Id
+	}
+	return ids
+}
+
+// saveFilesetManifest records the verified files and the storages which hold them,
+// so the cluster can be enabled immediately after restart
+func (cr *Cluster) saveFilesetManifest(files []FileInfo, fileStorages map[string][]int) error {
+	manifest := filelist.NewManifest(cr.storageIds(), files, fileStorages, cr.storageIndexes)
+	var buf bytes.Buffer
+	if err := manifest.Encode(&buf); err != nil {
+		return err
+	}
+	return writeFileWithOld(filepath.Join(cr.dataDir, filesetManifestFileName), buf.Bytes(), 0644)
+}
+
+// LoadFilesetManifest sets the fileset from the saved manifest if the fileset has not been synced yet.
+// The placement on the storages that no longer exist will be dropped.
+// It returns false if there is no usable manifest
+func (cr *Cluster) LoadFilesetManifest() (ok bool, err error) {
+	var manifest *filelist.Manifest
+	if err = parseFileOrOld(filepath.Join(cr.dataDir, filesetManifestFileName), func(buf []byte) (err error) {
+		manifest, err = filelist.DecodeManifest(bytes.NewReader(buf))
+		return
+	}); err != nil {
+		return
+	}
+	if manifest == nil || manifest.Time.IsZero() {
+		return false, nil
+	}
+
+	fileset, fileStorages, records, err := manifest.Placement(cr.storageIds())
+	if err != nil {
+		return false, err
+	}
+	if len(fileset) == 0 {
+		return false, nil
+	}
+
+	cr.filesetMux.Lock()
+	defer cr.filesetMux.Unlock()
+	if cr.filesetSynced {
+		return false, nil
+	}
+	cr.fileset = fileset
+	cr.fileStorages = fileStorages
+	if config.Hijack.Enable {
+		for _, f := range records {
+			cr.fileMapDB.Set(database.Record{
+				Path: f.Path,
+				Hash: f.Hash,
+				Size: f.Size,
+			})
+		}
+	}
+	log.Infof("Loaded %d files from the fileset manifest saved at %s", len(fileset), manifest.Time.Format(time.DateTime))
+	return true, nil
+}
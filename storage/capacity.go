@@ -0,0 +1,129 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCapacityUnknown is returned by CapacityReporter when the storage cannot report its capacity
+var ErrCapacityUnknown = errors.New("storage capacity is unknown")
+
+// Capacity is the space usage of a storage, in bytes.
+// Total may be zero if the storage only knows the free space
+type Capacity struct {
+	Total int64 `json:"total"`
+	Used  int64 `json:"used"`
+	Free  int64 `json:"free"`
+}
+
+// CapacityReporter can be implemented by a Storage to report its used and free space
+type CapacityReporter interface {
+	Capacity(ctx context.Context) (Capacity, error)
+}
+
+type CapacityInfo struct {
+	Capacity
+	Known     bool      `json:"known"`
+	LastError string    `json:"lastError,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+}
+
+// StorageCapacity caches the last reported capacity of a storage.
+// Storages that do not implement CapacityReporter are treated as they have unlimited space
+type StorageCapacity struct {
+	reporter CapacityReporter
+
+	mux       sync.RWMutex
+	cap       Capacity
+	known     bool
+	lastErr   error
+	updatedAt time.Time
+}
+
+func NewStorageCapacity(s Storage) *StorageCapacity {
+	c := new(StorageCapacity)
+	c.reporter, _ = s.(CapacityReporter)
+	return c
+}
+
+// Supported reports whether the storage implements CapacityReporter
+func (c *StorageCapacity) Supported() bool {
+	return c.reporter != nil
+}
+
+// Refresh queries the storage for its current capacity
+func (c *StorageCapacity) Refresh(ctx context.Context) error {
+	if c.reporter == nil {
+		return nil
+	}
+	cap, err := c.reporter.Capacity(ctx)
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.updatedAt = time.Now()
+	if err != nil {
+		c.lastErr = err
+		if errors.Is(err, ErrCapacityUnknown) {
+			c.known = false
+		}
+		return err
+	}
+	c.cap = cap
+	c.known = true
+	c.lastErr = nil
+	return nil
+}
+
+// HasRoom reports whether the storage can hold another size bytes while keeping reserve bytes free.
+// It always returns true when the capacity is unknown
+func (c *StorageCapacity) HasRoom(size int64, reserve int64) bool {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	if !c.known {
+		return true
+	}
+	return c.cap.Free-size >= reserve
+}
+
+// Consume records that size bytes have been written, until the next refresh
+func (c *StorageCapacity) Consume(size int64) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	if !c.known {
+		return
+	}
+	c.cap.Free -= size
+	c.cap.Used += size
+}
+
+func (c *StorageCapacity) Info() (info CapacityInfo) {
+	c.mux.RLock()
+	defer c.mux.RUnlock()
+	info.Capacity = c.cap
+	info.Known = c.known
+	if c.lastErr != nil {
+		info.LastError = c.lastErr.Error()
+	}
+	info.UpdatedAt = c.updatedAt
+	return
+}
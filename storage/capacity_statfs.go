@@ -0,0 +1,39 @@
+//go:build linux || darwin || freebsd
+
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func diskCapacity(path string) (c Capacity, err error) {
+	var st unix.Statfs_t
+	if err = unix.Statfs(path, &st); err != nil {
+		return
+	}
+	bsize := (int64)(st.Bsize)
+	c.Total = (int64)(st.Blocks) * bsize
+	c.Used = ((int64)(st.Blocks) - (int64)(st.Bfree)) * bsize
+	// Bavail excludes the blocks reserved for root
+	c.Free = (int64)(st.Bavail) * bsize
+	return
+}
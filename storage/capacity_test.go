@@ -0,0 +1,161 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeCapacityStorage struct {
+	Storage
+	cap Capacity
+	err error
+}
+
+func (s *fakeCapacityStorage) Capacity(context.Context) (Capacity, error) {
+	return s.cap, s.err
+}
+
+func TestStorageCapacity(t *testing.T) {
+	if c := NewStorageCapacity(new(LocalStorage)); !c.Supported() {
+		t.Fatalf("LocalStorage should report its capacity")
+	}
+
+	s := &fakeCapacityStorage{err: ErrCapacityUnknown}
+	c := NewStorageCapacity(s)
+	if err := c.Refresh(context.Background()); !errors.Is(err, ErrCapacityUnknown) {
+		t.Fatalf("Expected ErrCapacityUnknown, got %v", err)
+	}
+	if !c.HasRoom(1<<40, 0) {
+		t.Fatalf("Storage with unknown capacity should always have room")
+	}
+
+	s.cap, s.err = Capacity{Total: 1000, Used: 400, Free: 600}, nil
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if !c.HasRoom(500, 100) {
+		t.Errorf("Storage should have room for 500 bytes with 100 bytes reserved")
+	}
+	if c.HasRoom(501, 100) {
+		t.Errorf("Storage should not have room for 501 bytes with 100 bytes reserved")
+	}
+	c.Consume(300)
+	if info := c.Info(); info.Free != 300 || info.Used != 700 || !info.Known {
+		t.Errorf("Unexpected capacity after consume: %#v", info)
+	}
+
+	s.err = errors.New("temporary error")
+	if err := c.Refresh(context.Background()); err == nil {
+		t.Fatalf("Expected an error")
+	}
+	if info := c.Info(); !info.Known || info.Free != 300 || info.LastError == "" {
+		t.Errorf("Last known capacity should be kept on temporary error: %#v", info)
+	}
+}
+
+func TestLocalStorageCapacity(t *testing.T) {
+	s := new(LocalStorage)
+	s.SetOptions(&LocalStorageOption{CachePath: t.TempDir()})
+	c, err := s.Capacity(context.Background())
+	if errors.Is(err, ErrCapacityUnknown) {
+		t.Skip("Capacity is not supported on this platform")
+	}
+	if err != nil {
+		t.Fatalf("Capacity: %v", err)
+	}
+	if c.Total <= 0 || c.Free < 0 || c.Free > c.Total || c.Used > c.Total {
+		t.Errorf("Unexpected capacity: %#v", c)
+	}
+}
+
+func TestWebDavStorageCapacity(t *testing.T) {
+	const quotaResponse = `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:">
+  <d:response>
+    <d:href>/dav/</d:href>
+    <d:propstat>
+      <d:prop>
+        <d:quota-available-bytes>6000</d:quota-available-bytes>
+        <d:quota-used-bytes>4000</d:quota-used-bytes>
+      </d:prop>
+      <d:status>HTTP/1.1 200 OK</d:status>
+    </d:propstat>
+  </d:response>
+</d:multistatus>`
+	const noQuotaResponse = `<?xml version="1.0" encoding="utf-8"?>
+<d:multistatus xmlns:d="DAV:">
+  <d:response>
+    <d:href>/dav/</d:href>
+    <d:propstat>
+      <d:prop><d:quota-available-bytes/><d:quota-used-bytes/></d:prop>
+      <d:status>HTTP/1.1 404 Not Found</d:status>
+    </d:propstat>
+  </d:response>
+</d:multistatus>`
+
+	response := quotaResponse
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "MKCOL":
+			rw.WriteHeader(http.StatusCreated)
+		case "PROPFIND":
+			body, _ := io.ReadAll(req.Body)
+			if req.Header.Get("Depth") != "0" || !strings.Contains(string(body), "quota-available-bytes") {
+				rw.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			rw.Header().Set("Content-Type", "application/xml; charset=utf-8")
+			rw.WriteHeader(http.StatusMultiStatus)
+			io.WriteString(rw, response)
+		default:
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	defer srv.Close()
+
+	s := new(WebDavStorage)
+	s.SetOptions(&WebDavStorageOption{
+		MaxConn:      4,
+		FullEndPoint: srv.URL + "/dav/",
+	})
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+
+	c, err := s.Capacity(context.Background())
+	if err != nil {
+		t.Fatalf("Capacity: %v", err)
+	}
+	if expect := (Capacity{Total: 10000, Used: 4000, Free: 6000}); c != expect {
+		t.Errorf("Expected %#v, got %#v", expect, c)
+	}
+
+	response = noQuotaResponse
+	if _, err := s.Capacity(context.Background()); !errors.Is(err, ErrCapacityUnknown) {
+		t.Errorf("Expected ErrCapacityUnknown, got %v", err)
+	}
+}
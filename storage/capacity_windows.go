@@ -0,0 +1,41 @@
+//go:build windows
+
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+func diskCapacity(path string) (c Capacity, err error) {
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return
+	}
+	var avail, total, free uint64
+	if err = windows.GetDiskFreeSpaceEx(name, &avail, &total, &free); err != nil {
+		return
+	}
+	c.Total = (int64)(total)
+	c.Used = (int64)(total - free)
+	c.Free = (int64)(avail)
+	return
+}
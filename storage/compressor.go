@@ -22,17 +22,54 @@ package storage
 import (
 	"compress/gzip"
 	"compress/zlib"
+	"fmt"
 	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
 )
 
 type Compressor string
 
 const (
-	NullCompressor Compressor = ""
-	ZlibCompressor Compressor = "zlib"
-	GzipCompressor Compressor = "gzip"
+	NullCompressor   Compressor = ""
+	ZlibCompressor   Compressor = "zlib"
+	GzipCompressor   Compressor = "gzip"
+	ZstdCompressor   Compressor = "zstd"
+	BrotliCompressor Compressor = "br"
 )
 
+// Compressors are all supported compressors, sorted by the preference when the client accepts multiple of them
+var Compressors = []Compressor{ZstdCompressor, BrotliCompressor, GzipCompressor, ZlibCompressor}
+
+// ParseCompressor returns the compressor by its name, extension or content encoding
+func ParseCompressor(name string) (Compressor, error) {
+	switch strings.TrimPrefix(strings.ToLower(name), ".") {
+	case "", "none", "identity":
+		return NullCompressor, nil
+	case "zlib", "zz", "deflate":
+		return ZlibCompressor, nil
+	case "gzip", "gz":
+		return GzipCompressor, nil
+	case "zstd", "zst":
+		return ZstdCompressor, nil
+	case "br", "brotli":
+		return BrotliCompressor, nil
+	}
+	return NullCompressor, fmt.Errorf("Unknown compressor %q", name)
+}
+
+// CompressorByExt returns the compressor which uses the extension of the path
+func CompressorByExt(path string) (Compressor, bool) {
+	for _, c := range Compressors {
+		if strings.HasSuffix(path, c.Ext()) {
+			return c, true
+		}
+	}
+	return NullCompressor, false
+}
+
 func (c Compressor) Ext() string {
 	switch c {
 	case NullCompressor:
@@ -41,11 +78,49 @@ func (c Compressor) Ext() string {
 		return ".zz"
 	case GzipCompressor:
 		return ".gz"
+	case ZstdCompressor:
+		return ".zst"
+	case BrotliCompressor:
+		return ".br"
+	default:
+		panic("Unknown compressor: " + c)
+	}
+}
+
+// ContentEncoding returns the value used in the Content-Encoding header
+func (c Compressor) ContentEncoding() string {
+	switch c {
+	case NullCompressor:
+		return "identity"
+	case ZlibCompressor:
+		return "deflate"
+	case GzipCompressor:
+		return "gzip"
+	case ZstdCompressor:
+		return "zstd"
+	case BrotliCompressor:
+		return "br"
 	default:
 		panic("Unknown compressor: " + c)
 	}
 }
 
+// NegotiateCompressor picks the candidate with the highest quality value in the parsed Accept-Encoding header.
+// ok will be false if the client does not accept any of the candidates
+func NegotiateCompressor(acceptEncoding map[string]float32, candidates []Compressor) (best Compressor, ok bool) {
+	var bestQ float32 = 0
+	for _, c := range candidates {
+		q, has := acceptEncoding[c.ContentEncoding()]
+		if !has {
+			q = acceptEncoding["*"]
+		}
+		if q > bestQ {
+			best, bestQ, ok = c, q, true
+		}
+	}
+	return
+}
+
 // Decompress the reader
 func (c Compressor) WrapReader(r io.Reader) (io.Reader, error) {
 	switch c {
@@ -55,6 +130,14 @@ func (c Compressor) WrapReader(r io.Reader) (io.Reader, error) {
 		return zlib.NewReader(r)
 	case GzipCompressor:
 		return gzip.NewReader(r)
+	case ZstdCompressor:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case BrotliCompressor:
+		return brotli.NewReader(r), nil
 	default:
 		panic("Unknown compressor: " + c)
 	}
@@ -77,6 +160,11 @@ func (c Compressor) WrapWriter(w io.Writer) io.WriteCloser {
 		return zlib.NewWriter(w)
 	case GzipCompressor:
 		return gzip.NewWriter(w)
+	case ZstdCompressor:
+		// always write in seekable format, so Range requests can be served without decompressing the whole file
+		return newSeekableZstdWriter(w, zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+	case BrotliCompressor:
+		return brotli.NewWriter(w)
 	default:
 		panic("Unknown compressor: " + c)
 	}
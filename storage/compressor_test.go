@@ -0,0 +1,146 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	. "github.com/LiterMC/go-openbmclapi/utils"
+)
+
+func TestCompressorRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("go-openbmclapi compressor test data "), 1024)
+	for _, c := range Compressors {
+		var buf bytes.Buffer
+		w := c.WrapWriter(&buf)
+		if _, err := w.Write(data); err != nil {
+			t.Fatalf("[%s] Cannot compress: %v", c, err)
+		}
+		if err := w.Close(); err != nil {
+			t.Fatalf("[%s] Cannot close compressor: %v", c, err)
+		}
+		r, err := c.WrapReader(&buf)
+		if err != nil {
+			t.Fatalf("[%s] Cannot create decompressor: %v", c, err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("[%s] Cannot decompress: %v", c, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("[%s] Decompressed data mismatch", c)
+		}
+	}
+}
+
+func TestNegotiateCompressor(t *testing.T) {
+	all := Compressors
+	data := []struct {
+		accept     string
+		candidates []Compressor
+		expect     Compressor
+		ok         bool
+	}{
+		{"", all, NullCompressor, false},
+		{"gzip", all, GzipCompressor, true},
+		{"gzip, deflate, br, zstd", all, ZstdCompressor, true},
+		{"gzip, deflate, br", all, BrotliCompressor, true},
+		{"gzip;q=1.0, br;q=0.5", all, GzipCompressor, true},
+		{"zstd;q=0, gzip;q=0.1", all, GzipCompressor, true},
+		{"deflate", []Compressor{GzipCompressor}, NullCompressor, false},
+		{"*", []Compressor{BrotliCompressor, GzipCompressor}, BrotliCompressor, true},
+		{"*;q=0.5, gzip", []Compressor{BrotliCompressor, GzipCompressor}, GzipCompressor, true},
+	}
+	for _, d := range data {
+		got, ok := NegotiateCompressor(SplitCSV(d.accept), d.candidates)
+		if got != d.expect || ok != d.ok {
+			t.Errorf("NegotiateCompressor(%q, %v): expected %q,%v, got %q,%v", d.accept, d.candidates, d.expect, d.ok, got, ok)
+		}
+	}
+}
+
+func TestLocalStorageServeCompressed(t *testing.T) {
+	const hash = "0123456789abcdef0123456789abcdef01234567"
+	data := bytes.Repeat([]byte("compressed local file "), 512)
+
+	s := new(LocalStorage)
+	s.SetOptions(&LocalStorageOption{
+		CachePath:   t.TempDir(),
+		Compressor:  ZstdCompressor,
+		Compressors: []Compressor{GzipCompressor},
+	})
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatalf("Cannot init local storage: %v", err)
+	}
+	// the brotli variant is not configured, so it should be ignored
+	for _, c := range []Compressor{ZstdCompressor, GzipCompressor, BrotliCompressor} {
+		fd, err := os.Create(s.hashToPath(hash) + c.Ext())
+		if err != nil {
+			t.Fatalf("Cannot create file: %v", err)
+		}
+		w := c.WrapWriter(fd)
+		w.Write(data)
+		w.Close()
+		fd.Close()
+	}
+
+	serve := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/download/"+hash, nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		rw := httptest.NewRecorder()
+		if _, err := s.ServeDownload(rw, req, hash, (int64)(len(data))); err != nil {
+			t.Fatalf("Cannot serve file with Accept-Encoding %q: %v", accept, err)
+		}
+		return rw
+	}
+
+	for accept, expect := range map[string]Compressor{
+		"gzip, zstd": ZstdCompressor,
+		"gzip, br":   GzipCompressor,
+	} {
+		rw := serve(accept)
+		if ce := rw.Header().Get("Content-Encoding"); ce != expect.ContentEncoding() {
+			t.Errorf("Accept-Encoding %q: expected Content-Encoding %q, got %q", accept, expect.ContentEncoding(), ce)
+			continue
+		}
+		r, err := expect.WrapReader(rw.Body)
+		if err != nil {
+			t.Fatalf("Cannot decompress response: %v", err)
+		}
+		if got, _ := io.ReadAll(r); !bytes.Equal(got, data) {
+			t.Errorf("Accept-Encoding %q: response body mismatch", accept)
+		}
+	}
+
+	rw := serve("br")
+	if ce := rw.Header().Get("Content-Encoding"); ce != "" {
+		t.Errorf("Expected no Content-Encoding, got %q", ce)
+	}
+	if !bytes.Equal(rw.Body.Bytes(), data) {
+		t.Errorf("Decompressed response body mismatch")
+	}
+}
@@ -0,0 +1,119 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/LiterMC/go-openbmclapi/storage"
+	"github.com/LiterMC/go-openbmclapi/storage/storagetest"
+)
+
+func initTestStorage(t *testing.T, s storage.Storage) storage.Storage {
+	t.Helper()
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatalf("Cannot init %s: %v", s.String(), err)
+	}
+	return s
+}
+
+func TestLocalStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s := new(storage.LocalStorage)
+		s.SetOptions(&storage.LocalStorageOption{
+			CachePath: t.TempDir(),
+		})
+		return initTestStorage(t, s)
+	}, storagetest.Options{})
+}
+
+func TestLocalDisksStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s := new(storage.LocalStorage)
+		s.SetOptions(&storage.LocalStorageOption{
+			Disks: []storage.LocalDiskOption{
+				{Path: t.TempDir(), Weight: 1},
+				{Path: t.TempDir(), Weight: 2},
+			},
+		})
+		return initTestStorage(t, s)
+	}, storagetest.Options{})
+}
+
+func TestMountStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		dir := t.TempDir()
+		srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+		t.Cleanup(srv.Close)
+		s := new(storage.MountStorage)
+		s.SetOptions(&storage.MountStorageOption{
+			Path:         dir,
+			RedirectBase: srv.URL,
+		})
+		return initTestStorage(t, s)
+	}, storagetest.Options{})
+}
+
+func TestWebDavStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		srv := httptest.NewServer(&webdav.Handler{
+			FileSystem: webdav.Dir(t.TempDir()),
+			LockSystem: webdav.NewMemLS(),
+		})
+		t.Cleanup(srv.Close)
+		s := new(storage.WebDavStorage)
+		s.SetOptions(&storage.WebDavStorageOption{
+			MaxConn:      8,
+			FullEndPoint: srv.URL + "/",
+		})
+		return initTestStorage(t, s)
+	}, storagetest.Options{})
+}
+
+func TestMemoryStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s := new(storage.MemoryStorage)
+		s.SetOptions(&storage.MemoryStorageOption{
+			MaxSize: 64,
+		})
+		return initTestStorage(t, s)
+	}, storagetest.Options{})
+}
+
+func TestFaultyStorageConformance(t *testing.T) {
+	// without any fault, it should behave the same as the backend
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s := new(storage.FaultyStorage)
+		s.SetOptions(&storage.FaultyStorageOption{
+			Latency: (storage.YAMLDuration)(time.Millisecond),
+			Backend: storage.StorageOption{
+				BasicStorageOption: storage.BasicStorageOption{Type: storage.StorageLocal},
+				Data:               &storage.LocalStorageOption{CachePath: t.TempDir()},
+			},
+		})
+		return initTestStorage(t, s)
+	}, storagetest.Options{})
+}
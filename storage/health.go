@@ -0,0 +1,181 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/LiterMC/go-openbmclapi/utils"
+)
+
+// HealthChecker can be implemented by a Storage to provide its own liveness probe.
+// Storages that do not implement it will be probed with a Size call on a non-existent hash.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// probeHash should never exist on any storage
+const probeHash = "0000000000000000000000000000000000000000"
+
+// CheckHealth probes the storage and returns nil if it is working.
+// The probe will be abandoned when ctx is done
+func CheckHealth(ctx context.Context, s Storage) error {
+	done := make(chan error, 1)
+	go func() {
+		if c, ok := s.(HealthChecker); ok {
+			done <- c.CheckHealth(ctx)
+			return
+		}
+		_, err := s.Size(ctx, probeHash)
+		if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// IsHealthError reports whether err indicates the storage itself is not working,
+// rather than the file is missing or the client went away
+func IsHealthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, os.ErrNotExist) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var se *HTTPStatusError
+	if errors.As(err, &se) {
+		return se.Code >= 500 || se.Code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+type HealthStatus struct {
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"failures"`
+	Latency   int64     `json:"latency"` // in milliseconds
+	LastError string    `json:"lastError,omitempty"`
+	DownSince time.Time `json:"downSince,omitempty"`
+	LastProbe time.Time `json:"lastProbe,omitempty"`
+}
+
+// StorageHealth tracks the consecutive failures and the serve latency of a storage.
+// A storage will be marked as down after it failed maxFailures times in a row,
+// and will only be marked as up again by a successful probe.
+type StorageHealth struct {
+	maxFailures int
+
+	down      atomic.Bool
+	mux       sync.RWMutex
+	failures  int
+	latency   time.Duration // exponentially weighted moving average
+	lastErr   error
+	downSince time.Time
+	lastProbe time.Time
+}
+
+// NewStorageHealth creates a health tracker.
+// If maxFailures is not positive, the storage will never be marked as down
+func NewStorageHealth(maxFailures int) *StorageHealth {
+	return &StorageHealth{
+		maxFailures: maxFailures,
+	}
+}
+
+func (h *StorageHealth) Healthy() bool {
+	return !h.down.Load()
+}
+
+func (h *StorageHealth) Latency() time.Duration {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	return h.latency
+}
+
+// OnSuccess resets the failure counter and records the latency
+func (h *StorageHealth) OnSuccess(latency time.Duration) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.failures = 0
+	if h.latency == 0 {
+		h.latency = latency
+	} else {
+		h.latency += (latency - h.latency) / 5
+	}
+}
+
+// OnFailure records a failure, and returns true if the storage has just been marked as down
+func (h *StorageHealth) OnFailure(err error) (tripped bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.failures++
+	h.lastErr = err
+	if h.maxFailures > 0 && h.failures >= h.maxFailures && !h.down.Load() {
+		h.downSince = time.Now()
+		h.down.Store(true)
+		return true
+	}
+	return false
+}
+
+// OnProbe records a probe result, and returns true if the storage has just been brought back
+func (h *StorageHealth) OnProbe(err error, latency time.Duration) (recovered bool) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	h.lastProbe = time.Now()
+	if err != nil {
+		h.lastErr = err
+		return false
+	}
+	h.failures = 0
+	h.latency = latency
+	if h.down.Load() {
+		h.downSince = time.Time{}
+		h.down.Store(false)
+		return true
+	}
+	return false
+}
+
+func (h *StorageHealth) Status() (s HealthStatus) {
+	h.mux.RLock()
+	defer h.mux.RUnlock()
+	s.Healthy = !h.down.Load()
+	s.Failures = h.failures
+	s.Latency = h.latency.Milliseconds()
+	if h.lastErr != nil {
+		s.LastError = h.lastErr.Error()
+	}
+	s.DownSince = h.downSince
+	s.LastProbe = h.lastProbe
+	return
+}
@@ -0,0 +1,95 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/LiterMC/go-openbmclapi/utils"
+)
+
+func TestIsHealthError(t *testing.T) {
+	data := []struct {
+		err    error
+		expect bool
+	}{
+		{nil, false},
+		{os.ErrNotExist, false},
+		{&os.PathError{Op: "open", Path: "x", Err: os.ErrNotExist}, false},
+		{context.Canceled, false},
+		{&HTTPStatusError{Code: 404}, false},
+		{fmt.Errorf("wrapped: %w", &HTTPStatusError{Code: 502}), true},
+		{&HTTPStatusError{Code: 429}, true},
+		{context.DeadlineExceeded, true},
+		{errors.New("connection refused"), true},
+	}
+	for _, d := range data {
+		if got := IsHealthError(d.err); got != d.expect {
+			t.Errorf("IsHealthError(%v): expected %v, got %v", d.err, d.expect, got)
+		}
+	}
+}
+
+func TestStorageHealth(t *testing.T) {
+	h := NewStorageHealth(3)
+	errDown := errors.New("down")
+	for i := 0; i < 2; i++ {
+		if h.OnFailure(errDown) {
+			t.Fatalf("Storage tripped after %d failures", i+1)
+		}
+	}
+	h.OnSuccess(time.Millisecond * 10)
+	if h.OnFailure(errDown) || h.OnFailure(errDown) {
+		t.Fatalf("Failure counter was not reset by success")
+	}
+	if !h.OnFailure(errDown) {
+		t.Fatalf("Storage should be tripped after 3 failures")
+	}
+	if h.Healthy() {
+		t.Fatalf("Storage should not be healthy")
+	}
+	if h.OnFailure(errDown) {
+		t.Fatalf("Storage should only be tripped once")
+	}
+	if h.OnProbe(errDown, time.Millisecond) {
+		t.Fatalf("Failed probe should not recover the storage")
+	}
+	if st := h.Status(); st.Healthy || st.Failures != 4 || st.LastError != "down" || st.DownSince.IsZero() {
+		t.Fatalf("Unexpected status %#v", st)
+	}
+	if !h.OnProbe(nil, time.Millisecond*20) {
+		t.Fatalf("Successful probe should recover the storage")
+	}
+	if st := h.Status(); !st.Healthy || st.Failures != 0 || st.Latency != 20 {
+		t.Fatalf("Unexpected status %#v", st)
+	}
+
+	h = NewStorageHealth(0)
+	for i := 0; i < 10; i++ {
+		h.OnFailure(errDown)
+	}
+	if !h.Healthy() {
+		t.Fatalf("Storage should never be tripped when maxFailures is 0")
+	}
+}
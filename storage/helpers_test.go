@@ -0,0 +1,96 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// initTestStorage applies opt to s and initializes it
+func initTestStorage[S Storage](t *testing.T, s S, opt any) S {
+	t.Helper()
+	s.SetOptions(opt)
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatalf("Cannot init %s: %v", s.String(), err)
+	}
+	return s
+}
+
+func testFileHash(data []byte) string {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func createTestFile(t *testing.T, s Storage, seed byte, size int) string {
+	t.Helper()
+	data := bytes.Repeat([]byte{seed}, size)
+	hash := testFileHash(data)
+	if err := s.Create(context.Background(), hash, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Cannot create file %s: %v", hash, err)
+	}
+	return hash
+}
+
+func serveTestFile(t *testing.T, s Storage, hash string, size int64) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/download/"+hash, nil)
+	rw := httptest.NewRecorder()
+	n, err := s.ServeDownload(rw, req, hash, size)
+	if err != nil {
+		t.Fatalf("Cannot serve %s: %v", hash, err)
+	}
+	if n != size {
+		t.Fatalf("Served size of %s mismatch, expected %d, got %d", hash, size, n)
+	}
+}
+
+// walkTestFiles collects every file reported by s.WalkDir, and fails if a hash is reported twice
+func walkTestFiles(s Storage) (map[string]int64, error) {
+	found := make(map[string]int64)
+	err := s.WalkDir(context.Background(), func(hash string, size int64) error {
+		if _, ok := found[hash]; ok {
+			return errors.New("duplicated hash " + hash)
+		}
+		found[hash] = size
+		return nil
+	})
+	return found, err
+}
+
+// waitTestCached polls cached until it reports hash as cached
+func waitTestCached(t *testing.T, cached func(hash string) bool, hash string) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		if cached(hash) {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("File %s was not cached", hash)
+}
@@ -0,0 +1,331 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+	. "github.com/LiterMC/go-openbmclapi/utils"
+)
+
+type LocalDiskOption struct {
+	Path string `yaml:"path"`
+	// Weight is the share of the hash prefixes placed on the disk.
+	// Zero means using the total size of the disk as its weight
+	Weight uint `yaml:"weight"`
+}
+
+type localDisk struct {
+	path   string
+	weight uint
+	online bool
+}
+
+func (d *localDisk) tmpPath() string {
+	return filepath.Join(d.path, ".tmp")
+}
+
+// init prepares the cache folders on the disk.
+// If mustExist is true, the disk folder will not be created,
+// so an unmounted disk will not be filled up with files which should be written to it
+func (d *localDisk) init(mustExist bool) (err error) {
+	if mustExist {
+		var stat os.FileInfo
+		if stat, err = os.Stat(d.path); err != nil {
+			return
+		}
+		if !stat.IsDir() {
+			return fmt.Errorf("%q is not a directory", d.path)
+		}
+	}
+	tmpDir := d.tmpPath()
+	cleanTmpDir(tmpDir)
+	// should be 0755 here because Windows permission issue
+	if err = os.MkdirAll(tmpDir, 0755); err != nil {
+		return
+	}
+	return initCache(d.path)
+}
+
+// placeWeight returns the weight used for placing the hash prefixes
+func (d *localDisk) placeWeight() float64 {
+	if d.weight > 0 {
+		return (float64)(d.weight)
+	}
+	if c, err := diskCapacity(d.path); err == nil && c.Total > 0 {
+		return (float64)(c.Total) / (1 << 30)
+	}
+	return 1
+}
+
+// hrwScore returns the weighted rendezvous hashing score of the prefix on the disk.
+// The disk with the highest score owns the prefix, so adding or removing a disk
+// only moves the prefixes which are owned by that disk
+func hrwScore(disk string, prefix string, weight float64) float64 {
+	h := sha256.New()
+	h.Write(([]byte)(disk))
+	h.Write([]byte{0})
+	h.Write(([]byte)(prefix))
+	var buf [sha256.Size]byte
+	// map the hash to a float in (0, 1)
+	u := ((float64)(binary.BigEndian.Uint64(h.Sum(buf[:0]))>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
+
+// layoutDisks ranks the online disks for each hash prefix, the first one is the owner
+func (s *LocalStorage) layoutDisks() {
+	weights := make([]float64, len(s.disks))
+	for i, d := range s.disks {
+		if d.online {
+			weights[i] = d.placeWeight()
+		}
+	}
+	scores := make([]float64, len(s.disks))
+	for b, prefix := range Hex256 {
+		rank := make([]int, 0, len(s.disks))
+		for i, d := range s.disks {
+			if d.online {
+				scores[i] = hrwScore(d.path, prefix, weights[i])
+				rank = append(rank, i)
+			}
+		}
+		sort.SliceStable(rank, func(i, j int) bool { return scores[rank[i]] > scores[rank[j]] })
+		s.ranks[b] = rank
+	}
+}
+
+// diskRank returns the indexes of the online disks which the file may be placed on, ordered by priority
+func (s *LocalStorage) diskRank(hash string) []int {
+	return s.ranks[HexTo256(hash)]
+}
+
+// owner returns the disk which new files of the hash should be written to
+func (s *LocalStorage) owner(hash string) *localDisk {
+	if rank := s.diskRank(hash); len(rank) > 0 {
+		return s.disks[rank[0]]
+	}
+	return s.disks[0]
+}
+
+// statFile finds the disk which holds the file.
+// Files may be found on a disk other than the owner when the disks have not been rebalanced
+func (s *LocalStorage) statFile(hash string) (path string, stat os.FileInfo, err error) {
+	rank := s.diskRank(hash)
+	if len(rank) <= 1 {
+		path = s.hashToPath(hash)
+		stat, err = os.Stat(path)
+		return
+	}
+	for i, di := range rank {
+		p := filepath.Join(s.disks[di].path, hash[0:2], hash)
+		st, e := os.Stat(p)
+		if e == nil {
+			return p, st, nil
+		}
+		if i == 0 {
+			path, err = p, e
+		}
+	}
+	// the file may be moved to the owner disk while the other disks are checked
+	if st, e := os.Stat(path); e == nil {
+		return path, st, nil
+	}
+	return
+}
+
+// statVariants checks the raw file at path and its configured precompressed variants.
+// The error of the raw file will be returned if neither of them exists
+func (s *LocalStorage) statVariants(path string) (hasRaw bool, variants []Compressor, err error) {
+	if _, err = os.Stat(path); err == nil {
+		hasRaw = true
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	for _, c := range s.variants {
+		if _, e := os.Stat(path + c.Ext()); e == nil {
+			variants = append(variants, c)
+		}
+	}
+	if hasRaw || len(variants) > 0 {
+		err = nil
+	}
+	return
+}
+
+// locate finds the first disk that holds the file or any of its compressed variants,
+// and returns the path of the file on that disk with the variants found there
+func (s *LocalStorage) locate(hash string) (path string, hasRaw bool, variants []Compressor, err error) {
+	rank := s.diskRank(hash)
+	if len(rank) <= 1 {
+		path = s.hashToPath(hash)
+		hasRaw, variants, err = s.statVariants(path)
+		return
+	}
+	for i, di := range rank {
+		p := filepath.Join(s.disks[di].path, hash[0:2], hash)
+		raw, vs, e := s.statVariants(p)
+		if e == nil {
+			return p, raw, vs, nil
+		}
+		if i == 0 {
+			path, err = p, e
+		}
+	}
+	// the file may be moved to the owner disk while the other disks are checked
+	if raw, vs, e := s.statVariants(path); e == nil {
+		return path, raw, vs, nil
+	}
+	return
+}
+
+// walkDisks walks the prefix folders on all online disks, files found on more than one disk are reported once.
+// A disk that cannot be read is logged and skipped, so its files will be reported as missing
+func (s *LocalStorage) walkDisks(ctx context.Context, walker func(hash string, size int64) error) error {
+	broken := make([]bool, len(s.disks))
+	for b, dir := range Hex256 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		seen := make(map[string]struct{})
+		for _, di := range s.ranks[b] {
+			if broken[di] {
+				continue
+			}
+			d := s.disks[di]
+			files, err := os.ReadDir(filepath.Join(d.path, dir))
+			if err != nil {
+				if !errors.Is(err, os.ErrNotExist) {
+					log.Errorf("Cannot read disk %q of %s, skipped its files: %v", d.path, s.String(), err)
+					broken[di] = true
+				}
+				continue
+			}
+			for _, f := range files {
+				hash := f.Name()
+				if f.IsDir() || len(hash) < 2 || hash[:2] != dir {
+					continue
+				}
+				if _, ok := seen[hash]; ok {
+					continue
+				}
+				seen[hash] = struct{}{}
+				info, err := f.Info()
+				if err != nil {
+					continue
+				}
+				if err := walker(hash, info.Size()); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// rebalance moves the files which are not on their owner disks, for example after a disk is added.
+// It runs in the background, and the files can be read from their old disks until they are moved
+func (s *LocalStorage) rebalance(ctx context.Context) {
+	var moved, failed int
+	defer func() {
+		if moved > 0 || failed > 0 {
+			log.Infof("Moved %d files to their disks for %s, %d failed", moved, s.String(), failed)
+		}
+	}()
+	for b, dir := range Hex256 {
+		rank := s.ranks[b]
+		if len(rank) <= 1 {
+			continue
+		}
+		owner := s.disks[rank[0]]
+		for _, di := range rank[1:] {
+			src := filepath.Join(s.disks[di].path, dir)
+			files, err := os.ReadDir(src)
+			if err != nil {
+				continue
+			}
+			for _, f := range files {
+				if f.IsDir() {
+					continue
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				name := f.Name()
+				if err := moveFile(ctx, filepath.Join(src, name), filepath.Join(owner.path, dir, name), owner.tmpPath()); err != nil {
+					log.Errorf("Cannot move %q to disk %q: %v", filepath.Join(src, name), owner.path, err)
+					failed++
+					continue
+				}
+				moved++
+			}
+		}
+	}
+}
+
+// moveFile moves src to dst, it copies the file through tmpDir if they are on different file systems.
+// If dst already exists, src will be removed
+func moveFile(ctx context.Context, src, dst string, tmpDir string) (err error) {
+	if _, err = os.Stat(dst); err == nil {
+		return os.Remove(src)
+	}
+	if err = os.Rename(src, dst); err == nil {
+		return
+	}
+	fd, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+	tmp, err := os.CreateTemp(tmpDir, filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return
+	}
+	tmpPath := tmp.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+	_, err = io.Copy(tmp, &contextReader{ctx, fd})
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	if err = os.Rename(tmpPath, dst); err != nil {
+		return
+	}
+	fd.Close()
+	return os.Remove(src)
+}
@@ -0,0 +1,163 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+	. "github.com/LiterMC/go-openbmclapi/utils"
+)
+
+// CheckMigrateTarget checks if the objects of src can be migrated to dst
+func CheckMigrateTarget(src, dst *StorageOption) error {
+	if src.Id == dst.Id {
+		return fmt.Errorf("Source and destination must be different storages")
+	}
+	if !dst.Writable() {
+		return fmt.Errorf("Storage %q is %s, it cannot be the destination", dst.Id, dst.Mode)
+	}
+	return nil
+}
+
+// MigrateJob is an object to be migrated
+type MigrateJob struct {
+	Hash string
+	Size int64
+	// Exists is true if the object was copied by a previous run,
+	// it will only be verified, and be copied again if it is broken
+	Exists bool
+}
+
+// PlanMigrate returns the objects at the source which need to be migrated, and the total size to be copied.
+// Objects that already exist at the destination with the same size are only included when del is true,
+// so they can be verified and removed from the source
+func PlanMigrate(srcFiles, dstFiles map[string]int64, del bool) (jobs []MigrateJob, totalSize int64) {
+	jobs = make([]MigrateJob, 0, len(srcFiles))
+	for hash, size := range srcFiles {
+		if dsize, ok := dstFiles[hash]; ok && dsize == size {
+			if del {
+				jobs = append(jobs, MigrateJob{Hash: hash, Size: size, Exists: true})
+			}
+			continue
+		}
+		jobs = append(jobs, MigrateJob{Hash: hash, Size: size})
+		totalSize += size
+	}
+	return
+}
+
+// ListFiles returns the size of each object in the storage
+func ListFiles(ctx context.Context, s Storage) (map[string]int64, error) {
+	files := make(map[string]int64)
+	err := s.WalkDir(ctx, func(hash string, size int64) error {
+		files[hash] = size
+		return nil
+	})
+	return files, err
+}
+
+// MigrateObject copies an object from src to dst, and checks the hash of the copied object.
+// The object will be removed from src after it passed the check if del is true
+func MigrateObject(ctx context.Context, src, dst Storage, job MigrateJob, del bool, proxy func(io.ReadSeeker) io.ReadSeeker) error {
+	hash, exists := job.Hash, job.Exists
+	if exists {
+		if err := verifyObject(ctx, dst, hash); err != nil {
+			log.Warnf("Object %s at %s is broken, copying it again: %v", hash, dst.String(), err)
+			exists = false
+		}
+	}
+	if !exists {
+		if err := copyObject(ctx, src, dst, hash, proxy); err != nil {
+			return err
+		}
+		if err := verifyObject(ctx, dst, hash); err != nil {
+			return fmt.Errorf("Copied object is broken: %w", err)
+		}
+	}
+	if del {
+		if err := src.Remove(ctx, hash); err != nil {
+			return fmt.Errorf("Cannot remove source object: %w", err)
+		}
+	}
+	return nil
+}
+
+func copyObject(ctx context.Context, src, dst Storage, hash string, proxy func(io.ReadSeeker) io.ReadSeeker) error {
+	r, err := src.Open(ctx, hash)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	rs, ok := r.(io.ReadSeeker)
+	if !ok {
+		fd, err := os.CreateTemp("", "*.migrating")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(fd.Name())
+		defer fd.Close()
+		if _, err := io.Copy(fd, r); err != nil {
+			return err
+		}
+		rs = fd
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if err := checkObjectHash(rs, hash); err != nil {
+		return fmt.Errorf("Source object is broken: %w", err)
+	}
+	if _, err := rs.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if proxy != nil {
+		rs = proxy(rs)
+	}
+	return dst.Create(ctx, hash, rs)
+}
+
+func verifyObject(ctx context.Context, s Storage, hash string) error {
+	r, err := s.Open(ctx, hash)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return checkObjectHash(r, hash)
+}
+
+func checkObjectHash(r io.Reader, hash string) error {
+	hashMethod, err := GetHashMethod(len(hash))
+	if err != nil {
+		return err
+	}
+	hw := hashMethod.New()
+	if _, err := io.Copy(hw, r); err != nil {
+		return err
+	}
+	if hs := hex.EncodeToString(hw.Sum(nil)); hs != hash {
+		return fmt.Errorf("File hash mismatch, got %s", hs)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+)
+
+func TestCheckMigrateTarget(t *testing.T) {
+	opt := func(id string, mode string) *StorageOption {
+		return &StorageOption{BasicStorageOption: BasicStorageOption{Type: StorageLocal, Id: id, Mode: mode}}
+	}
+	var data = []struct {
+		Src, Dst *StorageOption
+		Ok       bool
+	}{
+		{opt("a", ModeReadWrite), opt("b", ModeReadWrite), true},
+		{opt("a", ModeReadOnly), opt("b", ""), true},
+		{opt("a", ModeReadWrite), opt("a", ModeReadWrite), false},
+		{opt("a", ModeReadWrite), opt("b", ModeReadOnly), false},
+		{opt("a", ModeReadWrite), opt("b", ModeDrain), false},
+	}
+	for _, d := range data {
+		if err := CheckMigrateTarget(d.Src, d.Dst); (err == nil) != d.Ok {
+			t.Errorf("Migrate %s(%s) to %s(%s): expected ok=%v, got %v", d.Src.Id, d.Src.Mode, d.Dst.Id, d.Dst.Mode, d.Ok, err)
+		}
+	}
+}
+
+func migrateTestFiles(t *testing.T, src, dst Storage, del bool) (failed []string) {
+	t.Helper()
+	srcFiles, err := ListFiles(context.Background(), src)
+	if err != nil {
+		t.Fatalf("Cannot list %s: %v", src.String(), err)
+	}
+	dstFiles, err := ListFiles(context.Background(), dst)
+	if err != nil {
+		t.Fatalf("Cannot list %s: %v", dst.String(), err)
+	}
+	jobs, _ := PlanMigrate(srcFiles, dstFiles, del)
+	for _, job := range jobs {
+		if err := MigrateObject(context.Background(), src, dst, job, del, nil); err != nil {
+			failed = append(failed, job.Hash)
+		}
+	}
+	return
+}
+
+func TestMigrate(t *testing.T) {
+	const size = 1024
+	src := initTestStorage(t, new(LocalStorage), &LocalStorageOption{CachePath: t.TempDir()})
+	dst := initTestStorage(t, new(LocalStorage), &LocalStorageOption{CachePath: t.TempDir()})
+	hashes := make([]string, 4)
+	for i := range hashes {
+		hashes[i] = createTestFile(t, src, (byte)(i+1), size)
+	}
+	// hashes[0] was copied by a previous run, and hashes[1] was broken by an interrupted one
+	createTestFile(t, dst, 1, size)
+	if err := os.WriteFile(dst.hashToPath(hashes[1]), make([]byte, size), 0644); err != nil {
+		t.Fatalf("Cannot create broken object: %v", err)
+	}
+
+	srcFiles, _ := ListFiles(context.Background(), src)
+	dstFiles, _ := ListFiles(context.Background(), dst)
+	jobs, total := PlanMigrate(srcFiles, dstFiles, false)
+	if len(jobs) != 2 || total != size*2 {
+		t.Errorf("Expected 2 objects (%d bytes) to be copied, got %d (%d bytes)", size*2, len(jobs), total)
+	}
+	if jobs, total = PlanMigrate(srcFiles, dstFiles, true); len(jobs) != 4 || total != size*2 {
+		t.Errorf("Expected 4 objects (%d bytes) to be migrated with deleting, got %d (%d bytes)", size*2, len(jobs), total)
+	}
+
+	if failed := migrateTestFiles(t, src, dst, true); len(failed) != 0 {
+		t.Fatalf("Objects %v failed to migrate", failed)
+	}
+	for _, hash := range hashes {
+		if err := verifyObject(context.Background(), dst, hash); err != nil {
+			t.Errorf("Object %s at destination is broken: %v", hash, err)
+		}
+		if _, err := src.Size(context.Background(), hash); !os.IsNotExist(err) {
+			t.Errorf("Object %s should be removed from source, got %v", hash, err)
+		}
+	}
+}
+
+func TestMigrateBrokenSource(t *testing.T) {
+	const size = 1024
+	src := initTestStorage(t, new(LocalStorage), &LocalStorageOption{CachePath: t.TempDir()})
+	dst := initTestStorage(t, new(LocalStorage), &LocalStorageOption{CachePath: t.TempDir()})
+	good := createTestFile(t, src, 1, size)
+	broken := testFileHash(bytes.Repeat([]byte{2}, size))
+	if err := os.WriteFile(src.hashToPath(broken), make([]byte, size), 0644); err != nil {
+		t.Fatalf("Cannot create broken object: %v", err)
+	}
+
+	failed := migrateTestFiles(t, src, dst, true)
+	if len(failed) != 1 || failed[0] != broken {
+		t.Fatalf("Only the broken object %s should fail, got %v", broken, failed)
+	}
+	if _, err := dst.Size(context.Background(), broken); !os.IsNotExist(err) {
+		t.Errorf("Broken object should not be copied, got %v", err)
+	}
+	if _, err := src.Size(context.Background(), broken); err != nil {
+		t.Errorf("Broken object should be kept at source, got %v", err)
+	}
+	if _, err := dst.Size(context.Background(), good); err != nil {
+		t.Errorf("Object %s should be migrated, got %v", good, err)
+	}
+}
@@ -0,0 +1,131 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// RedirectSignNone does not sign the redirect links
+	RedirectSignNone = "none"
+	// RedirectSignSecureLink signs the links for nginx's secure_link module.
+	// The query will be `?md5=<base64url(md5(expr))>&expires=<unix seconds>`
+	RedirectSignSecureLink = "secure-link"
+	// RedirectSignHmac signs the path and the expire time with HMAC-SHA256 using the secret.
+	// The query will be `?e=<base36 unix milliseconds>&s=<base64url(hmac-sha256(secret, path + e))>`
+	RedirectSignHmac = "hmac"
+)
+
+// DefaultSecureLinkExpr matches the nginx config `secure_link_md5 "$secure_link_expires$uri <secret>";`
+const DefaultSecureLinkExpr = "{expires}{uri} {secret}"
+
+type RedirectSignOption struct {
+	Type   string       `yaml:"type"`
+	Secret string       `yaml:"secret,omitempty"`
+	Expire YAMLDuration `yaml:"expire"`
+	// SecureLinkExpr is the string to be hashed for RedirectSignSecureLink,
+	// it should be the same as the `secure_link_md5` directive in the nginx config.
+	// Placeholders {expires}, {uri} and {secret} will be replaced
+	SecureLinkExpr string `yaml:"secure-link-expr,omitempty"`
+}
+
+func (o *RedirectSignOption) setDefaults() {
+	o.Type = RedirectSignNone
+	o.Expire = (YAMLDuration)(time.Minute * 10)
+	o.SecureLinkExpr = DefaultSecureLinkExpr
+}
+
+func (o *RedirectSignOption) validate() error {
+	switch o.Type {
+	case "", RedirectSignNone:
+		return nil
+	case RedirectSignSecureLink, RedirectSignHmac:
+	default:
+		return fmt.Errorf("Unknown redirect sign type %q", o.Type)
+	}
+	if o.Secret == "" {
+		return fmt.Errorf("Secret is required for redirect sign type %q", o.Type)
+	}
+	if o.Expire <= 0 {
+		return fmt.Errorf("Redirect sign expire must be positive")
+	}
+	return nil
+}
+
+// Sign adds the signature and the expiry time to the query of u
+func (o *RedirectSignOption) Sign(u *url.URL, now time.Time) {
+	expires := now.Add(o.Expire.Dur())
+	query := u.Query()
+	switch o.Type {
+	case RedirectSignSecureLink:
+		e := strconv.FormatInt(expires.Unix(), 10)
+		expr := strings.NewReplacer(
+			"{expires}", e,
+			"{uri}", u.Path,
+			"{secret}", o.Secret,
+		).Replace(o.SecureLinkExpr)
+		sum := md5.Sum(([]byte)(expr))
+		query.Set("md5", base64.RawURLEncoding.EncodeToString(sum[:]))
+		query.Set("expires", e)
+	case RedirectSignHmac:
+		e := strconv.FormatInt(expires.UnixMilli(), 36)
+		query.Set("e", e)
+		query.Set("s", o.hmacSign(u.Path, e))
+	default:
+		return
+	}
+	u.RawQuery = query.Encode()
+}
+
+func (o *RedirectSignOption) hmacSign(path string, e string) string {
+	h := hmac.New(sha256.New, ([]byte)(o.Secret))
+	h.Write(([]byte)(path))
+	h.Write(([]byte)(e))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Verify checks a link signed by RedirectSignHmac.
+// It is provided for the web servers written in Go which serve the mounted folder
+func (o *RedirectSignOption) Verify(path string, query url.Values, now time.Time) bool {
+	if o.Type != RedirectSignHmac {
+		return false
+	}
+	sign, e := query.Get("s"), query.Get("e")
+	if len(sign) == 0 || len(e) == 0 {
+		return false
+	}
+	before, err := strconv.ParseInt(e, 36, 64)
+	if err != nil {
+		return false
+	}
+	if !hmac.Equal(([]byte)(o.hmacSign(path, e)), ([]byte)(sign)) {
+		return false
+	}
+	return now.UnixMilli() < before
+}
@@ -0,0 +1,165 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestRedirectSignSecureLink(t *testing.T) {
+	var opt MountStorageOption
+	if err := yaml.Unmarshal(([]byte)(`
+path: mirror
+redirect-base: https://oss.example.com/base
+redirect-sign:
+  type: secure-link
+  secret: my-secret
+  expire: 5m
+`), &opt); err != nil {
+		t.Fatalf("Cannot parse option: %v", err)
+	}
+	if err := opt.RedirectSign.validate(); err != nil {
+		t.Fatalf("Option should be valid: %v", err)
+	}
+	s := new(MountStorage)
+	s.SetOptions(&opt)
+
+	now := time.Unix(1700000000, 0)
+	target, err := s.redirectURL("download", "ab", "abcdef")
+	if err != nil {
+		t.Fatalf("redirectURL: %v", err)
+	}
+	u, _ := url.Parse(target)
+	if u.Path != "/base/download/ab/abcdef" {
+		t.Errorf("Unexpected path %q", u.Path)
+	}
+	expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+	if err != nil {
+		t.Fatalf("Cannot parse expires: %v", err)
+	}
+	if d := time.Until(time.Unix(expires, 0)); d <= 4*time.Minute || d > 5*time.Minute {
+		t.Errorf("Unexpected expire duration %v", d)
+	}
+
+	// the same as `secure_link_md5 "$secure_link_expires$uri my-secret";`
+	u, _ = url.Parse("https://oss.example.com/base/download/ab/abcdef")
+	opt.RedirectSign.Sign(u, now)
+	sum := md5.Sum(([]byte)("1700000300/base/download/ab/abcdef my-secret"))
+	if expect := base64.RawURLEncoding.EncodeToString(sum[:]); u.Query().Get("md5") != expect {
+		t.Errorf("Expected md5=%s, got %s", expect, u.Query().Get("md5"))
+	}
+	if u.Query().Get("expires") != "1700000300" {
+		t.Errorf("Expected expires=1700000300, got %s", u.Query().Get("expires"))
+	}
+}
+
+func TestRedirectSignHmac(t *testing.T) {
+	opt := RedirectSignOption{
+		Type:   RedirectSignHmac,
+		Secret: "my-secret",
+		Expire: (YAMLDuration)(time.Minute),
+	}
+	if err := opt.validate(); err != nil {
+		t.Fatalf("Option should be valid: %v", err)
+	}
+	now := time.Now()
+	u, _ := url.Parse("https://oss.example.com/download/ab/abcdef?name=a.jar")
+	opt.Sign(u, now)
+	query := u.Query()
+	if query.Get("name") != "a.jar" {
+		t.Errorf("Existing query was dropped: %q", u.RawQuery)
+	}
+	if !opt.Verify(u.Path, query, now) {
+		t.Errorf("Signed link should be valid")
+	}
+	if opt.Verify(u.Path, query, now.Add(time.Minute*2)) {
+		t.Errorf("Signed link should be expired")
+	}
+	if opt.Verify("/download/ab/abcdee", query, now) {
+		t.Errorf("Signature should not be valid for another path")
+	}
+	other := opt
+	other.Secret = "other-secret"
+	if other.Verify(u.Path, query, now) {
+		t.Errorf("Signature should not be valid for another secret")
+	}
+}
+
+func TestRedirectSignValidate(t *testing.T) {
+	data := []struct {
+		opt   RedirectSignOption
+		valid bool
+	}{
+		{RedirectSignOption{}, true},
+		{RedirectSignOption{Type: RedirectSignNone}, true},
+		{RedirectSignOption{Type: RedirectSignHmac, Expire: (YAMLDuration)(time.Minute)}, false},
+		{RedirectSignOption{Type: RedirectSignHmac, Secret: "s"}, false},
+		{RedirectSignOption{Type: "sha1", Secret: "s", Expire: (YAMLDuration)(time.Minute)}, false},
+	}
+	for _, d := range data {
+		if err := d.opt.validate(); (err == nil) != d.valid {
+			t.Errorf("validate(%#v): expected valid=%v, got %v", d.opt, d.valid, err)
+		}
+	}
+}
+
+func TestMountStorageCheckAliveSigned(t *testing.T) {
+	dir := t.TempDir()
+	sign := RedirectSignOption{
+		Type:   RedirectSignHmac,
+		Secret: "my-secret",
+		Expire: (YAMLDuration)(time.Minute),
+	}
+	files := http.FileServer(http.Dir(dir))
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if !sign.Verify(req.URL.Path, req.URL.Query(), time.Now()) {
+			http.Error(rw, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+		files.ServeHTTP(rw, req)
+	}))
+	defer srv.Close()
+
+	s := new(MountStorage)
+	s.SetOptions(&MountStorageOption{
+		Path:         dir,
+		RedirectBase: srv.URL,
+		RedirectSign: sign,
+	})
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if _, err := s.checkAlive(context.Background(), 1); err != nil {
+		t.Errorf("checkAlive: %v", err)
+	}
+	if err := s.CheckHealth(context.Background()); err != nil {
+		t.Errorf("CheckHealth: %v", err)
+	}
+}
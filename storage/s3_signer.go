@@ -0,0 +1,186 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Signer implements AWS Signature Version 4 for the S3 service
+// see <https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-authenticating-requests.html>
+type s3Signer struct {
+	accessKey string
+	secretKey string
+	region    string
+}
+
+const (
+	s3SignAlgorithm   = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3EmptyPayload    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	s3TimeFormat      = "20060102T150405Z"
+	s3DateFormat      = "20060102"
+)
+
+func hmacSha256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(([]byte)(data))
+	return h.Sum(nil)
+}
+
+func (s *s3Signer) scope(now time.Time) string {
+	return now.Format(s3DateFormat) + "/" + s.region + "/s3/aws4_request"
+}
+
+func (s *s3Signer) signature(now time.Time, canonicalRequest string) string {
+	reqHash := sha256.Sum256(([]byte)(canonicalRequest))
+	strToSign := s3SignAlgorithm + "\n" +
+		now.Format(s3TimeFormat) + "\n" +
+		s.scope(now) + "\n" +
+		hex.EncodeToString(reqHash[:])
+	key := hmacSha256(([]byte)("AWS4"+s.secretKey), now.Format(s3DateFormat))
+	key = hmacSha256(key, s.region)
+	key = hmacSha256(key, "s3")
+	key = hmacSha256(key, "aws4_request")
+	return hex.EncodeToString(hmacSha256(key, strToSign))
+}
+
+// Sign adds the Authorization header to the request
+// payloadHash should be the hex encoded sha256 of the body, or s3UnsignedPayload
+func (s *s3Signer) Sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	req.Header.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("Range") != "" {
+		headers = append(headers, "range")
+		sort.Strings(headers)
+	}
+	var canonicalHeaders strings.Builder
+	for _, h := range headers {
+		canonicalHeaders.WriteString(h)
+		canonicalHeaders.WriteByte(':')
+		if h == "host" {
+			canonicalHeaders.WriteString(req.URL.Host)
+		} else {
+			canonicalHeaders.WriteString(strings.TrimSpace(req.Header.Get(h)))
+		}
+		canonicalHeaders.WriteByte('\n')
+	}
+	signedHeaders := strings.Join(headers, ";")
+
+	canonicalRequest := req.Method + "\n" +
+		s3EscapePath(req.URL.Path) + "\n" +
+		s3CanonicalQuery(req.URL.Query()) + "\n" +
+		canonicalHeaders.String() + "\n" +
+		signedHeaders + "\n" +
+		payloadHash
+	req.Header.Set("Authorization", s3SignAlgorithm+
+		" Credential="+s.accessKey+"/"+s.scope(now)+
+		", SignedHeaders="+signedHeaders+
+		", Signature="+s.signature(now, canonicalRequest))
+}
+
+// Presign returns a URL that can be used to access u without any other credentials until it expires
+func (s *s3Signer) Presign(method string, u *url.URL, expires time.Duration, now time.Time) string {
+	now = now.UTC()
+	query := u.Query()
+	query.Set("X-Amz-Algorithm", s3SignAlgorithm)
+	query.Set("X-Amz-Credential", s.accessKey+"/"+s.scope(now))
+	query.Set("X-Amz-Date", now.Format(s3TimeFormat))
+	query.Set("X-Amz-Expires", strconv.FormatInt((int64)(expires.Seconds()), 10))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalQuery := s3CanonicalQuery(query)
+	canonicalRequest := method + "\n" +
+		s3EscapePath(u.Path) + "\n" +
+		canonicalQuery + "\n" +
+		"host:" + u.Host + "\n" +
+		"\n" +
+		"host\n" +
+		s3UnsignedPayload
+
+	signed := *u
+	signed.RawPath = ""
+	signed.RawQuery = canonicalQuery + "&X-Amz-Signature=" + s.signature(now, canonicalRequest)
+	return signed.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k, _ := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		// do not sort the caller's values in place
+		vs := slices.Clone(query[k])
+		sort.Strings(vs)
+		for _, v := range vs {
+			if b.Len() > 0 {
+				b.WriteByte('&')
+			}
+			b.WriteString(s3Escape(k, true))
+			b.WriteByte('=')
+			b.WriteString(s3Escape(v, true))
+		}
+	}
+	return b.String()
+}
+
+func s3EscapePath(p string) string {
+	if p == "" {
+		return "/"
+	}
+	return s3Escape(p, false)
+}
+
+// s3Escape encodes every byte except the unreserved characters defined by RFC 3986
+func s3Escape(s string, encodeSlash bool) string {
+	const hexChars = "0123456789ABCDEF"
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexChars[c>>4])
+			b.WriteByte(hexChars[c&0xf])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,358 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// The seekable zstd format is a sequence of independently compressed zstd frames,
+// followed by a seek table inside a skippable frame.
+// Since skippable frames are ignored by decoders, it is still a valid zstd stream.
+//
+// See <https://github.com/facebook/zstd/blob/dev/contrib/seekable_format/zstd_seekable_compression_format.md>
+const (
+	seekableFrameSize = 1024 * 1024 // size of the decompressed data in each frame
+
+	seekTableSkippableMagic = 0x184D2A5E
+	seekableMagic           = 0x8F92EAB1
+	seekTableFooterSize     = 9
+	seekTableChecksumFlag   = 1 << 7
+)
+
+var errNotSeekable = errors.New("zstd stream does not contain a seek table")
+
+type seekableZstdWriter struct {
+	w       io.Writer
+	enc     *zstd.Encoder
+	buf     []byte
+	cbuf    []byte
+	entries []byte
+	frames  uint32
+	err     error
+}
+
+func newSeekableZstdWriter(w io.Writer, opts ...zstd.EOption) *seekableZstdWriter {
+	// error will only be returned when the options are invalid
+	enc, _ := zstd.NewWriter(nil, opts...)
+	return &seekableZstdWriter{
+		w:   w,
+		enc: enc,
+		buf: make([]byte, 0, seekableFrameSize),
+	}
+}
+
+func (w *seekableZstdWriter) Write(buf []byte) (n int, err error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	for len(buf) > 0 {
+		m := copy(w.buf[len(w.buf):cap(w.buf)], buf)
+		w.buf = w.buf[:len(w.buf)+m]
+		buf = buf[m:]
+		n += m
+		if len(w.buf) == cap(w.buf) {
+			if err = w.flushFrame(); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (w *seekableZstdWriter) flushFrame() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	w.cbuf = w.enc.EncodeAll(w.buf, w.cbuf[:0])
+	if _, err := w.w.Write(w.cbuf); err != nil {
+		w.err = err
+		return err
+	}
+	w.entries = binary.LittleEndian.AppendUint32(w.entries, (uint32)(len(w.cbuf)))
+	w.entries = binary.LittleEndian.AppendUint32(w.entries, (uint32)(len(w.buf)))
+	w.frames++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// Close flushes the last frame and writes the seek table, it will not close the underlying writer
+func (w *seekableZstdWriter) Close() (err error) {
+	if w.err != nil {
+		return w.err
+	}
+	defer w.enc.Close()
+	if err = w.flushFrame(); err != nil {
+		return
+	}
+	table := make([]byte, 0, 8+len(w.entries)+seekTableFooterSize)
+	table = binary.LittleEndian.AppendUint32(table, seekTableSkippableMagic)
+	table = binary.LittleEndian.AppendUint32(table, (uint32)(len(w.entries)+seekTableFooterSize))
+	table = append(table, w.entries...)
+	table = binary.LittleEndian.AppendUint32(table, w.frames)
+	table = append(table, 0) // seek table descriptor, without checksum
+	table = binary.LittleEndian.AppendUint32(table, seekableMagic)
+	if _, err = w.w.Write(table); err != nil {
+		w.err = err
+		return
+	}
+	w.err = errors.New("seekable zstd writer is closed")
+	return nil
+}
+
+type seekableFrame struct {
+	cOffset, dOffset int64
+	cSize, dSize     int64
+}
+
+// seekableZstdReader decompresses a seekable zstd stream with random access
+type seekableZstdReader struct {
+	r      io.ReaderAt
+	frames []seekableFrame
+	size   int64
+	dec    *zstd.Decoder
+
+	pos  int64
+	cur  int // index of the decoded frame in buf, -1 means none
+	buf  []byte
+	cbuf []byte
+}
+
+var _ io.ReadSeekCloser = (*seekableZstdReader)(nil)
+
+// newSeekableZstdReader parses the seek table at the end of r.
+// errNotSeekable will be returned if r is not in seekable format
+func newSeekableZstdReader(r io.ReaderAt, csize int64) (*seekableZstdReader, error) {
+	if csize < seekTableFooterSize+8 {
+		return nil, errNotSeekable
+	}
+	var footer [seekTableFooterSize]byte
+	if _, err := r.ReadAt(footer[:], csize-seekTableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic {
+		return nil, errNotSeekable
+	}
+	count := (int64)(binary.LittleEndian.Uint32(footer[0:]))
+	descriptor := footer[4]
+	entrySize := (int64)(8)
+	if descriptor&seekTableChecksumFlag != 0 {
+		entrySize = 12
+	}
+	tableSize := count*entrySize + seekTableFooterSize
+	tableStart := csize - tableSize - 8
+	if tableStart < 0 {
+		return nil, fmt.Errorf("seek table size %d is larger than the file", tableSize)
+	}
+	table := make([]byte, tableSize+8)
+	if _, err := r.ReadAt(table, tableStart); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(table[0:]) != seekTableSkippableMagic || (int64)(binary.LittleEndian.Uint32(table[4:])) != tableSize {
+		return nil, errNotSeekable
+	}
+
+	frames := make([]seekableFrame, count)
+	var cOffset, dOffset int64
+	entries := table[8:]
+	for i := range frames {
+		e := entries[(int64)(i)*entrySize:]
+		f := &frames[i]
+		f.cOffset, f.dOffset = cOffset, dOffset
+		f.cSize = (int64)(binary.LittleEndian.Uint32(e[0:]))
+		f.dSize = (int64)(binary.LittleEndian.Uint32(e[4:]))
+		cOffset += f.cSize
+		dOffset += f.dSize
+	}
+	if cOffset != tableStart {
+		return nil, fmt.Errorf("seek table does not match the file, frames end at %d but table starts at %d", cOffset, tableStart)
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return &seekableZstdReader{
+		r:      r,
+		frames: frames,
+		size:   dOffset,
+		dec:    dec,
+		cur:    -1,
+	}, nil
+}
+
+// Size returns the decompressed size
+func (r *seekableZstdReader) Size() int64 {
+	return r.size
+}
+
+func (r *seekableZstdReader) Read(buf []byte) (n int, err error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	i := sort.Search(len(r.frames), func(i int) bool {
+		f := &r.frames[i]
+		return f.dOffset+f.dSize > r.pos
+	})
+	f := &r.frames[i]
+	if i != r.cur {
+		r.cur = -1
+		if (int64)(cap(r.cbuf)) < f.cSize {
+			r.cbuf = make([]byte, f.cSize)
+		}
+		r.cbuf = r.cbuf[:f.cSize]
+		if _, err = r.r.ReadAt(r.cbuf, f.cOffset); err != nil {
+			return
+		}
+		if r.buf, err = r.dec.DecodeAll(r.cbuf, r.buf[:0]); err != nil {
+			return
+		}
+		if (int64)(len(r.buf)) != f.dSize {
+			return 0, fmt.Errorf("zstd frame %d decompressed to %d bytes, expected %d bytes", i, len(r.buf), f.dSize)
+		}
+		r.cur = i
+	}
+	n = copy(buf, r.buf[r.pos-f.dOffset:])
+	r.pos += (int64)(n)
+	return
+}
+
+func (r *seekableZstdReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := resolveSeek(r.pos, r.size, offset, whence)
+	if err != nil {
+		return r.pos, err
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *seekableZstdReader) Close() error {
+	r.dec.Close()
+	return nil
+}
+
+// decompressSeeker provides random access for compressed streams which cannot seek.
+// Seeking forward discards the decompressed data, and seeking backward restarts from the beginning
+type decompressSeeker struct {
+	src  io.ReadSeeker
+	c    Compressor
+	size int64
+
+	r    io.Reader
+	rpos int64 // position of r
+	pos  int64
+}
+
+var _ io.ReadSeekCloser = (*decompressSeeker)(nil)
+
+// newDecompressSeeker creates a seeker for the compressed src, size must be the decompressed size
+func newDecompressSeeker(src io.ReadSeeker, c Compressor, size int64) *decompressSeeker {
+	return &decompressSeeker{
+		src:  src,
+		c:    c,
+		size: size,
+	}
+}
+
+func (r *decompressSeeker) reset() (err error) {
+	r.closeReader()
+	if _, err = r.src.Seek(0, io.SeekStart); err != nil {
+		return
+	}
+	if r.r, err = r.c.WrapReader(r.src); err != nil {
+		return
+	}
+	r.rpos = 0
+	return
+}
+
+func (r *decompressSeeker) closeReader() {
+	if closer, ok := r.r.(io.Closer); ok {
+		closer.Close()
+	}
+	r.r = nil
+}
+
+func (r *decompressSeeker) Read(buf []byte) (n int, err error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.r == nil || r.pos < r.rpos {
+		if err = r.reset(); err != nil {
+			return
+		}
+	}
+	if r.pos > r.rpos {
+		var m int64
+		m, err = io.CopyN(io.Discard, r.r, r.pos-r.rpos)
+		r.rpos += m
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+	}
+	if remain := r.size - r.pos; (int64)(len(buf)) > remain {
+		buf = buf[:remain]
+	}
+	n, err = r.r.Read(buf)
+	r.rpos += (int64)(n)
+	r.pos += (int64)(n)
+	if err == io.EOF && r.pos < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+func (r *decompressSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos, err := resolveSeek(r.pos, r.size, offset, whence)
+	if err != nil {
+		return r.pos, err
+	}
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *decompressSeeker) Close() error {
+	r.closeReader()
+	return nil
+}
+
+func resolveSeek(pos, size int64, offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += pos
+	case io.SeekEnd:
+		offset += size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	return offset, nil
+}
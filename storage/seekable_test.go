@@ -0,0 +1,176 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func newSeekableTestData(size int) []byte {
+	data := make([]byte, size)
+	rd := rand.New(rand.NewSource(1))
+	for i := range data {
+		// compressible but not trivial
+		data[i] = 'a' + (byte)(rd.Intn(8))
+	}
+	return data
+}
+
+func checkRandomAccess(t *testing.T, r io.ReadSeeker, data []byte) {
+	offsets := []int64{0, 1, seekableFrameSize - 3, seekableFrameSize, (int64)(len(data)) - 10, 12345, seekableFrameSize*2 + 7, 5}
+	for _, off := range offsets {
+		if off >= (int64)(len(data)) {
+			continue
+		}
+		if _, err := r.Seek(off, io.SeekStart); err != nil {
+			t.Fatalf("Cannot seek to %d: %v", off, err)
+		}
+		n := (int64)(seekableFrameSize / 2)
+		if off+n > (int64)(len(data)) {
+			n = (int64)(len(data)) - off
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatalf("Cannot read %d bytes at %d: %v", n, off, err)
+		}
+		if !bytes.Equal(buf, data[off:off+n]) {
+			t.Fatalf("Data mismatch at offset %d", off)
+		}
+	}
+	if end, err := r.Seek(0, io.SeekEnd); err != nil || end != (int64)(len(data)) {
+		t.Fatalf("Seek to end returned %d, %v; expected %d", end, err, len(data))
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Fatalf("Read at end returned %d, %v; expected io.EOF", n, err)
+	}
+}
+
+func TestSeekableZstd(t *testing.T) {
+	data := newSeekableTestData(seekableFrameSize*2 + seekableFrameSize/3)
+	var buf bytes.Buffer
+	w := ZstdCompressor.WrapWriter(&buf)
+	// write in odd sized chunks to cross the frame boundaries
+	for p := data; len(p) > 0; {
+		n := 77777
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatalf("Cannot write: %v", err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Cannot close writer: %v", err)
+	}
+
+	// should still be a valid zstd stream
+	r, err := ZstdCompressor.WrapReader(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("Cannot create decompressor: %v", err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Decompress seekable zstd as normal zstd failed: %v", err)
+	}
+
+	sr, err := newSeekableZstdReader(bytes.NewReader(buf.Bytes()), (int64)(buf.Len()))
+	if err != nil {
+		t.Fatalf("Cannot open seekable zstd: %v", err)
+	}
+	defer sr.Close()
+	if len(sr.frames) != 3 {
+		t.Errorf("Expected 3 frames, got %d", len(sr.frames))
+	}
+	if sr.Size() != (int64)(len(data)) {
+		t.Errorf("Expected size %d, got %d", len(data), sr.Size())
+	}
+	checkRandomAccess(t, sr, data)
+
+	var gz bytes.Buffer
+	gw := GzipCompressor.WrapWriter(&gz)
+	gw.Write(data)
+	gw.Close()
+	if _, err := newSeekableZstdReader(bytes.NewReader(gz.Bytes()), (int64)(gz.Len())); err != errNotSeekable {
+		t.Errorf("Expected errNotSeekable for gzip data, got %v", err)
+	}
+}
+
+func TestDecompressSeeker(t *testing.T) {
+	data := newSeekableTestData(seekableFrameSize*2 + 100)
+	for _, c := range []Compressor{GzipCompressor, BrotliCompressor} {
+		var buf bytes.Buffer
+		w := c.WrapWriter(&buf)
+		w.Write(data)
+		w.Close()
+		r := newDecompressSeeker(bytes.NewReader(buf.Bytes()), c, (int64)(len(data)))
+		checkRandomAccess(t, r, data)
+		r.Close()
+	}
+}
+
+func TestLocalStorageServeCompressedRange(t *testing.T) {
+	const hash = "89abcdef0123456789abcdef0123456789abcdef"
+	data := newSeekableTestData(seekableFrameSize + 4096)
+
+	for _, c := range []Compressor{ZstdCompressor, GzipCompressor} {
+		s := new(LocalStorage)
+		s.SetOptions(&LocalStorageOption{CachePath: t.TempDir(), Compressor: c})
+		if err := s.Init(context.Background()); err != nil {
+			t.Fatalf("Cannot init local storage: %v", err)
+		}
+		fd, err := os.Create(s.hashToPath(hash) + c.Ext())
+		if err != nil {
+			t.Fatalf("Cannot create file: %v", err)
+		}
+		w := c.WrapWriter(fd)
+		w.Write(data)
+		w.Close()
+		fd.Close()
+
+		const start, end = seekableFrameSize - 100, seekableFrameSize + 99
+		req := httptest.NewRequest(http.MethodGet, "/download/"+hash, nil)
+		req.Header.Set("Range", "bytes="+strconv.Itoa(start)+"-"+strconv.Itoa(end))
+		rw := httptest.NewRecorder()
+		n, err := s.ServeDownload(rw, req, hash, (int64)(len(data)))
+		if err != nil {
+			t.Fatalf("[%s] Cannot serve ranged request: %v", c, err)
+		}
+		if rw.Code != http.StatusPartialContent {
+			t.Fatalf("[%s] Expected status 206, got %d", c, rw.Code)
+		}
+		expectRange := "bytes " + strconv.Itoa(start) + "-" + strconv.Itoa(end) + "/" + strconv.Itoa(len(data))
+		if cr := rw.Header().Get("Content-Range"); cr != expectRange {
+			t.Errorf("[%s] Expected Content-Range %q, got %q", c, expectRange, cr)
+		}
+		if n != end-start+1 {
+			t.Errorf("[%s] Expected served size %d, got %d", c, end-start+1, n)
+		}
+		if !bytes.Equal(rw.Body.Bytes(), data[start:end+1]) {
+			t.Errorf("[%s] Response body mismatch", c)
+		}
+	}
+}
@@ -21,6 +21,7 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -29,6 +30,7 @@ import (
 
 	"gopkg.in/yaml.v3"
 
+	"github.com/LiterMC/go-openbmclapi/internal/gosrc"
 	"github.com/LiterMC/go-openbmclapi/utils"
 )
 
@@ -43,11 +45,15 @@ type Storage interface {
 	// Init will be called before start to use a storage
 	Init(context.Context) error
 
-	Size(hash string) (int64, error)
-	Open(hash string) (io.ReadCloser, error)
-	Create(hash string, r io.ReadSeeker) error
-	Remove(hash string) error
-	WalkDir(func(hash string, size int64) error) error
+	// The context passed to the following methods should cancel the in-flight I/O,
+	// and ctx.Err() should be returned once it is done.
+	// The reader returned by Open may still be read after the call returns, until the context is done
+
+	Size(ctx context.Context, hash string) (int64, error)
+	Open(ctx context.Context, hash string) (io.ReadCloser, error)
+	Create(ctx context.Context, hash string, r io.ReadSeeker) error
+	Remove(ctx context.Context, hash string) error
+	WalkDir(ctx context.Context, walker func(hash string, size int64) error) error
 
 	ServeDownload(rw http.ResponseWriter, req *http.Request, hash string, size int64) (int64, error)
 	ServeMeasure(rw http.ResponseWriter, req *http.Request, size int) error
@@ -57,6 +63,10 @@ const (
 	StorageLocal  = "local"
 	StorageMount  = "mount"
 	StorageWebdav = "webdav"
+	StorageS3     = "s3"
+	StorageTiered = "tiered"
+	StorageMemory = "memory"
+	StorageFaulty = "faulty"
 )
 
 type StorageFactory struct {
@@ -82,6 +92,44 @@ func NewStorage(opt StorageOption) Storage {
 	return s
 }
 
+// rangedSize returns the actual content size that will be sent for a ranged request
+func rangedSize(rangeH string, size int64) int64 {
+	rgs, err := gosrc.ParseRange(rangeH, size)
+	if err == nil && len(rgs) > 0 {
+		var newSize int64 = 0
+		for _, r := range rgs {
+			newSize += r.Length
+		}
+		if newSize < size {
+			return newSize
+		}
+	}
+	return size
+}
+
+// contextReader stops reading once the context is done
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(buf []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(buf)
+}
+
+// walkCacheDirContext walks the cache folder, and stops once the context is done
+func walkCacheDirContext(ctx context.Context, cacheDir string, walker func(hash string, size int64) error) error {
+	return utils.WalkCacheDir(cacheDir, func(hash string, size int64) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return walker(hash, size)
+	})
+}
+
 type UnexpectedStorageTypeError struct {
 	Type string
 }
@@ -95,10 +143,40 @@ func (e *UnexpectedStorageTypeError) Error() string {
 	return fmt.Sprintf("Unexpected storage type %q, must be one of %s", e.Type, strings.Join(types, ","))
 }
 
+const (
+	// ModeReadWrite storages are served from and written to
+	ModeReadWrite = "read-write"
+	// ModeReadOnly storages are served from, but never written to
+	ModeReadOnly = "read-only"
+	// ModeDrain storages are served from, and their files will be migrated to the other storages in the background
+	ModeDrain = "drain"
+)
+
+// ServeLimitOption limits the downloads served from a storage.
+// Zero means no limit
+type ServeLimitOption struct {
+	MaxConn    int `yaml:"max-conn"`
+	UploadRate int `yaml:"upload-rate"` // in KiB/s
+}
+
+// Enabled reports whether any limit is set
+func (o ServeLimitOption) Enabled() bool {
+	return o.MaxConn > 0 || o.UploadRate > 0
+}
+
 type BasicStorageOption struct {
 	Type   string `yaml:"type"`
 	Id     string `yaml:"id"`
 	Weight uint   `yaml:"weight"`
+	Mode   string `yaml:"mode"`
+	// ServeLimit limits the downloads served from the storage,
+	// and the requests will be spilled to the next storage when the limit is reached
+	ServeLimit ServeLimitOption `yaml:"serve-limit,omitempty"`
+}
+
+// Writable reports whether new files can be written to the storage
+func (o *BasicStorageOption) Writable() bool {
+	return o.Mode == "" || o.Mode == ModeReadWrite
 }
 
 type StorageOption struct {
@@ -118,6 +196,16 @@ func (o *StorageOption) UnmarshalYAML(n *yaml.Node) (err error) {
 	if !ok {
 		return &UnexpectedStorageTypeError{opts.Type}
 	}
+	switch opts.Mode {
+	case "":
+		opts.Mode = ModeReadWrite
+	case ModeReadWrite, ModeReadOnly, ModeDrain:
+	default:
+		return fmt.Errorf("Unexpected storage mode %q, must be one of %s,%s,%s", opts.Mode, ModeReadWrite, ModeReadOnly, ModeDrain)
+	}
+	if opts.ServeLimit.MaxConn < 0 || opts.ServeLimit.UploadRate < 0 {
+		return errors.New("Serve limit cannot be negative")
+	}
 	o.BasicStorageOption = opts.BasicStorageOption
 	o.Data = f.NewConfig()
 	if opts.Data.Node == nil {
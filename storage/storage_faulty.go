@@ -0,0 +1,390 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+	. "github.com/LiterMC/go-openbmclapi/utils"
+)
+
+// ErrInjectedFault is returned by FaultyStorage when it decides to fail a call
+var ErrInjectedFault = errors.New("Injected fault")
+
+// The methods of FaultyStorage which faults can be injected to
+const (
+	FaultMethodSize          = "size"
+	FaultMethodOpen          = "open"
+	FaultMethodCreate        = "create"
+	FaultMethodRemove        = "remove"
+	FaultMethodWalkDir       = "walk-dir"
+	FaultMethodServeDownload = "serve-download"
+	FaultMethodServeMeasure  = "serve-measure"
+	FaultMethodHealth        = "health"
+)
+
+var faultMethods = []string{
+	FaultMethodSize, FaultMethodOpen, FaultMethodCreate, FaultMethodRemove,
+	FaultMethodWalkDir, FaultMethodServeDownload, FaultMethodServeMeasure, FaultMethodHealth,
+}
+
+type FaultyStorageOption struct {
+	// Methods are the methods which faults will be injected to, empty means all methods
+	Methods []string `yaml:"methods"`
+	// Latency is added before each call, plus a random duration up to LatencyJitter
+	Latency       YAMLDuration `yaml:"latency"`
+	LatencyJitter YAMLDuration `yaml:"latency-jitter"`
+	// ErrorRate is the probability that a call fails with ErrInjectedFault
+	ErrorRate float64 `yaml:"error-rate"`
+	// TruncateRate is the probability that the content is cut short without an error.
+	// For walk-dir, it is the probability that each file is missing from the listing
+	TruncateRate float64 `yaml:"truncate-rate"`
+	// CorruptRate is the probability that a byte of the content is flipped
+	CorruptRate float64 `yaml:"corrupt-rate"`
+	// StallRate is the probability that the content stalls for StallDuration before it is sent
+	StallRate     float64      `yaml:"stall-rate"`
+	StallDuration YAMLDuration `yaml:"stall-duration"`
+	// Seed of the random source, 0 means a random seed
+	Seed    int64         `yaml:"seed"`
+	Backend StorageOption `yaml:"backend"`
+}
+
+var (
+	_ yaml.Marshaler   = (*FaultyStorageOption)(nil)
+	_ yaml.Unmarshaler = (*FaultyStorageOption)(nil)
+)
+
+func (o *FaultyStorageOption) MarshalYAML() (any, error) {
+	type T FaultyStorageOption
+	return (*T)(o), nil
+}
+
+func (o *FaultyStorageOption) UnmarshalYAML(n *yaml.Node) (err error) {
+	// set default values
+	o.StallDuration = (YAMLDuration)(time.Second * 30)
+
+	type T FaultyStorageOption
+	if err = n.Decode((*T)(o)); err != nil {
+		return
+	}
+	for _, m := range o.Methods {
+		if !slices.Contains(faultMethods, m) {
+			return fmt.Errorf("Unexpected fault method %q, must be one of %s", m, strings.Join(faultMethods, ","))
+		}
+	}
+	for _, r := range []float64{o.ErrorRate, o.TruncateRate, o.CorruptRate, o.StallRate} {
+		if r < 0 || r > 1 {
+			return fmt.Errorf("Fault rate %v must be between 0 and 1", r)
+		}
+	}
+	return
+}
+
+// FaultyStorage wraps another storage, and injects latency, errors, truncated or corrupted content
+// and stalled responses into the selected methods.
+// It should only be used to test how the cluster behaves when a storage misbehaves
+type FaultyStorage struct {
+	opt FaultyStorageOption
+
+	backend Storage
+
+	rndMux sync.Mutex
+	rnd    *rand.Rand
+}
+
+var _ Storage = (*FaultyStorage)(nil)
+var _ HealthChecker = (*FaultyStorage)(nil)
+var _ CapacityReporter = (*FaultyStorage)(nil)
+
+func init() {
+	RegisterStorageFactory(StorageFaulty, StorageFactory{
+		New:       func() Storage { return new(FaultyStorage) },
+		NewConfig: func() any { return new(FaultyStorageOption) },
+	})
+}
+
+func (s *FaultyStorage) String() string {
+	return fmt.Sprintf("<FaultyStorage error=%v truncate=%v corrupt=%v stall=%v backend=%s>",
+		s.opt.ErrorRate, s.opt.TruncateRate, s.opt.CorruptRate, s.opt.StallRate, s.backend)
+}
+
+func (s *FaultyStorage) Options() any {
+	return &s.opt
+}
+
+func (s *FaultyStorage) SetOptions(newOpts any) {
+	s.opt = *(newOpts.(*FaultyStorageOption))
+	s.backend = nil
+	if _, ok := storageFactories[s.opt.Backend.Type]; ok {
+		s.backend = NewStorage(s.opt.Backend)
+	}
+	seed := s.opt.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	s.rnd = rand.New(rand.NewSource(seed))
+}
+
+// Backend returns the wrapped storage
+func (s *FaultyStorage) Backend() Storage {
+	return s.backend
+}
+
+func (s *FaultyStorage) Init(ctx context.Context) error {
+	if s.backend == nil {
+		return errors.New("Faulty storage requires a backend storage")
+	}
+	log.Warnf("Faults will be injected into %s, it should never be used in production", s.String())
+	return s.backend.Init(ctx)
+}
+
+func (s *FaultyStorage) enabled(method string) bool {
+	return len(s.opt.Methods) == 0 || slices.Contains(s.opt.Methods, method)
+}
+
+func (s *FaultyStorage) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	s.rndMux.Lock()
+	defer s.rndMux.Unlock()
+	return s.rnd.Float64() < rate
+}
+
+func (s *FaultyStorage) randInt63n(n int64) int64 {
+	if n <= 0 {
+		return 0
+	}
+	s.rndMux.Lock()
+	defer s.rndMux.Unlock()
+	return s.rnd.Int63n(n)
+}
+
+// before injects the latency and the error for a call
+func (s *FaultyStorage) before(ctx context.Context, method string) error {
+	if !s.enabled(method) {
+		return nil
+	}
+	if delay := s.opt.Latency.Dur() + (time.Duration)(s.randInt63n((int64)(s.opt.LatencyJitter))); delay > 0 {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if s.roll(s.opt.ErrorRate) {
+		return fmt.Errorf("%w at %s", ErrInjectedFault, method)
+	}
+	return nil
+}
+
+// newContentFault decides how the content of a call will be broken.
+// The offsets are picked in [0, size)
+func (s *FaultyStorage) newContentFault(method string, size int64) *contentFault {
+	if !s.enabled(method) || size <= 0 {
+		return nil
+	}
+	f := &contentFault{
+		truncateAt: -1,
+		corruptAt:  -1,
+	}
+	if s.roll(s.opt.StallRate) {
+		f.stall = s.opt.StallDuration.Dur()
+	}
+	if s.roll(s.opt.TruncateRate) {
+		f.truncateAt = s.randInt63n(size)
+	}
+	if s.roll(s.opt.CorruptRate) {
+		f.corruptAt = s.randInt63n(size)
+	}
+	if f.stall <= 0 && f.truncateAt < 0 && f.corruptAt < 0 {
+		return nil
+	}
+	return f
+}
+
+func (s *FaultyStorage) CheckHealth(ctx context.Context) error {
+	if err := s.before(ctx, FaultMethodHealth); err != nil {
+		return err
+	}
+	return CheckHealth(ctx, s.backend)
+}
+
+func (s *FaultyStorage) Capacity(ctx context.Context) (Capacity, error) {
+	if r, ok := s.backend.(CapacityReporter); ok {
+		return r.Capacity(ctx)
+	}
+	return Capacity{}, ErrCapacityUnknown
+}
+
+func (s *FaultyStorage) Size(ctx context.Context, hash string) (int64, error) {
+	if err := s.before(ctx, FaultMethodSize); err != nil {
+		return 0, err
+	}
+	return s.backend.Size(ctx, hash)
+}
+
+func (s *FaultyStorage) Open(ctx context.Context, hash string) (io.ReadCloser, error) {
+	if err := s.before(ctx, FaultMethodOpen); err != nil {
+		return nil, err
+	}
+	r, err := s.backend.Open(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	if s.enabled(FaultMethodOpen) && (s.opt.StallRate > 0 || s.opt.TruncateRate > 0 || s.opt.CorruptRate > 0) {
+		size, err := s.backend.Size(ctx, hash)
+		if err == nil {
+			if f := s.newContentFault(FaultMethodOpen, size); f != nil {
+				return &faultyReader{ReadCloser: r, ctx: ctx, fault: f}, nil
+			}
+		}
+	}
+	return r, nil
+}
+
+func (s *FaultyStorage) Create(ctx context.Context, hash string, r io.ReadSeeker) error {
+	if err := s.before(ctx, FaultMethodCreate); err != nil {
+		return err
+	}
+	return s.backend.Create(ctx, hash, r)
+}
+
+func (s *FaultyStorage) Remove(ctx context.Context, hash string) error {
+	if err := s.before(ctx, FaultMethodRemove); err != nil {
+		return err
+	}
+	return s.backend.Remove(ctx, hash)
+}
+
+func (s *FaultyStorage) WalkDir(ctx context.Context, walker func(hash string, size int64) error) error {
+	if err := s.before(ctx, FaultMethodWalkDir); err != nil {
+		return err
+	}
+	if !s.enabled(FaultMethodWalkDir) || s.opt.TruncateRate <= 0 {
+		return s.backend.WalkDir(ctx, walker)
+	}
+	return s.backend.WalkDir(ctx, func(hash string, size int64) error {
+		if s.roll(s.opt.TruncateRate) {
+			return nil
+		}
+		return walker(hash, size)
+	})
+}
+
+func (s *FaultyStorage) ServeDownload(rw http.ResponseWriter, req *http.Request, hash string, size int64) (int64, error) {
+	if err := s.before(req.Context(), FaultMethodServeDownload); err != nil {
+		return 0, err
+	}
+	if f := s.newContentFault(FaultMethodServeDownload, size); f != nil {
+		rw = &faultyResponseWriter{ResponseWriter: rw, ctx: req.Context(), fault: f}
+	}
+	return s.backend.ServeDownload(rw, req, hash, size)
+}
+
+func (s *FaultyStorage) ServeMeasure(rw http.ResponseWriter, req *http.Request, size int) error {
+	if err := s.before(req.Context(), FaultMethodServeMeasure); err != nil {
+		return err
+	}
+	if f := s.newContentFault(FaultMethodServeMeasure, (int64)(size)*MbChunkSize); f != nil {
+		rw = &faultyResponseWriter{ResponseWriter: rw, ctx: req.Context(), fault: f}
+	}
+	return s.backend.ServeMeasure(rw, req, size)
+}
+
+// contentFault breaks a stream of content
+type contentFault struct {
+	stall      time.Duration
+	truncateAt int64 // negative means not truncated
+	corruptAt  int64 // negative means not corrupted
+	offset     int64
+}
+
+// apply is called before buf is sent, and returns the part of buf that should be sent.
+// The bytes in buf may be modified
+func (f *contentFault) apply(ctx context.Context, buf []byte) (_ []byte, truncated bool) {
+	if f.stall > 0 {
+		select {
+		case <-time.After(f.stall):
+		case <-ctx.Done():
+		}
+		f.stall = 0
+	}
+	if f.truncateAt >= 0 && f.offset+(int64)(len(buf)) > f.truncateAt {
+		buf = buf[:max(0, f.truncateAt-f.offset)]
+		truncated = true
+	}
+	if f.corruptAt >= f.offset && f.corruptAt < f.offset+(int64)(len(buf)) {
+		buf[f.corruptAt-f.offset] ^= 0xff
+	}
+	f.offset += (int64)(len(buf))
+	return buf, truncated
+}
+
+type faultyReader struct {
+	io.ReadCloser
+	ctx   context.Context
+	fault *contentFault
+}
+
+func (r *faultyReader) Read(buf []byte) (int, error) {
+	if r.fault.truncateAt >= 0 && r.fault.offset >= r.fault.truncateAt {
+		return 0, io.EOF
+	}
+	n, err := r.ReadCloser.Read(buf)
+	data, truncated := r.fault.apply(r.ctx, buf[:n])
+	if truncated {
+		// a truncated file looks like it ends early
+		return len(data), io.EOF
+	}
+	return len(data), err
+}
+
+type faultyResponseWriter struct {
+	http.ResponseWriter
+	ctx   context.Context
+	fault *contentFault
+}
+
+func (w *faultyResponseWriter) Write(buf []byte) (int, error) {
+	if w.fault.truncateAt >= 0 && w.fault.offset >= w.fault.truncateAt {
+		return 0, io.ErrClosedPipe
+	}
+	// do not modify the caller's buffer
+	data, truncated := w.fault.apply(w.ctx, slices.Clone(buf))
+	n, err := w.ResponseWriter.Write(data)
+	if err == nil && truncated {
+		// the connection will be closed since the Content-Length cannot be satisfied
+		err = io.ErrClosedPipe
+	}
+	return n, err
+}
@@ -0,0 +1,113 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestFaultyStorage(t *testing.T, opt FaultyStorageOption) *FaultyStorage {
+	opt.Seed = 1
+	opt.Backend = StorageOption{
+		BasicStorageOption: BasicStorageOption{Type: StorageLocal},
+		Data:               &LocalStorageOption{CachePath: t.TempDir()},
+	}
+	return initTestStorage(t, new(FaultyStorage), &opt)
+}
+
+func readTestFile(s Storage, hash string) ([]byte, error) {
+	r, err := s.Open(context.Background(), hash)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+func TestFaultyStorageError(t *testing.T) {
+	s := newTestFaultyStorage(t, FaultyStorageOption{
+		Methods:   []string{FaultMethodOpen},
+		ErrorRate: 1,
+	})
+	hash := createTestFile(t, s, 1, 1024)
+	if _, err := s.Open(context.Background(), hash); !errors.Is(err, ErrInjectedFault) {
+		t.Errorf("Expected ErrInjectedFault from Open, got %v", err)
+	}
+	if size, err := s.Size(context.Background(), hash); err != nil || size != 1024 {
+		t.Errorf("Size should not be affected, got %d, %v", size, err)
+	}
+}
+
+func TestFaultyStorageContent(t *testing.T) {
+	const size = 64 * 1024
+	expect := bytes.Repeat([]byte{1}, size)
+
+	s := newTestFaultyStorage(t, FaultyStorageOption{CorruptRate: 1})
+	hash := createTestFile(t, s, 1, size)
+	data, err := readTestFile(s, hash)
+	if err != nil {
+		t.Fatalf("Cannot read file: %v", err)
+	}
+	if len(data) != size {
+		t.Fatalf("Corrupted file should not be truncated, got %d bytes", len(data))
+	}
+	diff := 0
+	for i := range data {
+		if data[i] != expect[i] {
+			diff++
+		}
+	}
+	if diff != 1 {
+		t.Errorf("Expected exactly 1 corrupted byte, got %d", diff)
+	}
+
+	s = newTestFaultyStorage(t, FaultyStorageOption{TruncateRate: 1})
+	hash = createTestFile(t, s, 1, size)
+	if data, err = readTestFile(s, hash); err != nil {
+		t.Fatalf("Truncated read should end without error, got %v", err)
+	}
+	if len(data) >= size || !bytes.Equal(data, expect[:len(data)]) {
+		t.Errorf("Expected a prefix of the file, got %d bytes", len(data))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/download/"+hash, nil)
+	rw := httptest.NewRecorder()
+	n, _ := s.ServeDownload(rw, req, hash, size)
+	if n >= size || rw.Body.Len() >= size {
+		t.Errorf("Expected truncated response, counted %d bytes, sent %d bytes", n, rw.Body.Len())
+	}
+
+	found := 0
+	if err := s.WalkDir(context.Background(), func(string, int64) error {
+		found++
+		return nil
+	}); err != nil {
+		t.Fatalf("WalkDir: %v", err)
+	}
+	if found != 0 {
+		t.Errorf("Expected all files to be missing from the listing, got %d", found)
+	}
+}
@@ -20,7 +20,6 @@
 package storage
 
 import (
-	"compress/gzip"
 	"context"
 	"encoding/hex"
 	"errors"
@@ -29,16 +28,69 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	"gopkg.in/yaml.v3"
+
 	"github.com/LiterMC/go-openbmclapi/log"
 	. "github.com/LiterMC/go-openbmclapi/utils"
 )
 
 type LocalStorageOption struct {
-	CachePath  string     `yaml:"cache-path"`
-	Compressor Compressor `yaml:"compressor"`
+	CachePath string `yaml:"cache-path,omitempty"`
+	// Compressor and Compressors are the precompressed variants that will be looked for when serving,
+	// the other variants will be ignored
+	Compressor  Compressor   `yaml:"compressor"`
+	Compressors []Compressor `yaml:"compressors,omitempty"`
+	// Disks shards the hash prefixes across several folders instead of using the cache path.
+	// Each disk folder must exist, or the disk will be treated as removed
+	Disks []LocalDiskOption `yaml:"disks,omitempty"`
+}
+
+func (o *LocalStorageOption) UnmarshalYAML(n *yaml.Node) (err error) {
+	type T LocalStorageOption
+	if err = n.Decode((*T)(o)); err != nil {
+		return
+	}
+	if o.Compressor, err = ParseCompressor((string)(o.Compressor)); err != nil {
+		return
+	}
+	for i, c := range o.Compressors {
+		if o.Compressors[i], err = ParseCompressor((string)(c)); err != nil {
+			return
+		}
+	}
+	if len(o.Disks) > 0 {
+		if o.CachePath != "" {
+			return errors.New("Cache path and disks cannot be used together")
+		}
+		paths := make(map[string]struct{}, len(o.Disks))
+		for _, d := range o.Disks {
+			if d.Path == "" {
+				return errors.New("Disk path cannot be empty")
+			}
+			p := filepath.Clean(d.Path)
+			if _, ok := paths[p]; ok {
+				return fmt.Errorf("Disk %q is declared more than once", d.Path)
+			}
+			paths[p] = struct{}{}
+		}
+	}
+	return
+}
+
+// variantCompressors returns the configured compressors sorted by the preference
+func (opt *LocalStorageOption) variantCompressors() []Compressor {
+	var variants []Compressor
+	for _, c := range Compressors {
+		if c == opt.Compressor || slices.Contains(opt.Compressors, c) {
+			variants = append(variants, c)
+		}
+	}
+	return variants
 }
 
 func (opt *LocalStorageOption) TmpPath() string {
@@ -46,10 +98,14 @@ func (opt *LocalStorageOption) TmpPath() string {
 }
 
 type LocalStorage struct {
-	opt LocalStorageOption
+	opt      LocalStorageOption
+	variants []Compressor // the precompressed variants to look for
+	disks    []*localDisk
+	ranks    [256][]int
 }
 
 var _ Storage = (*LocalStorage)(nil)
+var _ CapacityReporter = (*LocalStorage)(nil)
 
 func init() {
 	RegisterStorageFactory(StorageLocal, StorageFactory{
@@ -59,6 +115,13 @@ func init() {
 }
 
 func (s *LocalStorage) String() string {
+	if len(s.opt.Disks) > 0 {
+		paths := make([]string, len(s.opt.Disks))
+		for i, d := range s.opt.Disks {
+			paths[i] = d.Path
+		}
+		return fmt.Sprintf("<LocalStorage disks=%q>", paths)
+	}
 	return fmt.Sprintf("<LocalStorage cache=%q>", s.opt.CachePath)
 }
 
@@ -68,19 +131,61 @@ func (s *LocalStorage) Options() any {
 
 func (s *LocalStorage) SetOptions(newOpts any) {
 	s.opt = *(newOpts.(*LocalStorageOption))
+	s.variants = s.opt.variantCompressors()
+	if len(s.opt.Disks) == 0 {
+		s.disks = []*localDisk{{path: s.opt.CachePath, online: true}}
+	} else {
+		s.disks = make([]*localDisk, len(s.opt.Disks))
+		for i, d := range s.opt.Disks {
+			s.disks[i] = &localDisk{path: d.Path, weight: d.Weight, online: true}
+		}
+	}
+	s.layoutDisks()
 }
 
-func (s *LocalStorage) Init(context.Context) (err error) {
-	tmpDir := s.opt.TmpPath()
-	os.RemoveAll(tmpDir)
-	// should be 0755 here because Windows permission issue
-	if err = os.MkdirAll(tmpDir, 0755); err != nil {
-		return
+func (s *LocalStorage) Init(ctx context.Context) (err error) {
+	if len(s.opt.Disks) == 0 {
+		return s.disks[0].init(false)
 	}
-	if err = initCache(s.opt.CachePath); err != nil {
+	online := 0
+	for _, d := range s.disks {
+		if err := d.init(true); err != nil {
+			log.Errorf("Disk %q of %s is unavailable, its files will be reported as missing: %v", d.path, s.String(), err)
+			d.online = false
+			continue
+		}
+		d.online = true
+		online++
+	}
+	if online == 0 {
+		return errors.New("No disk is available")
+	}
+	s.layoutDisks()
+	go s.rebalance(ctx)
+	return nil
+}
+
+// cleanTmpDir reports and removes the partial files which left by interrupted writes
+func cleanTmpDir(tmpDir string) {
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("Cannot read temporary folder %q: %v", tmpDir, err)
+		}
 		return
 	}
-	return
+	for _, e := range entries {
+		var size int64
+		if info, err := e.Info(); err == nil {
+			size = info.Size()
+		}
+		hash, _, _ := strings.Cut(e.Name(), ".")
+		log.Warnf("Found orphaned partial file %q (%d bytes) of %s, which is left by an interrupted write", e.Name(), size, hash)
+	}
+	if len(entries) > 0 {
+		log.Warnf("Removing %d orphaned partial files in %q", len(entries), tmpDir)
+	}
+	os.RemoveAll(tmpDir)
 }
 
 func initCache(base string) (err error) {
@@ -97,95 +202,190 @@ func initCache(base string) (err error) {
 	return nil
 }
 
+// hashToPath returns the path of the file on its owner disk
 func (s *LocalStorage) hashToPath(hash string) string {
-	return filepath.Join(s.opt.CachePath, hash[0:2], hash)
+	return filepath.Join(s.owner(hash).path, hash[0:2], hash)
 }
 
-func (s *LocalStorage) Size(hash string) (int64, error) {
-	stat, err := os.Stat(s.hashToPath(hash))
+func (s *LocalStorage) Size(ctx context.Context, hash string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	_, stat, err := s.statFile(hash)
 	if err != nil {
 		return 0, err
 	}
 	return stat.Size(), nil
 }
 
+// Capacity reports the sum of the online disks, so each disk should be a separate file system
+func (s *LocalStorage) Capacity(context.Context) (total Capacity, err error) {
+	if len(s.disks) == 1 {
+		return diskCapacity(s.disks[0].path)
+	}
+	known := false
+	for _, d := range s.disks {
+		if !d.online {
+			continue
+		}
+		c, e := diskCapacity(d.path)
+		if e != nil {
+			err = e
+			continue
+		}
+		known = true
+		total.Total += c.Total
+		total.Used += c.Used
+		total.Free += c.Free
+	}
+	if known {
+		err = nil
+	}
+	return
+}
+
 func (s *LocalStorage) OpenFd(hash string) (*os.File, error) {
-	return os.Open(s.hashToPath(hash))
+	path, _, err := s.statFile(hash)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
 }
 
-func (s *LocalStorage) Open(hash string) (io.ReadCloser, error) {
+func (s *LocalStorage) Open(ctx context.Context, hash string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return s.OpenFd(hash)
 }
 
-func (s *LocalStorage) Create(hash string, r io.ReadSeeker) error {
-	fd, err := os.Create(s.hashToPath(hash))
+func (s *LocalStorage) Create(ctx context.Context, hash string, r io.ReadSeeker) error {
+	return s.createFrom(ctx, hash, r)
+}
+
+func (s *LocalStorage) createFrom(ctx context.Context, hash string, r io.Reader) error {
+	return writeFileAtomic(ctx, s.owner(hash).tmpPath(), s.hashToPath(hash), hash, r)
+}
+
+// writeFileAtomic writes r into a temporary file under tmpDir,
+// then renames it to target after the content is synced and the hash is verified.
+// So the target will never be a partially written file even if the program crashed or the context is canceled
+func writeFileAtomic(ctx context.Context, tmpDir string, target string, hash string, r io.Reader) (err error) {
+	hashMethod, err := GetHashMethod(len(hash))
 	if err != nil {
-		return err
+		return
+	}
+	fd, err := os.CreateTemp(tmpDir, hash+".*.tmp")
+	if err != nil {
+		return
+	}
+	tmpPath := fd.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpPath)
+		}
+	}()
+
+	hw := hashMethod.New()
+	buf, free := AllocBuf()
+	defer free()
+	_, err = io.CopyBuffer(io.MultiWriter(fd, hw), &contextReader{ctx, r}, buf)
+	if err == nil {
+		err = fd.Sync()
 	}
-	var buf [1024 * 512]byte
-	_, err = io.CopyBuffer(fd, r, buf[:])
 	if e := fd.Close(); e != nil && err == nil {
 		err = e
 	}
-	return err
+	if err != nil {
+		return
+	}
+	if hs := hex.EncodeToString(hw.Sum(buf[:0])); hs != hash {
+		return fmt.Errorf("File hash (%s) mismatch for %s, got %s", hashMethod, hash, hs)
+	}
+	if err = os.Rename(tmpPath, target); err != nil {
+		return
+	}
+	// sync the directory so the rename will be persisted. It is not supported on Windows, so ignore the error
+	if dir, err := os.Open(filepath.Dir(target)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
 }
 
-func (s *LocalStorage) Remove(hash string) error {
-	return os.Remove(s.hashToPath(hash))
+// Remove removes the file from all the disks which hold it
+func (s *LocalStorage) Remove(ctx context.Context, hash string) (err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	rank := s.diskRank(hash)
+	if len(rank) <= 1 {
+		return os.Remove(s.hashToPath(hash))
+	}
+	removed := false
+	for i, di := range rank {
+		e := os.Remove(filepath.Join(s.disks[di].path, hash[0:2], hash))
+		if e == nil {
+			removed = true
+		} else if i == 0 {
+			err = e
+		}
+	}
+	if removed {
+		return nil
+	}
+	return
 }
 
-func (s *LocalStorage) WalkDir(walker func(hash string, size int64) error) error {
-	return WalkCacheDir(s.opt.CachePath, walker)
+func (s *LocalStorage) WalkDir(ctx context.Context, walker func(hash string, size int64) error) error {
+	if len(s.disks) == 1 {
+		return walkCacheDirContext(ctx, s.disks[0].path, walker)
+	}
+	return s.walkDisks(ctx, walker)
 }
 
 func (s *LocalStorage) ServeDownload(rw http.ResponseWriter, req *http.Request, hash string, size int64) (int64, error) {
 	acceptEncoding := SplitCSV(req.Header.Get("Accept-Encoding"))
 	name := req.URL.Query().Get("name")
 
-	hasGzip := false
-	isGzip := false
-	path := s.hashToPath(hash)
-	if s.opt.Compressor == GzipCompressor {
-		if _, err := os.Stat(path + ".gz"); err == nil {
-			hasGzip = true
-		}
-	}
-	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
-		if !hasGzip {
-			return 0, err
-		}
-		if hasGzip {
-			isGzip = true
-			path += ".gz"
-		}
+	path, hasRaw, variants, err := s.locate(hash)
+	if err != nil {
+		return 0, err
 	}
 
-	if !isGzip && rw.Header().Get("Range") != "" {
-		fd, err := os.Open(path)
+	if req.Header.Get("Range") != "" {
+		var rs io.ReadSeekCloser
+		if hasRaw {
+			rs, err = os.Open(path)
+		} else {
+			rs, err = openSeekableVariant(path, variants, size)
+		}
 		if err != nil {
-			return 0, err
+			if !errors.Is(err, errNotSeekable) {
+				log.Errorf("Could not open %q for ranged request: %v", path, err)
+				return 0, err
+			}
+			// cannot seek on the compressed file, fallback to serve the entire file
+			goto SERVE_ENTIRE
 		}
-		defer fd.Close()
+		defer rs.Close()
 
-		counter := &CountReader{
-			ReadSeeker: fd,
-		}
+		// count on the writer side, since the raw file must be passed to http.ServeContent as is to use sendfile(2)
+		counter := &countResponseWriter{ResponseWriter: rw}
 		rw.Header().Set("ETag", `"`+hash+`"`)
 		rw.Header().Set("Cache-Control", "public, max-age=31536000, immutable") // cache for a year
 		rw.Header().Set("Content-Type", "application/octet-stream")
 		if name != "" {
 			rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
 		}
-		http.ServeContent(rw, req, name, time.Time{}, counter)
-		return counter.N, nil
+		http.ServeContent(counter, req, name, time.Time{}, rs)
+		return counter.n, nil
 	}
 
+SERVE_ENTIRE:
 	var r io.Reader
-	if hasGzip && acceptEncoding["gzip"] != 0 {
-		if !isGzip {
-			isGzip = true
-			path += ".gz"
-		}
+	if c, ok := NegotiateCompressor(acceptEncoding, variants); ok {
+		path += c.Ext()
 		fd, err := os.Open(path)
 		if err != nil {
 			return 0, err
@@ -193,23 +393,35 @@ func (s *LocalStorage) ServeDownload(rw http.ResponseWriter, req *http.Request,
 		defer fd.Close()
 		r = fd
 		size, _ = GetFileSize(fd)
-		rw.Header().Set("Content-Encoding", "gzip")
-	} else {
+		rw.Header().Set("Content-Encoding", c.ContentEncoding())
+	} else if hasRaw {
 		fd, err := os.Open(path)
 		if err != nil {
 			return 0, err
 		}
 		defer fd.Close()
 		r = fd
-		if isGzip {
-			size = 0
-			if r, err = gzip.NewReader(r); err != nil {
-				log.Errorf("Could not decompress %q: %v", path, err)
-				return 0, err
-			}
-			isGzip = false
+	} else {
+		// the client does not accept any of the compressions, decompress it on the fly
+		c := variants[0]
+		path += c.Ext()
+		fd, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer fd.Close()
+		size = 0
+		if r, err = c.WrapReader(fd); err != nil {
+			log.Errorf("Could not decompress %q: %v", path, err)
+			return 0, err
+		}
+		if closer, ok := r.(io.Closer); ok {
+			defer closer.Close()
 		}
 	}
+	if len(variants) > 0 {
+		rw.Header().Add("Vary", "Accept-Encoding")
+	}
 	rw.Header().Set("ETag", `"`+hash+`"`)
 	rw.Header().Set("Cache-Control", "public, max-age=31536000, immutable") // cache for a year
 	rw.Header().Set("Content-Type", "application/octet-stream")
@@ -221,14 +433,96 @@ func (s *LocalStorage) ServeDownload(rw http.ResponseWriter, req *http.Request,
 	}
 	rw.WriteHeader(http.StatusOK)
 	if req.Method == http.MethodGet {
-		buf, free := AllocBuf()
-		defer free()
-		n, _ := io.CopyBuffer(rw, r, buf)
+		n, _ := copyToResponse(rw, r)
 		return n, nil
 	}
 	return 0, nil
 }
 
+// copyToResponse copies r to w.
+// If w implements io.ReaderFrom, r will be passed to it directly,
+// so when r is an *os.File, the kernel can send it with sendfile(2) without copying it to the user space
+func copyToResponse(w io.Writer, r io.Reader) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	buf, free := AllocBuf()
+	defer free()
+	return io.CopyBuffer(w, r, buf)
+}
+
+// countResponseWriter counts the bytes written to the response, and keeps the io.ReaderFrom fast path
+type countResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+var _ io.ReaderFrom = (*countResponseWriter)(nil)
+
+func (w *countResponseWriter) Write(buf []byte) (n int, err error) {
+	n, err = w.ResponseWriter.Write(buf)
+	w.n += (int64)(n)
+	return
+}
+
+func (w *countResponseWriter) ReadFrom(r io.Reader) (n int64, err error) {
+	n, err = copyToResponse(w.ResponseWriter, r)
+	w.n += n
+	return
+}
+
+func hasVariant(variants []Compressor, c Compressor) bool {
+	for _, v := range variants {
+		if v == c {
+			return true
+		}
+	}
+	return false
+}
+
+// openSeekableVariant opens a compressed variant with random access on the decompressed data.
+// The seekable zstd variant will be preferred, otherwise the decompressed size must be known
+func openSeekableVariant(path string, variants []Compressor, size int64) (io.ReadSeekCloser, error) {
+	if hasVariant(variants, ZstdCompressor) {
+		fd, err := os.Open(path + ZstdCompressor.Ext())
+		if err != nil {
+			return nil, err
+		}
+		csize, err := GetFileSize(fd)
+		if err != nil {
+			fd.Close()
+			return nil, err
+		}
+		r, err := newSeekableZstdReader(fd, csize)
+		if err == nil {
+			return &fdReadSeekCloser{r, fd}, nil
+		}
+		fd.Close()
+		if !errors.Is(err, errNotSeekable) {
+			return nil, err
+		}
+	}
+	if size <= 0 {
+		return nil, errNotSeekable
+	}
+	c := variants[0]
+	fd, err := os.Open(path + c.Ext())
+	if err != nil {
+		return nil, err
+	}
+	return &fdReadSeekCloser{newDecompressSeeker(fd, c, size), fd}, nil
+}
+
+type fdReadSeekCloser struct {
+	io.ReadSeekCloser
+	fd *os.File
+}
+
+func (r *fdReadSeekCloser) Close() error {
+	r.ReadSeekCloser.Close()
+	return r.fd.Close()
+}
+
 func (s *LocalStorage) ServeMeasure(rw http.ResponseWriter, req *http.Request, size int) error {
 	rw.Header().Set("Content-Length", strconv.Itoa(size*MbChunkSize))
 	rw.WriteHeader(http.StatusOK)
@@ -0,0 +1,244 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestLocalStorageAtomicCreate(t *testing.T) {
+	s := new(LocalStorage)
+	s.SetOptions(&LocalStorageOption{CachePath: t.TempDir()})
+	tmpDir := s.opt.TmpPath()
+
+	// orphaned files should be removed by Init
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		t.Fatalf("Cannot create tmp dir: %v", err)
+	}
+	orphan := filepath.Join(tmpDir, "0123456789abcdef0123456789abcdef01234567.123.tmp")
+	if err := os.WriteFile(orphan, []byte("partial"), 0644); err != nil {
+		t.Fatalf("Cannot create orphaned file: %v", err)
+	}
+	if err := s.Init(context.Background()); err != nil {
+		t.Fatalf("Cannot init local storage: %v", err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Errorf("Orphaned file should be removed, got %v", err)
+	}
+
+	hash := createTestFile(t, s, 'x', 1024)
+	if size, err := s.Size(context.Background(), hash); err != nil || size != 1024 {
+		t.Errorf("Expected size 1024, got %d, %v", size, err)
+	}
+
+	const badHash = "0123456789abcdef0123456789abcdef01234567"
+	if err := s.Create(context.Background(), badHash, bytes.NewReader([]byte("content does not match the hash"))); err == nil {
+		t.Fatalf("Create should fail when the hash mismatch")
+	}
+	if _, err := s.Size(context.Background(), badHash); !os.IsNotExist(err) {
+		t.Errorf("File with mismatched hash should not exist, got %v", err)
+	}
+	if entries, _ := os.ReadDir(tmpDir); len(entries) != 0 {
+		t.Errorf("Temporary files should be removed after failure, found %d", len(entries))
+	}
+}
+
+func newTestDiskStorage(t *testing.T, disks ...string) *LocalStorage {
+	t.Helper()
+	opt := &LocalStorageOption{}
+	for _, d := range disks {
+		opt.Disks = append(opt.Disks, LocalDiskOption{Path: d, Weight: 1})
+	}
+	return initTestStorage(t, new(LocalStorage), opt)
+}
+
+// waitTestRebalanced waits until every file on the online disks is moved to its owner disk
+func waitTestRebalanced(t *testing.T, s *LocalStorage) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		misplaced := 0
+		for _, d := range s.disks {
+			if !d.online {
+				continue
+			}
+			walkCacheDirContext(context.Background(), d.path, func(hash string, _ int64) error {
+				if s.owner(hash) != d {
+					misplaced++
+				}
+				return nil
+			})
+		}
+		if misplaced == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Fatalf("Files of %s were not moved to their owner disks", s.String())
+}
+
+// diskFiles returns the disk that each file is placed on
+func diskFiles(t *testing.T, disks ...string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	for _, d := range disks {
+		if err := walkCacheDirContext(context.Background(), d, func(hash string, _ int64) error {
+			if other, ok := files[hash]; ok {
+				t.Errorf("File %s is placed on both %q and %q", hash, other, d)
+			}
+			files[hash] = d
+			return nil
+		}); err != nil {
+			t.Fatalf("Cannot walk disk %q: %v", d, err)
+		}
+	}
+	return files
+}
+
+func TestLocalStorageDisks(t *testing.T) {
+	root := t.TempDir()
+	a, b, c := filepath.Join(root, "a"), filepath.Join(root, "b"), filepath.Join(root, "c")
+	for _, d := range []string{a, b, c} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatalf("Cannot create disk folder: %v", err)
+		}
+	}
+
+	s := newTestDiskStorage(t, a, b)
+	hashes := make([]string, 64)
+	for i := range hashes {
+		hashes[i] = createTestFile(t, s, (byte)(i), 100)
+	}
+	placed := diskFiles(t, a, b)
+	if len(placed) != len(hashes) {
+		t.Fatalf("Expected %d files on disks, got %d", len(hashes), len(placed))
+	}
+	counts := make(map[string]int)
+	for _, hash := range hashes {
+		counts[placed[hash]]++
+	}
+	if counts[a] == 0 || counts[b] == 0 {
+		t.Errorf("Files should be sharded across disks, got %v", counts)
+	}
+	if found, err := walkTestFiles(s); err != nil || len(found) != len(hashes) {
+		t.Errorf("WalkDir: expected %d files, got %d, %v", len(hashes), len(found), err)
+	}
+	waitTestRebalanced(t, s)
+
+	// adding a disk should only move the files to the new disk
+	s = newTestDiskStorage(t, a, b, c)
+	for _, hash := range hashes {
+		if size, err := s.Size(context.Background(), hash); err != nil || size != 100 {
+			t.Errorf("File %s should be readable while rebalancing, got %d, %v", hash, size, err)
+		}
+	}
+	waitTestRebalanced(t, s)
+	moved := diskFiles(t, a, b, c)
+	counts = make(map[string]int)
+	for _, hash := range hashes {
+		d := moved[hash]
+		counts[d]++
+		if d != s.owner(hash).path {
+			t.Errorf("File %s should be moved to its owner %q, but it is on %q", hash, s.owner(hash).path, d)
+		}
+		if d != c && d != placed[hash] {
+			t.Errorf("File %s should not be moved between the old disks", hash)
+		}
+	}
+	if counts[c] == 0 {
+		t.Errorf("No file is moved to the new disk")
+	}
+	if found, err := walkTestFiles(s); err != nil || len(found) != len(hashes) {
+		t.Errorf("WalkDir: expected %d files, got %d, %v", len(hashes), len(found), err)
+	}
+
+	// a removed disk should only make its files missing
+	if err := os.Rename(b, b+".removed"); err != nil {
+		t.Fatalf("Cannot remove disk: %v", err)
+	}
+	s = newTestDiskStorage(t, a, b, c)
+	found, err := walkTestFiles(s)
+	if err != nil {
+		t.Fatalf("WalkDir should not fail when a disk is removed: %v", err)
+	}
+	for _, hash := range hashes {
+		_, ok := found[hash]
+		_, err := s.Size(context.Background(), hash)
+		if moved[hash] == b {
+			if ok || !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("File %s on the removed disk should be missing, got %v", hash, err)
+			}
+		} else if !ok || err != nil {
+			t.Errorf("File %s should not be affected by the removed disk, got %v", hash, err)
+		}
+	}
+	hash := createTestFile(t, s, 0xff, 100)
+	if d := s.owner(hash).path; d == b {
+		t.Errorf("File %s should not be written to the removed disk", hash)
+	}
+	waitTestRebalanced(t, s)
+
+	s = new(LocalStorage)
+	s.SetOptions(&LocalStorageOption{Disks: []LocalDiskOption{{Path: b}}})
+	if err := s.Init(context.Background()); err == nil {
+		t.Errorf("Init should fail when no disk is available")
+	}
+}
+
+func TestLocalStorageOptionDisks(t *testing.T) {
+	data := []struct {
+		config string
+		valid  bool
+	}{
+		{"cache-path: cache", true},
+		{"disks: [{path: a}, {path: b, weight: 2}]", true},
+		{"cache-path: cache\ndisks: [{path: a}]", false},
+		{"disks: [{path: a}, {path: ./a}]", false},
+		{"disks: [{weight: 1}]", false},
+	}
+	for _, d := range data {
+		var opt LocalStorageOption
+		if err := yaml.Unmarshal(([]byte)(d.config), &opt); (err == nil) != d.valid {
+			t.Errorf("Unmarshal %q: expected valid=%v, got %v", d.config, d.valid, err)
+		}
+	}
+}
+
+func TestLocalStorageOptionCompressors(t *testing.T) {
+	var opt LocalStorageOption
+	if err := yaml.Unmarshal(([]byte)("cache-path: cache\ncompressor: gz\ncompressors: [zstd, brotli]"), &opt); err != nil {
+		t.Fatalf("Cannot parse option: %v", err)
+	}
+	expect := []Compressor{ZstdCompressor, BrotliCompressor, GzipCompressor}
+	if got := opt.variantCompressors(); !slices.Equal(got, expect) {
+		t.Errorf("Expected variants %v, got %v", expect, got)
+	}
+	if err := yaml.Unmarshal(([]byte)("compressor: lzma"), &opt); err == nil {
+		t.Errorf("Unknown compressor should be rejected")
+	}
+}
@@ -0,0 +1,478 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/LiterMC/go-openbmclapi/limited"
+	"github.com/LiterMC/go-openbmclapi/log"
+	. "github.com/LiterMC/go-openbmclapi/utils"
+)
+
+// ErrMemoryFull is returned when a file cannot be stored in a memory storage without a backend
+var ErrMemoryFull = errors.New("Memory storage is full")
+
+// maxTrackedHits is the max number of files whose request count are tracked before they are admitted.
+// All counters will be reset once it is exceeded, so files that are rarely requested will not stay forever
+const maxTrackedHits = 1 << 16
+
+type MemoryStorageOption struct {
+	MaxSize     int64 `yaml:"max-size"`      // in MiB
+	MaxFileSize int64 `yaml:"max-file-size"` // in KiB
+	MinHits     int   `yaml:"min-hits"`
+	// Backend is optional. Without a backend, all files are kept in memory and will never be evicted
+	Backend StorageOption `yaml:"backend,omitempty"`
+}
+
+var (
+	_ yaml.Marshaler   = (*MemoryStorageOption)(nil)
+	_ yaml.Unmarshaler = (*MemoryStorageOption)(nil)
+)
+
+func (o *MemoryStorageOption) MarshalYAML() (any, error) {
+	type T MemoryStorageOption
+	return (*T)(o), nil
+}
+
+func (o *MemoryStorageOption) UnmarshalYAML(n *yaml.Node) (err error) {
+	// set default values
+	o.MaxSize = 256
+	o.MaxFileSize = 1024
+	o.MinHits = 2
+
+	type T MemoryStorageOption
+	if err = n.Decode((*T)(o)); err != nil {
+		return
+	}
+	return
+}
+
+func (o *MemoryStorageOption) MaxSizeBytes() int64 {
+	return o.MaxSize * 1024 * 1024
+}
+
+func (o *MemoryStorageOption) MaxFileSizeBytes() int64 {
+	return o.MaxFileSize * 1024
+}
+
+// MemoryStorage keeps files in memory up to a byte budget.
+//
+// With a backend, it works as a cache in front of the backend:
+// files no larger than max-file-size are loaded into memory after they are requested min-hits times,
+// and the least recently used ones are evicted when the budget is exceeded.
+// Without a backend, every created file is kept in memory until it is removed
+type MemoryStorage struct {
+	opt MemoryStorageOption
+
+	backend Storage
+
+	mux     sync.Mutex
+	files   map[string]*memoryFile
+	policy  *lruPolicy
+	used    int64 // includes the size of the files which are being loaded
+	hits    map[string]int
+	loading map[string]struct{}
+	slots   *limited.Semaphore
+}
+
+type memoryFile struct {
+	entry tierEntry
+	data  []byte
+}
+
+var _ Storage = (*MemoryStorage)(nil)
+var _ HealthChecker = (*MemoryStorage)(nil)
+var _ CapacityReporter = (*MemoryStorage)(nil)
+
+func init() {
+	RegisterStorageFactory(StorageMemory, StorageFactory{
+		New:       func() Storage { return new(MemoryStorage) },
+		NewConfig: func() any { return new(MemoryStorageOption) },
+	})
+}
+
+func (s *MemoryStorage) String() string {
+	if s.backend == nil {
+		return fmt.Sprintf("<MemoryStorage max=%dMiB>", s.opt.MaxSize)
+	}
+	return fmt.Sprintf("<MemoryStorage max=%dMiB backend=%s>", s.opt.MaxSize, s.backend)
+}
+
+func (s *MemoryStorage) Options() any {
+	return &s.opt
+}
+
+func (s *MemoryStorage) SetOptions(newOpts any) {
+	s.opt = *(newOpts.(*MemoryStorageOption))
+	s.backend = nil
+	if _, ok := storageFactories[s.opt.Backend.Type]; ok {
+		s.backend = NewStorage(s.opt.Backend)
+	}
+}
+
+// Backend returns the storage behind the memory, or nil if there is no backend
+func (s *MemoryStorage) Backend() Storage {
+	return s.backend
+}
+
+func (s *MemoryStorage) Init(ctx context.Context) (err error) {
+	if s.opt.Backend.Type != "" && s.backend == nil {
+		return &UnexpectedStorageTypeError{s.opt.Backend.Type}
+	}
+	if s.opt.MaxSize <= 0 {
+		return errors.New("Memory storage max-size must be positive")
+	}
+	s.mux.Lock()
+	s.files = make(map[string]*memoryFile)
+	s.policy = newLruPolicy()
+	s.used = 0
+	s.hits = make(map[string]int)
+	s.loading = make(map[string]struct{})
+	s.slots = limited.NewSemaphore(4)
+	s.mux.Unlock()
+	if s.backend != nil {
+		if err = s.backend.Init(ctx); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) CheckHealth(ctx context.Context) error {
+	if s.backend == nil {
+		return nil
+	}
+	return CheckHealth(ctx, s.backend)
+}
+
+// Capacity reports the capacity of the backend if it exists, or the memory budget otherwise
+func (s *MemoryStorage) Capacity(ctx context.Context) (Capacity, error) {
+	if s.backend != nil {
+		if r, ok := s.backend.(CapacityReporter); ok {
+			return r.Capacity(ctx)
+		}
+		return Capacity{}, ErrCapacityUnknown
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	total := s.opt.MaxSizeBytes()
+	return Capacity{
+		Total: total,
+		Used:  s.used,
+		Free:  max(0, total-s.used),
+	}, nil
+}
+
+// lookup returns the content of the file and marks it as accessed
+func (s *MemoryStorage) lookup(hash string) ([]byte, bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	f, ok := s.files[hash]
+	if !ok {
+		return nil, false
+	}
+	s.policy.Touch(&f.entry)
+	return f.data, true
+}
+
+func (s *MemoryStorage) forget(hash string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.forgetLocked(hash)
+}
+
+func (s *MemoryStorage) forgetLocked(hash string) bool {
+	f, ok := s.files[hash]
+	if !ok {
+		return false
+	}
+	delete(s.files, hash)
+	s.policy.Remove(&f.entry)
+	s.used -= f.entry.size
+	return true
+}
+
+// evictLocked removes the least recently used files until there is enough space for extra bytes.
+// Files are never evicted if there is no backend
+func (s *MemoryStorage) evictLocked(extra int64) bool {
+	quota := s.opt.MaxSizeBytes()
+	if extra > quota {
+		return false
+	}
+	for s.used+extra > quota {
+		if s.backend == nil {
+			return false
+		}
+		e := s.policy.Victim()
+		if e == nil {
+			return false
+		}
+		s.forgetLocked(e.hash)
+	}
+	return true
+}
+
+func (s *MemoryStorage) putLocked(hash string, data []byte) {
+	f := &memoryFile{
+		entry: tierEntry{hash: hash, size: (int64)(len(data))},
+		data:  data,
+	}
+	s.files[hash] = f
+	s.policy.Add(&f.entry)
+}
+
+func (s *MemoryStorage) Size(ctx context.Context, hash string) (int64, error) {
+	if data, ok := s.lookup(hash); ok {
+		return (int64)(len(data)), nil
+	}
+	if s.backend == nil {
+		return 0, os.ErrNotExist
+	}
+	return s.backend.Size(ctx, hash)
+}
+
+func (s *MemoryStorage) Open(ctx context.Context, hash string) (io.ReadCloser, error) {
+	if data, ok := s.lookup(hash); ok {
+		return memoryReader{bytes.NewReader(data)}, nil
+	}
+	if s.backend == nil {
+		return nil, os.ErrNotExist
+	}
+	return s.backend.Open(ctx, hash)
+}
+
+func (s *MemoryStorage) Create(ctx context.Context, hash string, r io.ReadSeeker) error {
+	if s.backend != nil {
+		return s.backend.Create(ctx, hash, r)
+	}
+	data, err := readVerifiedData(hash, &contextReader{ctx, r}, -1)
+	if err != nil {
+		return err
+	}
+	size := (int64)(len(data))
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if _, ok := s.files[hash]; ok {
+		// the content is already verified to be the same
+		return nil
+	}
+	if !s.evictLocked(size) {
+		return ErrMemoryFull
+	}
+	s.used += size
+	s.putLocked(hash, data)
+	return nil
+}
+
+func (s *MemoryStorage) Remove(ctx context.Context, hash string) error {
+	removed := s.forget(hash)
+	if s.backend != nil {
+		return s.backend.Remove(ctx, hash)
+	}
+	if !removed {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (s *MemoryStorage) WalkDir(ctx context.Context, walker func(hash string, size int64) error) error {
+	if s.backend != nil {
+		return s.backend.WalkDir(ctx, walker)
+	}
+	s.mux.Lock()
+	files := make(map[string]int64, len(s.files))
+	for hash, f := range s.files {
+		files[hash] = f.entry.size
+	}
+	s.mux.Unlock()
+	for hash, size := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := walker(hash, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStorage) ServeDownload(rw http.ResponseWriter, req *http.Request, hash string, size int64) (int64, error) {
+	if data, ok := s.lookup(hash); ok {
+		return serveMemoryFile(rw, req, hash, data), nil
+	}
+	if s.backend == nil {
+		return 0, os.ErrNotExist
+	}
+	n, err := s.backend.ServeDownload(rw, req, hash, size)
+	if err == nil {
+		s.recordHit(hash, size)
+	}
+	return n, err
+}
+
+func (s *MemoryStorage) ServeMeasure(rw http.ResponseWriter, req *http.Request, size int) error {
+	if s.backend != nil {
+		return s.backend.ServeMeasure(rw, req, size)
+	}
+	rw.Header().Set("Content-Length", strconv.Itoa(size*MbChunkSize))
+	rw.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		for i := 0; i < size; i++ {
+			rw.Write(MbChunk[:])
+		}
+	}
+	return nil
+}
+
+// serveMemoryFile serves the content with http.ServeContent,
+// so Range, If-Range and If-None-Match are handled with the hash as the ETag
+func serveMemoryFile(rw http.ResponseWriter, req *http.Request, hash string, data []byte) int64 {
+	name := req.URL.Query().Get("name")
+	counter := &countResponseWriter{ResponseWriter: rw}
+	rw.Header().Set("ETag", `"`+hash+`"`)
+	rw.Header().Set("Cache-Control", "public, max-age=31536000, immutable") // cache for a year
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	if name != "" {
+		rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	}
+	http.ServeContent(counter, req, name, time.Time{}, bytes.NewReader(data))
+	return counter.n
+}
+
+// recordHit counts a request which is served by the backend,
+// and loads the file into memory once it is requested enough times
+func (s *MemoryStorage) recordHit(hash string, size int64) {
+	if size <= 0 || size > s.opt.MaxFileSizeBytes() || size > s.opt.MaxSizeBytes() {
+		return
+	}
+	s.mux.Lock()
+	if _, ok := s.loading[hash]; ok {
+		s.mux.Unlock()
+		return
+	}
+	if len(s.hits) >= maxTrackedHits {
+		clear(s.hits)
+	}
+	s.hits[hash]++
+	if s.hits[hash] < s.opt.MinHits {
+		s.mux.Unlock()
+		return
+	}
+	delete(s.hits, hash)
+	s.loading[hash] = struct{}{}
+	s.mux.Unlock()
+
+	go func() {
+		defer func() {
+			s.mux.Lock()
+			delete(s.loading, hash)
+			s.mux.Unlock()
+		}()
+		s.slots.Acquire()
+		defer s.slots.Release()
+		if err := s.load(hash, size); err != nil {
+			log.Errorf("Cannot load %s into %s: %v", hash, s.String(), err)
+		}
+	}()
+}
+
+func (s *MemoryStorage) load(hash string, size int64) (err error) {
+	s.mux.Lock()
+	if _, ok := s.files[hash]; ok {
+		s.mux.Unlock()
+		return nil
+	}
+	if !s.evictLocked(size) {
+		s.mux.Unlock()
+		return nil
+	}
+	s.used += size
+	s.mux.Unlock()
+
+	var data []byte
+	// loadings are not bound to the request which triggered them
+	r, err := s.backend.Open(context.Background(), hash)
+	if err == nil {
+		// the hash is verified, so a broken file will never be served from memory
+		data, err = readVerifiedData(hash, r, size)
+		r.Close()
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.used -= size
+	if err != nil {
+		return
+	}
+	if _, ok := s.files[hash]; ok {
+		return nil
+	}
+	s.used += size
+	s.putLocked(hash, data)
+	log.Debugf("Loaded %s into %s", hash, s.String())
+	return nil
+}
+
+// readVerifiedData reads the content and checks its hash.
+// If size is not negative, the content must be exactly size bytes
+func readVerifiedData(hash string, r io.Reader, size int64) ([]byte, error) {
+	hashMethod, err := GetHashMethod(len(hash))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if size >= 0 {
+		buf.Grow((int)(size))
+		r = io.LimitReader(r, size+1)
+	}
+	hw := hashMethod.New()
+	if _, err := io.Copy(io.MultiWriter(&buf, hw), r); err != nil {
+		return nil, err
+	}
+	if size >= 0 && (int64)(buf.Len()) != size {
+		return nil, fmt.Errorf("File size mismatch for %s, expected %d, got %d", hash, size, buf.Len())
+	}
+	if hs := hex.EncodeToString(hw.Sum(nil)); hs != hash {
+		return nil, fmt.Errorf("File hash (%s) mismatch for %s, got %s", hashMethod, hash, hs)
+	}
+	return buf.Bytes(), nil
+}
+
+type memoryReader struct {
+	*bytes.Reader
+}
+
+func (memoryReader) Close() error {
+	return nil
+}
@@ -0,0 +1,187 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestMemoryStorage(t *testing.T, opt MemoryStorageOption) *MemoryStorage {
+	return initTestStorage(t, new(MemoryStorage), &opt)
+}
+
+func isMemoryCached(s *MemoryStorage) func(hash string) bool {
+	return func(hash string) bool {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		_, ok := s.files[hash]
+		return ok
+	}
+}
+
+func TestMemoryStorageWithoutBackend(t *testing.T) {
+	s := newTestMemoryStorage(t, MemoryStorageOption{MaxSize: 1})
+	const size = 400 * 1024
+	hashes := []string{
+		createTestFile(t, s, 1, size),
+		createTestFile(t, s, 2, size),
+	}
+	if err := s.Create(context.Background(), "0000000000000000000000000000000000000000", bytes.NewReader([]byte("broken"))); err == nil {
+		t.Errorf("File with wrong hash should not be created")
+	}
+	data := bytes.Repeat([]byte{3}, size)
+	if err := s.Create(context.Background(), testFileHash(data), bytes.NewReader(data)); !errors.Is(err, ErrMemoryFull) {
+		t.Errorf("Expected ErrMemoryFull, got %v", err)
+	}
+
+	found, err := walkTestFiles(s)
+	if err != nil {
+		t.Fatalf("WalkDir: %v", err)
+	}
+	if len(found) != 2 || found[hashes[0]] != size || found[hashes[1]] != size {
+		t.Errorf("Unexpected files %v", found)
+	}
+	if c, _ := s.Capacity(context.Background()); c.Used != size*2 || c.Total != 1024*1024 {
+		t.Errorf("Unexpected capacity %#v", c)
+	}
+
+	r, err := s.Open(context.Background(), hashes[0])
+	if err != nil {
+		t.Fatalf("Cannot open file: %v", err)
+	}
+	buf, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(buf, bytes.Repeat([]byte{1}, size)) {
+		t.Errorf("File content mismatch")
+	}
+
+	if err := s.Remove(context.Background(), hashes[1]); err != nil {
+		t.Fatalf("Cannot remove file: %v", err)
+	}
+	if _, err := s.Size(context.Background(), hashes[1]); err == nil {
+		t.Errorf("Removed file %s still exists", hashes[1])
+	}
+	if err := s.Create(context.Background(), testFileHash(data), bytes.NewReader(data)); err != nil {
+		t.Errorf("File should be created after space is freed: %v", err)
+	}
+}
+
+func TestMemoryStorageServe(t *testing.T) {
+	s := newTestMemoryStorage(t, MemoryStorageOption{MaxSize: 1})
+	data := []byte("0123456789abcdef")
+	hash := testFileHash(data)
+	if err := s.Create(context.Background(), hash, bytes.NewReader(data)); err != nil {
+		t.Fatalf("Cannot create file: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/download/"+hash, nil)
+	req.Header.Set("Range", "bytes=4-7")
+	rw := httptest.NewRecorder()
+	n, err := s.ServeDownload(rw, req, hash, (int64)(len(data)))
+	if err != nil {
+		t.Fatalf("Cannot serve file: %v", err)
+	}
+	if rw.Code != http.StatusPartialContent || rw.Body.String() != "4567" || n != 4 {
+		t.Errorf("Unexpected ranged response: %d %q (%d bytes)", rw.Code, rw.Body.String(), n)
+	}
+	if etag := rw.Header().Get("ETag"); etag != `"`+hash+`"` {
+		t.Errorf("Unexpected ETag %q", etag)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/download/"+hash, nil)
+	req.Header.Set("If-None-Match", `"`+hash+`"`)
+	rw = httptest.NewRecorder()
+	if n, err = s.ServeDownload(rw, req, hash, (int64)(len(data))); err != nil {
+		t.Fatalf("Cannot serve file: %v", err)
+	}
+	if rw.Code != http.StatusNotModified || n != 0 {
+		t.Errorf("Expected 304 with empty body, got %d (%d bytes)", rw.Code, n)
+	}
+}
+
+func TestMemoryStorageAdmission(t *testing.T) {
+	s := newTestMemoryStorage(t, MemoryStorageOption{
+		MaxSize:     1,
+		MaxFileSize: 500,
+		MinHits:     2,
+		Backend: StorageOption{
+			BasicStorageOption: BasicStorageOption{Type: StorageLocal},
+			Data:               &LocalStorageOption{CachePath: filepath.Join(t.TempDir(), "backend")},
+		},
+	})
+	const size = 400 * 1024
+	hashes := make([]string, 3)
+	for i := range hashes {
+		hashes[i] = createTestFile(t, s, (byte)(i+1), size)
+	}
+	large := createTestFile(t, s, 9, 600*1024)
+
+	serveTestFile(t, s, hashes[0], size)
+	time.Sleep(time.Millisecond * 50)
+	if isMemoryCached(s)(hashes[0]) {
+		t.Fatalf("File should not be loaded before it is requested %d times", s.opt.MinHits)
+	}
+	serveTestFile(t, s, hashes[0], size)
+	waitTestCached(t, isMemoryCached(s), hashes[0])
+
+	for i := 0; i < 3; i++ {
+		serveTestFile(t, s, large, 600*1024)
+	}
+	time.Sleep(time.Millisecond * 50)
+	if isMemoryCached(s)(large) {
+		t.Errorf("File larger than max-file-size should not be loaded")
+	}
+
+	serveTestFile(t, s, hashes[1], size)
+	serveTestFile(t, s, hashes[1], size)
+	waitTestCached(t, isMemoryCached(s), hashes[1])
+	// touch the first one so the second one becomes the least recently used
+	serveTestFile(t, s, hashes[0], size)
+	serveTestFile(t, s, hashes[2], size)
+	serveTestFile(t, s, hashes[2], size)
+	waitTestCached(t, isMemoryCached(s), hashes[2])
+
+	if !isMemoryCached(s)(hashes[0]) {
+		t.Errorf("Recently used file %s should not be evicted", hashes[0])
+	}
+	if isMemoryCached(s)(hashes[1]) {
+		t.Errorf("Least recently used file %s should be evicted", hashes[1])
+	}
+	if s.used > s.opt.MaxSizeBytes() {
+		t.Errorf("Memory usage %d exceeded the budget %d", s.used, s.opt.MaxSizeBytes())
+	}
+
+	if err := s.Remove(context.Background(), hashes[0]); err != nil {
+		t.Fatalf("Cannot remove file: %v", err)
+	}
+	if isMemoryCached(s)(hashes[0]) {
+		t.Errorf("Removed file %s is still in memory", hashes[0])
+	}
+	if _, err := s.Size(context.Background(), hashes[0]); err == nil {
+		t.Errorf("Removed file %s still exists in the backend", hashes[0])
+	}
+}
@@ -34,6 +34,8 @@ import (
 	"sync/atomic"
 	"time"
 
+	"gopkg.in/yaml.v3"
+
 	"github.com/LiterMC/go-openbmclapi/internal/build"
 	"github.com/LiterMC/go-openbmclapi/internal/gosrc"
 	"github.com/LiterMC/go-openbmclapi/log"
@@ -43,15 +45,42 @@ import (
 var errNotWorking = errors.New("storage is down")
 
 type MountStorageOption struct {
-	Path           string `yaml:"path"`
-	RedirectBase   string `yaml:"redirect-base"`
-	PreGenMeasures bool   `yaml:"pre-gen-measures"`
+	Path           string             `yaml:"path"`
+	RedirectBase   string             `yaml:"redirect-base"`
+	PreGenMeasures bool               `yaml:"pre-gen-measures"`
+	RedirectSign   RedirectSignOption `yaml:"redirect-sign"`
+}
+
+var (
+	_ yaml.Marshaler   = (*MountStorageOption)(nil)
+	_ yaml.Unmarshaler = (*MountStorageOption)(nil)
+)
+
+func (opt *MountStorageOption) MarshalYAML() (any, error) {
+	type T MountStorageOption
+	return (*T)(opt), nil
+}
+
+func (opt *MountStorageOption) UnmarshalYAML(n *yaml.Node) (err error) {
+	// set default values
+	opt.PreGenMeasures = false
+	opt.RedirectSign.setDefaults()
+
+	type T MountStorageOption
+	if err = n.Decode((*T)(opt)); err != nil {
+		return
+	}
+	return
 }
 
 func (opt *MountStorageOption) CachePath() string {
 	return filepath.Join(opt.Path, "download")
 }
 
+func (opt *MountStorageOption) TmpPath() string {
+	return filepath.Join(opt.Path, ".tmp")
+}
+
 type MountStorage struct {
 	opt MountStorageOption
 
@@ -62,6 +91,8 @@ type MountStorage struct {
 }
 
 var _ Storage = (*MountStorage)(nil)
+var _ HealthChecker = (*MountStorage)(nil)
+var _ CapacityReporter = (*MountStorage)(nil)
 
 func init() {
 	RegisterStorageFactory(StorageMount, StorageFactory{
@@ -88,6 +119,9 @@ var checkerClient = &http.Client{
 
 func (s *MountStorage) Init(ctx context.Context) (err error) {
 	log.Infof("Initalizing mounted folder %s", s.opt.Path)
+	if err = s.opt.RedirectSign.validate(); err != nil {
+		return
+	}
 	if err = initCache(s.opt.CachePath()); err != nil {
 		return
 	}
@@ -95,6 +129,12 @@ func (s *MountStorage) Init(ctx context.Context) (err error) {
 		log.Errorf("Cannot create mirror folder %q: %v", s.opt.Path, err)
 		return err
 	}
+	tmpDir := s.opt.TmpPath()
+	cleanTmpDir(tmpDir)
+	if err := os.Mkdir(tmpDir, 0755); err != nil && !errors.Is(err, os.ErrExist) {
+		log.Errorf("Cannot create temporary folder %q: %v", tmpDir, err)
+		return err
+	}
 
 	measureDir := filepath.Join(s.opt.Path, "measure")
 	if err := os.Mkdir(measureDir, 0755); err != nil && !errors.Is(err, os.ErrExist) {
@@ -124,7 +164,10 @@ func (s *MountStorage) hashToPath(hash string) string {
 	return filepath.Join(s.opt.CachePath(), hash[0:2], hash)
 }
 
-func (s *MountStorage) Size(hash string) (int64, error) {
+func (s *MountStorage) Size(ctx context.Context, hash string) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 	stat, err := os.Stat(s.hashToPath(hash))
 	if err != nil {
 		return 0, err
@@ -132,29 +175,26 @@ func (s *MountStorage) Size(hash string) (int64, error) {
 	return stat.Size(), nil
 }
 
-func (s *MountStorage) Open(hash string) (io.ReadCloser, error) {
+func (s *MountStorage) Open(ctx context.Context, hash string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	return os.Open(s.hashToPath(hash))
 }
 
-func (s *MountStorage) Create(hash string, r io.ReadSeeker) error {
-	fd, err := os.Create(s.hashToPath(hash))
-	if err != nil {
-		return err
-	}
-	var buf [1024 * 512]byte
-	_, err = io.CopyBuffer(fd, r, buf[:])
-	if e := fd.Close(); e != nil && err == nil {
-		err = e
-	}
-	return err
+func (s *MountStorage) Create(ctx context.Context, hash string, r io.ReadSeeker) error {
+	return writeFileAtomic(ctx, s.opt.TmpPath(), s.hashToPath(hash), hash, r)
 }
 
-func (s *MountStorage) Remove(hash string) error {
+func (s *MountStorage) Remove(ctx context.Context, hash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return os.Remove(s.hashToPath(hash))
 }
 
-func (s *MountStorage) WalkDir(walker func(hash string, size int64) error) error {
-	return WalkCacheDir(s.opt.CachePath(), walker)
+func (s *MountStorage) WalkDir(ctx context.Context, walker func(hash string, size int64) error) error {
+	return walkCacheDirContext(ctx, s.opt.CachePath(), walker)
 }
 
 func (s *MountStorage) ServeDownload(rw http.ResponseWriter, req *http.Request, hash string, size int64) (int64, error) {
@@ -208,7 +248,7 @@ func (s *MountStorage) ServeDownload(rw http.ResponseWriter, req *http.Request,
 		}
 	}
 
-	target, err := url.JoinPath(s.opt.RedirectBase, "download", hash[:2], hash)
+	target, err := s.redirectURL("download", hash[:2], hash)
 	if err != nil {
 		return 0, err
 	}
@@ -233,7 +273,7 @@ func (s *MountStorage) ServeMeasure(rw http.ResponseWriter, req *http.Request, s
 	if err := s.createMeasureFile(size); err != nil {
 		return err
 	}
-	target, err := url.JoinPath(s.opt.RedirectBase, "measure", strconv.Itoa(size))
+	target, err := s.redirectURL("measure", strconv.Itoa(size))
 	if err != nil {
 		return err
 	}
@@ -241,6 +281,39 @@ func (s *MountStorage) ServeMeasure(rw http.ResponseWriter, req *http.Request, s
 	return nil
 }
 
+// redirectURL returns the public link of the file under RedirectBase, and signs it if it's required
+func (s *MountStorage) redirectURL(elem ...string) (string, error) {
+	target, err := url.JoinPath(s.opt.RedirectBase, elem...)
+	if err != nil {
+		return "", err
+	}
+	switch s.opt.RedirectSign.Type {
+	case "", RedirectSignNone:
+		return target, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	s.opt.RedirectSign.Sign(u, time.Now())
+	return u.String(), nil
+}
+
+func (s *MountStorage) CheckHealth(ctx context.Context) error {
+	supportRange, err := s.checkAlive(ctx, 0)
+	if err != nil {
+		s.working.Store(0)
+		return err
+	}
+	s.supportRange.Store(supportRange)
+	s.working.Store(1)
+	return nil
+}
+
+func (s *MountStorage) Capacity(context.Context) (Capacity, error) {
+	return diskCapacity(s.opt.Path)
+}
+
 func (s *MountStorage) createMeasureFile(size int) (err error) {
 	t := filepath.Join(s.opt.Path, "measure", strconv.Itoa(size))
 	log.Debugf("Checking measure file %q", t)
@@ -293,7 +366,8 @@ func (s *MountStorage) checkAlive(ctx context.Context, size int) (supportRange b
 		return
 	}
 
-	target, err := url.JoinPath(s.opt.RedirectBase, "measure", strconv.Itoa(size))
+	// the measure file must be signed as well, or the server may reject it
+	target, err := s.redirectURL("measure", strconv.Itoa(size))
 	if err != nil {
 		return false, fmt.Errorf("Cannot check webdav server: %w", err)
 	}
@@ -0,0 +1,444 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/LiterMC/go-openbmclapi/internal/build"
+	"github.com/LiterMC/go-openbmclapi/limited"
+	"github.com/LiterMC/go-openbmclapi/log"
+	. "github.com/LiterMC/go-openbmclapi/utils"
+)
+
+// s3MaxPresignExpiry is the max expire time of a SigV4 presigned URL
+const s3MaxPresignExpiry = time.Hour * 24 * 7
+
+type S3StorageOption struct {
+	Endpoint         string       `yaml:"endpoint"`
+	RedirectEndpoint string       `yaml:"redirect-endpoint,omitempty"`
+	Region           string       `yaml:"region"`
+	Bucket           string       `yaml:"bucket"`
+	Prefix           string       `yaml:"prefix,omitempty"`
+	PathStyle        bool         `yaml:"path-style"`
+	AccessKey        string       `yaml:"access-key"`
+	SecretKey        string       `yaml:"secret-key"`
+	MaxConn          int          `yaml:"max-conn"`
+	PresignExpiry    YAMLDuration `yaml:"presign-expiry"`
+	PreGenMeasures   bool         `yaml:"pre-gen-measures"`
+}
+
+var (
+	_ yaml.Marshaler   = (*S3StorageOption)(nil)
+	_ yaml.Unmarshaler = (*S3StorageOption)(nil)
+)
+
+func (o *S3StorageOption) MarshalYAML() (any, error) {
+	type T S3StorageOption
+	return (*T)(o), nil
+}
+
+func (o *S3StorageOption) UnmarshalYAML(n *yaml.Node) (err error) {
+	// set default values
+	o.Region = "us-east-1"
+	o.PathStyle = true
+	o.MaxConn = 64
+	o.PresignExpiry = (YAMLDuration)(time.Hour)
+	o.PreGenMeasures = false
+
+	type T S3StorageOption
+	if err = n.Decode((*T)(o)); err != nil {
+		return
+	}
+	if d := o.PresignExpiry.Dur(); d < time.Second || d > s3MaxPresignExpiry {
+		return fmt.Errorf("Presign expiry must be between 1s and %v, got %v", s3MaxPresignExpiry, d)
+	}
+	return
+}
+
+type S3Storage struct {
+	opt S3StorageOption
+
+	signer        s3Signer
+	endpoint      *url.URL
+	redirectBase  *url.URL
+	limitedDialer *limited.LimitedDialer
+	httpCli       *http.Client
+
+	measureMux sync.Mutex
+	measures   [201]bool                // if the measure file of the size has been checked
+	measuring  map[int]*s3MeasureCreate // the measure files being created
+}
+
+// s3MeasureCreate is a running creation of a measure file, the other requests of the same size will wait for it
+type s3MeasureCreate struct {
+	done chan struct{}
+	err  error
+}
+
+var _ Storage = (*S3Storage)(nil)
+
+func init() {
+	RegisterStorageFactory(StorageS3, StorageFactory{
+		New:       func() Storage { return new(S3Storage) },
+		NewConfig: func() any { return new(S3StorageOption) },
+	})
+}
+
+func (s *S3Storage) String() string {
+	return fmt.Sprintf("<S3Storage endpoint=%q bucket=%q>", s.opt.Endpoint, s.opt.Bucket)
+}
+
+func (s *S3Storage) Options() any {
+	return &s.opt
+}
+
+func (s *S3Storage) SetOptions(newOpts any) {
+	s.opt = *(newOpts.(*S3StorageOption))
+}
+
+func (s *S3Storage) Init(ctx context.Context) (err error) {
+	if s.endpoint, err = url.Parse(s.opt.Endpoint); err != nil {
+		return fmt.Errorf("Cannot parse s3 endpoint: %w", err)
+	}
+	s.redirectBase = s.endpoint
+	if s.opt.RedirectEndpoint != "" {
+		if s.redirectBase, err = url.Parse(s.opt.RedirectEndpoint); err != nil {
+			return fmt.Errorf("Cannot parse s3 redirect endpoint: %w", err)
+		}
+	}
+	s.signer = s3Signer{
+		accessKey: s.opt.AccessKey,
+		secretKey: s.opt.SecretKey,
+		region:    s.opt.Region,
+	}
+
+	s.limitedDialer = limited.NewLimitedDialer(nil, s.opt.MaxConn, 0, 0)
+	s.httpCli = &http.Client{
+		Transport: &http.Transport{
+			DialContext: s.limitedDialer.DialContext,
+		},
+	}
+
+	if s.opt.PreGenMeasures {
+		log.Infof("Creating measure files at %s", s.String())
+		for i := 1; i <= 200; i++ {
+			if err := s.createMeasureFile(ctx, i); err != nil {
+				log.Errorf("Cannot create measure file %d: %v", i, err)
+			}
+		}
+		log.Info("Measure files created")
+	}
+	return
+}
+
+func (s *S3Storage) objectKey(elems ...string) string {
+	return path.Join(s.opt.Prefix, path.Join(elems...))
+}
+
+func (s *S3Storage) hashToKey(hash string) string {
+	return s.objectKey("download", hash[0:2], hash)
+}
+
+// objectURL returns the URL of the object based on the base endpoint
+// if key is empty, the bucket URL will be returned
+func (s *S3Storage) objectURL(base *url.URL, key string) *url.URL {
+	u := *base
+	if s.opt.PathStyle {
+		u.Path = path.Join("/", u.Path, s.opt.Bucket, key)
+	} else {
+		u.Host = s.opt.Bucket + "." + u.Host
+		u.Path = path.Join("/", u.Path, key)
+	}
+	if key == "" && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	u.RawPath = ""
+	return &u
+}
+
+func (s *S3Storage) newRequest(ctx context.Context, method string, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := s.objectURL(s.endpoint, key)
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", build.ClusterUserAgentFull)
+	return req, nil
+}
+
+func (s *S3Storage) do(req *http.Request, payloadHash string) (*http.Response, error) {
+	s.signer.Sign(req, payloadHash, time.Now())
+	return s.httpCli.Do(req)
+}
+
+func s3NotExistError(op string, key string) error {
+	return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+}
+
+func (s *S3Storage) statObject(ctx context.Context, key string) (int64, error) {
+	req, err := s.newRequest(ctx, http.MethodHead, key, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.do(req, s3EmptyPayload)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.ContentLength, nil
+	case http.StatusNotFound:
+		return 0, s3NotExistError("stat", key)
+	default:
+		return 0, &HTTPStatusError{Code: res.StatusCode, URL: req.URL.String()}
+	}
+}
+
+func (s *S3Storage) putObject(ctx context.Context, key string, r io.ReadSeeker) error {
+	size, err := GetFileSize(r)
+	if err != nil {
+		return err
+	}
+	log.Debugf("Putting s3 object %q", key)
+	req, err := s.newRequest(ctx, http.MethodPut, key, nil, io.NopCloser(r))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/octet-stream")
+	res, err := s.do(req, s3UnsignedPayload)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return NewHTTPStatusErrorFromResponse(res)
+	}
+	return nil
+}
+
+func (s *S3Storage) Size(ctx context.Context, hash string) (int64, error) {
+	return s.statObject(ctx, s.hashToKey(hash))
+}
+
+func (s *S3Storage) Open(ctx context.Context, hash string) (io.ReadCloser, error) {
+	key := s.hashToKey(hash)
+	req, err := s.newRequest(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.do(req, s3EmptyPayload)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, s3NotExistError("open", key)
+	default:
+		defer res.Body.Close()
+		return nil, NewHTTPStatusErrorFromResponse(res)
+	}
+}
+
+func (s *S3Storage) Create(ctx context.Context, hash string, r io.ReadSeeker) error {
+	return s.putObject(ctx, s.hashToKey(hash), r)
+}
+
+func (s *S3Storage) Remove(ctx context.Context, hash string) error {
+	key := s.hashToKey(hash)
+	req, err := s.newRequest(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	res, err := s.do(req, s3EmptyPayload)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return s3NotExistError("remove", key)
+	default:
+		return &HTTPStatusError{Code: res.StatusCode, URL: req.URL.String()}
+	}
+}
+
+type s3ListBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key  string `xml:"Key"`
+		Size int64  `xml:"Size"`
+	} `xml:"Contents"`
+}
+
+func (s *S3Storage) WalkDir(ctx context.Context, walker func(hash string, size int64) error) error {
+	prefix := s.objectKey("download") + "/"
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+	}
+	for {
+		req, err := s.newRequest(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+		res, err := s.do(req, s3EmptyPayload)
+		if err != nil {
+			return err
+		}
+		if res.StatusCode != http.StatusOK {
+			err = NewHTTPStatusErrorFromResponse(res)
+			res.Body.Close()
+			return err
+		}
+		var result s3ListBucketResult
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("Cannot decode ListObjectsV2 response: %w", err)
+		}
+		for _, obj := range result.Contents {
+			dir, hash, ok := strings.Cut(strings.TrimPrefix(obj.Key, prefix), "/")
+			if !ok || len(dir) != 2 || len(hash) < 2 || hash[:2] != dir || strings.Contains(hash, "/") {
+				continue
+			}
+			if err := walker(hash, obj.Size); err != nil {
+				return err
+			}
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *S3Storage) presign(key string, query url.Values) string {
+	u := s.objectURL(s.redirectBase, key)
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	return s.signer.Presign(http.MethodGet, u, s.opt.PresignExpiry.Dur(), time.Now())
+}
+
+func (s *S3Storage) ServeDownload(rw http.ResponseWriter, req *http.Request, hash string, size int64) (int64, error) {
+	var query url.Values
+	if name := req.URL.Query().Get("name"); name != "" {
+		query = url.Values{
+			"response-content-disposition": {fmt.Sprintf("attachment; filename=%q", name)},
+		}
+	}
+	target := s.presign(s.hashToKey(hash), query)
+	// fix the size for Ranged request
+	size = rangedSize(req.Header.Get("Range"), size)
+	http.Redirect(rw, req, target, http.StatusFound)
+	return size, nil
+}
+
+func (s *S3Storage) ServeMeasure(rw http.ResponseWriter, req *http.Request, size int) error {
+	if err := s.createMeasureFile(req.Context(), size); err != nil {
+		return err
+	}
+	http.Redirect(rw, req, s.presign(s.objectKey("measure", strconv.Itoa(size)), nil), http.StatusFound)
+	return nil
+}
+
+func (s *S3Storage) createMeasureFile(ctx context.Context, size int) error {
+	s.measureMux.Lock()
+	if s.measures[size] {
+		s.measureMux.Unlock()
+		return nil
+	}
+	if c := s.measuring[size]; c != nil {
+		s.measureMux.Unlock()
+		select {
+		case <-c.done:
+			return c.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	c := &s3MeasureCreate{done: make(chan struct{})}
+	if s.measuring == nil {
+		s.measuring = make(map[int]*s3MeasureCreate)
+	}
+	s.measuring[size] = c
+	s.measureMux.Unlock()
+
+	// upload without the lock, so the other sizes will not wait for it
+	c.err = s.putMeasureFile(ctx, size)
+
+	s.measureMux.Lock()
+	if c.err == nil {
+		s.measures[size] = true
+	}
+	delete(s.measuring, size)
+	s.measureMux.Unlock()
+	close(c.done)
+	return c.err
+}
+
+func (s *S3Storage) putMeasureFile(ctx context.Context, size int) error {
+	key := s.objectKey("measure", strconv.Itoa(size))
+	tsz := (int64)(size) * MbChunkSize
+	if size == 0 {
+		tsz = 2
+	}
+	if sz, err := s.statObject(ctx, key); err == nil {
+		if sz == tsz {
+			return nil
+		}
+		log.Debugf("File [%d] size %d does not match %d", size, sz, tsz)
+	} else if e := ctx.Err(); e != nil {
+		return e
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Errorf("Cannot get stat of %s: %v", key, err)
+	}
+	log.Infof("Creating measure file at %q", key)
+	if err := s.putObject(ctx, key, io.NewSectionReader(EmptyReader, 0, tsz)); err != nil {
+		return fmt.Errorf("Cannot create measure file %q: %w", key, err)
+	}
+	return nil
+}
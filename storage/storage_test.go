@@ -0,0 +1,84 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestStorageOptionMode(t *testing.T) {
+	data := []struct {
+		mode     string
+		expect   string
+		writable bool
+		invalid  bool
+	}{
+		{"", ModeReadWrite, true, false},
+		{"read-write", ModeReadWrite, true, false},
+		{"read-only", ModeReadOnly, false, false},
+		{"drain", ModeDrain, false, false},
+		{"write-only", "", false, true},
+	}
+	for _, d := range data {
+		src := "type: local\nid: test\nweight: 1\n"
+		if d.mode != "" {
+			src += "mode: " + d.mode + "\n"
+		}
+		var opt StorageOption
+		err := yaml.Unmarshal(([]byte)(src), &opt)
+		if d.invalid {
+			if err == nil {
+				t.Errorf("Mode %q should be rejected", d.mode)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Cannot parse mode %q: %v", d.mode, err)
+			continue
+		}
+		if opt.Mode != d.expect {
+			t.Errorf("Mode %q: expected %q, got %q", d.mode, d.expect, opt.Mode)
+		}
+		if opt.Writable() != d.writable {
+			t.Errorf("Mode %q: expected writable=%v", d.mode, d.writable)
+		}
+	}
+}
+
+func TestStorageOptionServeLimit(t *testing.T) {
+	var opt StorageOption
+	if err := yaml.Unmarshal(([]byte)("type: local\nid: test\n"), &opt); err != nil {
+		t.Fatalf("Cannot parse option: %v", err)
+	}
+	if opt.ServeLimit.Enabled() {
+		t.Errorf("Serve limit should be disabled by default")
+	}
+	if err := yaml.Unmarshal(([]byte)("type: local\nid: test\nserve-limit:\n  max-conn: 8\n  upload-rate: 10240\n"), &opt); err != nil {
+		t.Fatalf("Cannot parse option: %v", err)
+	}
+	if !opt.ServeLimit.Enabled() || opt.ServeLimit.MaxConn != 8 || opt.ServeLimit.UploadRate != 10240 {
+		t.Errorf("Unexpected serve limit %+v", opt.ServeLimit)
+	}
+	if err := yaml.Unmarshal(([]byte)("type: local\nid: test\nserve-limit:\n  max-conn: -1\n"), &opt); err == nil {
+		t.Errorf("Negative serve limit should be rejected")
+	}
+}
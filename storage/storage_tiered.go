@@ -0,0 +1,484 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"container/heap"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/LiterMC/go-openbmclapi/limited"
+	"github.com/LiterMC/go-openbmclapi/log"
+	. "github.com/LiterMC/go-openbmclapi/utils"
+)
+
+const (
+	TieredPolicyLRU = "lru"
+	TieredPolicyLFU = "lfu"
+)
+
+type TieredStorageOption struct {
+	CachePath string        `yaml:"cache-path"`
+	Quota     int64         `yaml:"quota"` // in MiB
+	Policy    string        `yaml:"policy"`
+	Backend   StorageOption `yaml:"backend"`
+}
+
+var (
+	_ yaml.Marshaler   = (*TieredStorageOption)(nil)
+	_ yaml.Unmarshaler = (*TieredStorageOption)(nil)
+)
+
+func (o *TieredStorageOption) MarshalYAML() (any, error) {
+	type T TieredStorageOption
+	return (*T)(o), nil
+}
+
+func (o *TieredStorageOption) UnmarshalYAML(n *yaml.Node) (err error) {
+	// set default values
+	o.CachePath = "hot_cache"
+	o.Quota = 1024 * 10
+	o.Policy = TieredPolicyLRU
+
+	type T TieredStorageOption
+	if err = n.Decode((*T)(o)); err != nil {
+		return
+	}
+	switch o.Policy {
+	case TieredPolicyLRU, TieredPolicyLFU:
+	default:
+		return fmt.Errorf("Unexpected tiered cache policy %q, must be one of %s,%s", o.Policy, TieredPolicyLRU, TieredPolicyLFU)
+	}
+	return
+}
+
+func (o *TieredStorageOption) QuotaBytes() int64 {
+	return o.Quota * 1024 * 1024
+}
+
+// TieredStorage serves files from a bounded local cache tier,
+// and promotes files from the backend storage into the cache tier when they are requested
+type TieredStorage struct {
+	opt TieredStorageOption
+
+	cache   *LocalStorage
+	backend Storage
+
+	mux       sync.Mutex
+	entries   map[string]*tierEntry
+	policy    tierPolicy
+	used      int64           // includes the size of the files which are being promoted
+	promoting map[string]bool // the value is set if the file is removed while it is being promoted
+	slots     *limited.Semaphore
+}
+
+var _ Storage = (*TieredStorage)(nil)
+var _ HealthChecker = (*TieredStorage)(nil)
+var _ CapacityReporter = (*TieredStorage)(nil)
+
+func init() {
+	RegisterStorageFactory(StorageTiered, StorageFactory{
+		New:       func() Storage { return new(TieredStorage) },
+		NewConfig: func() any { return new(TieredStorageOption) },
+	})
+}
+
+func (s *TieredStorage) String() string {
+	return fmt.Sprintf("<TieredStorage cache=%q quota=%dMiB policy=%s backend=%s>", s.opt.CachePath, s.opt.Quota, s.opt.Policy, s.backend)
+}
+
+func (s *TieredStorage) Options() any {
+	return &s.opt
+}
+
+func (s *TieredStorage) SetOptions(newOpts any) {
+	s.opt = *(newOpts.(*TieredStorageOption))
+	s.cache = new(LocalStorage)
+	s.cache.SetOptions(&LocalStorageOption{
+		CachePath: s.opt.CachePath,
+	})
+	if _, ok := storageFactories[s.opt.Backend.Type]; ok {
+		s.backend = NewStorage(s.opt.Backend)
+	}
+}
+
+// Backend returns the storage behind the cache tier
+func (s *TieredStorage) Backend() Storage {
+	return s.backend
+}
+
+func (s *TieredStorage) Init(ctx context.Context) (err error) {
+	if s.backend == nil {
+		return errors.New("Tiered storage requires a backend storage")
+	}
+	if s.opt.Policy == TieredPolicyLFU {
+		s.policy = new(lfuPolicy)
+	} else {
+		s.policy = newLruPolicy()
+	}
+	s.entries = make(map[string]*tierEntry)
+	s.promoting = make(map[string]bool)
+	s.slots = limited.NewSemaphore(4)
+
+	if err = s.cache.Init(ctx); err != nil {
+		return
+	}
+	if err = s.backend.Init(ctx); err != nil {
+		return
+	}
+
+	s.mux.Lock()
+	if err = s.cache.WalkDir(ctx, func(hash string, size int64) error {
+		e := &tierEntry{hash: hash, size: size}
+		s.entries[hash] = e
+		s.policy.Add(e)
+		s.used += size
+		return nil
+	}); err != nil {
+		s.mux.Unlock()
+		return
+	}
+	log.Infof("Loaded %d files (%s) from the cache tier of %s", len(s.entries), BytesToUnit((float64)(s.used)), s.String())
+	_, victims := s.evictLocked(0)
+	s.mux.Unlock()
+	s.removeEvicted(victims)
+	return
+}
+
+func (s *TieredStorage) CheckHealth(ctx context.Context) error {
+	return CheckHealth(ctx, s.backend)
+}
+
+// Capacity reports the capacity of the backend, since the cache tier is bounded by its own quota
+func (s *TieredStorage) Capacity(ctx context.Context) (Capacity, error) {
+	if r, ok := s.backend.(CapacityReporter); ok {
+		return r.Capacity(ctx)
+	}
+	return Capacity{}, ErrCapacityUnknown
+}
+
+// lookup returns the size of the cached file and marks it as accessed
+func (s *TieredStorage) lookup(hash string) (size int64, ok bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	e, ok := s.entries[hash]
+	if !ok {
+		return 0, false
+	}
+	s.policy.Touch(e)
+	return e.size, true
+}
+
+func (s *TieredStorage) forget(hash string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	e, ok := s.entries[hash]
+	if !ok {
+		return false
+	}
+	delete(s.entries, hash)
+	s.policy.Remove(e)
+	s.used -= e.size
+	return true
+}
+
+// evictLocked drops files from the cache index until there is enough space for extra bytes.
+// The dropped files should be passed to removeEvicted after the lock is released
+func (s *TieredStorage) evictLocked(extra int64) (ok bool, victims []string) {
+	quota := s.opt.QuotaBytes()
+	if extra > quota {
+		return false, nil
+	}
+	for s.used+extra > quota {
+		e := s.policy.Victim()
+		if e == nil {
+			return false, victims
+		}
+		delete(s.entries, e.hash)
+		s.policy.Remove(e)
+		s.used -= e.size
+		victims = append(victims, e.hash)
+	}
+	return true, victims
+}
+
+// removeEvicted removes the files dropped by evictLocked from the cache tier.
+// The files are no longer indexed, so the lookups will not see them while they are being removed
+func (s *TieredStorage) removeEvicted(victims []string) {
+	for _, hash := range victims {
+		if err := s.cache.Remove(context.Background(), hash); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("Cannot evict %s from the cache tier: %v", hash, err)
+		}
+	}
+}
+
+func (s *TieredStorage) Size(ctx context.Context, hash string) (int64, error) {
+	if size, ok := s.lookup(hash); ok {
+		return size, nil
+	}
+	return s.backend.Size(ctx, hash)
+}
+
+func (s *TieredStorage) Open(ctx context.Context, hash string) (io.ReadCloser, error) {
+	if _, ok := s.lookup(hash); ok {
+		r, err := s.cache.Open(ctx, hash)
+		if err == nil {
+			return r, nil
+		}
+		s.forget(hash)
+	}
+	return s.backend.Open(ctx, hash)
+}
+
+func (s *TieredStorage) Create(ctx context.Context, hash string, r io.ReadSeeker) error {
+	return s.backend.Create(ctx, hash, r)
+}
+
+func (s *TieredStorage) Remove(ctx context.Context, hash string) error {
+	s.mux.Lock()
+	if _, ok := s.promoting[hash]; ok {
+		// the running promotion should not cache the removed file
+		s.promoting[hash] = true
+	}
+	s.mux.Unlock()
+	if s.forget(hash) {
+		if err := s.cache.Remove(ctx, hash); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Errorf("Cannot remove %s from the cache tier: %v", hash, err)
+		}
+	}
+	return s.backend.Remove(ctx, hash)
+}
+
+func (s *TieredStorage) WalkDir(ctx context.Context, walker func(hash string, size int64) error) error {
+	return s.backend.WalkDir(ctx, walker)
+}
+
+func (s *TieredStorage) ServeDownload(rw http.ResponseWriter, req *http.Request, hash string, size int64) (int64, error) {
+	if _, ok := s.lookup(hash); ok {
+		n, err := s.cache.ServeDownload(rw, req, hash, size)
+		if !errors.Is(err, os.ErrNotExist) {
+			return n, err
+		}
+		log.Warnf("File %s disappeared from the cache tier of %s", hash, s.String())
+		s.forget(hash)
+	}
+	n, err := s.backend.ServeDownload(rw, req, hash, size)
+	if err == nil {
+		s.schedulePromote(hash, size)
+	}
+	return n, err
+}
+
+func (s *TieredStorage) ServeMeasure(rw http.ResponseWriter, req *http.Request, size int) error {
+	return s.cache.ServeMeasure(rw, req, size)
+}
+
+func (s *TieredStorage) schedulePromote(hash string, size int64) {
+	if size <= 0 || size > s.opt.QuotaBytes() {
+		return
+	}
+	s.mux.Lock()
+	if _, ok := s.promoting[hash]; ok {
+		s.mux.Unlock()
+		return
+	}
+	s.promoting[hash] = false
+	s.mux.Unlock()
+
+	go func() {
+		defer func() {
+			s.mux.Lock()
+			delete(s.promoting, hash)
+			s.mux.Unlock()
+		}()
+		s.slots.Acquire()
+		defer s.slots.Release()
+		if err := s.promote(hash, size); err != nil {
+			log.Errorf("Cannot promote %s into the cache tier of %s: %v", hash, s.String(), err)
+		}
+	}()
+}
+
+func (s *TieredStorage) promote(hash string, size int64) (err error) {
+	s.mux.Lock()
+	if _, ok := s.entries[hash]; ok {
+		s.mux.Unlock()
+		return nil
+	}
+	ok, victims := s.evictLocked(size)
+	if !ok {
+		s.mux.Unlock()
+		s.removeEvicted(victims)
+		return nil
+	}
+	s.used += size
+	s.mux.Unlock()
+	s.removeEvicted(victims)
+
+	// promotions are not bound to the request which triggered them
+	ctx := context.Background()
+	r, err := s.backend.Open(ctx, hash)
+	if err == nil {
+		// the hash will be verified while writing, so a broken file will never be promoted
+		err = s.cache.createFrom(ctx, hash, r)
+		r.Close()
+	}
+	if err != nil {
+		s.mux.Lock()
+		s.used -= size
+		s.mux.Unlock()
+		return
+	}
+
+	s.mux.Lock()
+	if s.promoting[hash] {
+		s.used -= size
+		s.mux.Unlock()
+		log.Debugf("File %s is removed while being promoted into the cache tier of %s", hash, s.String())
+		s.removeEvicted([]string{hash})
+		return nil
+	}
+	e := &tierEntry{hash: hash, size: size}
+	s.entries[hash] = e
+	s.policy.Add(e)
+	s.mux.Unlock()
+	log.Debugf("Promoted %s into the cache tier of %s", hash, s.String())
+	return nil
+}
+
+type tierEntry struct {
+	hash string
+	size int64
+
+	hits  uint64
+	seq   uint64
+	elem  *list.Element
+	index int
+}
+
+type tierPolicy interface {
+	Add(e *tierEntry)
+	Touch(e *tierEntry)
+	Remove(e *tierEntry)
+	// Victim returns the entry which should be evicted next, or nil if there is no entry
+	Victim() *tierEntry
+}
+
+type lruPolicy struct {
+	l *list.List // front is the most recently used one
+}
+
+func newLruPolicy() *lruPolicy {
+	return &lruPolicy{
+		l: list.New(),
+	}
+}
+
+func (p *lruPolicy) Add(e *tierEntry) {
+	e.elem = p.l.PushFront(e)
+}
+
+func (p *lruPolicy) Touch(e *tierEntry) {
+	p.l.MoveToFront(e.elem)
+}
+
+func (p *lruPolicy) Remove(e *tierEntry) {
+	p.l.Remove(e.elem)
+	e.elem = nil
+}
+
+func (p *lruPolicy) Victim() *tierEntry {
+	if back := p.l.Back(); back != nil {
+		return back.Value.(*tierEntry)
+	}
+	return nil
+}
+
+// lfuPolicy evicts the least frequently used entry,
+// and the least recently used one if there are multiple candidates
+type lfuPolicy struct {
+	h   lfuHeap
+	seq uint64
+}
+
+func (p *lfuPolicy) Add(e *tierEntry) {
+	p.seq++
+	e.seq = p.seq
+	heap.Push(&p.h, e)
+}
+
+func (p *lfuPolicy) Touch(e *tierEntry) {
+	p.seq++
+	e.seq = p.seq
+	e.hits++
+	heap.Fix(&p.h, e.index)
+}
+
+func (p *lfuPolicy) Remove(e *tierEntry) {
+	heap.Remove(&p.h, e.index)
+}
+
+func (p *lfuPolicy) Victim() *tierEntry {
+	if len(p.h) == 0 {
+		return nil
+	}
+	return p.h[0]
+}
+
+type lfuHeap []*tierEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].hits != h[j].hits {
+		return h[i].hits < h[j].hits
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x any) {
+	e := x.(*tierEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*h = old[:n-1]
+	return e
+}
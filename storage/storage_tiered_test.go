@@ -0,0 +1,204 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestTieredStorage(t *testing.T, policy string) *TieredStorage {
+	dir := t.TempDir()
+	return initTestStorage(t, new(TieredStorage), &TieredStorageOption{
+		CachePath: filepath.Join(dir, "hot"),
+		Quota:     1,
+		Policy:    policy,
+		Backend: StorageOption{
+			BasicStorageOption: BasicStorageOption{Type: StorageLocal},
+			Data:               &LocalStorageOption{CachePath: filepath.Join(dir, "backend")},
+		},
+	})
+}
+
+func isTierCached(s *TieredStorage) func(hash string) bool {
+	return func(hash string) bool {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		_, ok := s.entries[hash]
+		return ok
+	}
+}
+
+func TestTieredStorageLRU(t *testing.T) {
+	const size = 400 * 1024
+	s := newTestTieredStorage(t, TieredPolicyLRU)
+	hashes := make([]string, 3)
+	for i := range hashes {
+		hashes[i] = createTestFile(t, s, (byte)(i+1), size)
+	}
+	if isTierCached(s)(hashes[0]) {
+		t.Fatalf("File should not be cached before served")
+	}
+
+	serveTestFile(t, s, hashes[0], size)
+	waitTestCached(t, isTierCached(s), hashes[0])
+	serveTestFile(t, s, hashes[1], size)
+	waitTestCached(t, isTierCached(s), hashes[1])
+	// touch the first one so the second one becomes the least recently used
+	serveTestFile(t, s, hashes[0], size)
+	serveTestFile(t, s, hashes[2], size)
+	waitTestCached(t, isTierCached(s), hashes[2])
+
+	if !isTierCached(s)(hashes[0]) {
+		t.Errorf("Recently used file %s should not be evicted", hashes[0])
+	}
+	if isTierCached(s)(hashes[1]) {
+		t.Errorf("Least recently used file %s should be evicted", hashes[1])
+	}
+	if _, err := s.cache.Size(context.Background(), hashes[1]); err == nil {
+		t.Errorf("Evicted file %s still exists in the cache tier", hashes[1])
+	}
+	if s.used > s.opt.QuotaBytes() {
+		t.Errorf("Cache tier usage %d exceeded the quota %d", s.used, s.opt.QuotaBytes())
+	}
+
+	// evicted files should still be readable from the backend
+	r, err := s.Open(context.Background(), hashes[1])
+	if err != nil {
+		t.Fatalf("Cannot open evicted file: %v", err)
+	}
+	n, _ := io.Copy(io.Discard, r)
+	r.Close()
+	if n != size {
+		t.Errorf("Evicted file size mismatch, expected %d, got %d", size, n)
+	}
+
+	if err := s.Remove(context.Background(), hashes[0]); err != nil {
+		t.Fatalf("Cannot remove file: %v", err)
+	}
+	if isTierCached(s)(hashes[0]) {
+		t.Errorf("Removed file %s is still in the cache tier", hashes[0])
+	}
+	if _, err := s.Size(context.Background(), hashes[0]); err == nil {
+		t.Errorf("Removed file %s still exists in the backend", hashes[0])
+	}
+}
+
+func TestTieredStorageLFU(t *testing.T) {
+	const size = 400 * 1024
+	s := newTestTieredStorage(t, TieredPolicyLFU)
+	hashes := make([]string, 3)
+	for i := range hashes {
+		hashes[i] = createTestFile(t, s, (byte)(i+1), size)
+	}
+
+	serveTestFile(t, s, hashes[0], size)
+	waitTestCached(t, isTierCached(s), hashes[0])
+	for i := 0; i < 3; i++ {
+		serveTestFile(t, s, hashes[0], size)
+	}
+	serveTestFile(t, s, hashes[1], size)
+	waitTestCached(t, isTierCached(s), hashes[1])
+	serveTestFile(t, s, hashes[1], size)
+	serveTestFile(t, s, hashes[2], size)
+	waitTestCached(t, isTierCached(s), hashes[2])
+
+	if !isTierCached(s)(hashes[0]) {
+		t.Errorf("Frequently used file %s should not be evicted", hashes[0])
+	}
+	if isTierCached(s)(hashes[1]) {
+		t.Errorf("Less frequently used file %s should be evicted", hashes[1])
+	}
+}
+
+// blockingReadStorage blocks the reads of the opened files until release is closed
+type blockingReadStorage struct {
+	Storage
+	opened  chan struct{}
+	release chan struct{}
+}
+
+type blockingReader struct {
+	io.ReadCloser
+	release <-chan struct{}
+}
+
+func (r *blockingReader) Read(buf []byte) (int, error) {
+	<-r.release
+	return r.ReadCloser.Read(buf)
+}
+
+func (s *blockingReadStorage) Open(ctx context.Context, hash string) (io.ReadCloser, error) {
+	r, err := s.Storage.Open(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+	close(s.opened)
+	return &blockingReader{r, s.release}, nil
+}
+
+func TestTieredStorageRemoveWhilePromoting(t *testing.T) {
+	const size = 400 * 1024
+	s := newTestTieredStorage(t, TieredPolicyLRU)
+	hash := createTestFile(t, s, 1, size)
+	backend := &blockingReadStorage{
+		Storage: s.backend,
+		opened:  make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	s.backend = backend
+
+	serveTestFile(t, s, hash, size)
+	<-backend.opened
+	if err := s.Remove(context.Background(), hash); err != nil {
+		t.Fatalf("Cannot remove %s: %v", hash, err)
+	}
+	close(backend.release)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		s.mux.Lock()
+		_, promoting := s.promoting[hash]
+		s.mux.Unlock()
+		if !promoting {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("File %s is still being promoted", hash)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if isTierCached(s)(hash) {
+		t.Errorf("Removed file %s should not be cached", hash)
+	}
+	if _, err := s.cache.Size(context.Background(), hash); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Removed file %s should not be left in the cache tier, got %v", hash, err)
+	}
+	s.mux.Lock()
+	used := s.used
+	s.mux.Unlock()
+	if used != 0 {
+		t.Errorf("Cache tier should be empty, got %d bytes used", used)
+	}
+}
@@ -21,6 +21,7 @@ package storage
 
 import (
 	"context"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
@@ -30,6 +31,7 @@ import (
 	"path"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/studio-b12/gowebdav"
@@ -125,9 +127,13 @@ type WebDavStorage struct {
 	limitedDialer *limited.LimitedDialer
 	httpCli       *http.Client
 	noRedCli      *http.Client // no redirect client
+
+	noInfinityDepth atomic.Bool // whether the server refused PROPFIND with infinity depth
 }
 
 var _ Storage = (*WebDavStorage)(nil)
+var _ HealthChecker = (*WebDavStorage)(nil)
+var _ CapacityReporter = (*WebDavStorage)(nil)
 
 func init() {
 	RegisterStorageFactory(StorageWebdav, StorageFactory{
@@ -197,85 +203,152 @@ func (s *WebDavStorage) Init(ctx context.Context) (err error) {
 	return
 }
 
-func (s *WebDavStorage) putFile(path string, r io.ReadSeeker) error {
+func (s *WebDavStorage) putFile(ctx context.Context, name string, r io.ReadSeeker) error {
 	size, err := GetFileSize(r)
 	if err != nil {
 		return err
 	}
-	target, err := url.JoinPath(s.opt.GetEndPoint(), path)
+	target, err := url.JoinPath(s.opt.GetEndPoint(), name)
 	if err != nil {
 		return err
 	}
 	log.Debugf("Putting %q", target)
 
-	req, err := http.NewRequestWithContext(context.TODO(), http.MethodPut, target, io.NopCloser(r))
+	code, err := s.doPut(ctx, target, r, size)
 	if err != nil {
 		return err
 	}
+	if code == http.StatusNotFound || code == http.StatusConflict {
+		// RFC 4918 9.7.1: the parent collection must exist, so create it and try again
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.limitedDialer.Acquire()
+		err = s.cli.MkdirAll(path.Dir(name), 0755)
+		s.limitedDialer.Release()
+		if err != nil {
+			return err
+		}
+		if _, err = r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if code, err = s.doPut(ctx, target, r, size); err != nil {
+			return err
+		}
+	}
+	switch code {
+	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+		return nil
+	default:
+		return &HTTPStatusError{Code: code}
+	}
+}
+
+func (s *WebDavStorage) doPut(ctx context.Context, target string, r io.Reader, size int64) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, target, io.NopCloser(r))
+	if err != nil {
+		return 0, err
+	}
 	req.SetBasicAuth(s.opt.GetUsername(), s.opt.GetPassword())
 	req.ContentLength = size
 
 	res, err := s.httpCli.Do(req)
 	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
-	switch res.StatusCode {
-	case http.StatusOK, http.StatusCreated, http.StatusNoContent:
-		return nil
-	default:
-		return &HTTPStatusError{Code: res.StatusCode}
+		return 0, err
 	}
+	res.Body.Close()
+	return res.StatusCode, nil
 }
 
 func (s *WebDavStorage) hashToPath(hash string) string {
 	return path.Join("download", hash[0:2], hash)
 }
 
-func (s *WebDavStorage) Size(hash string) (int64, error) {
-	s.limitedDialer.Acquire()
-	stat, err := s.cli.Stat(s.hashToPath(hash))
-	s.limitedDialer.Release()
+func (s *WebDavStorage) Size(ctx context.Context, hash string) (int64, error) {
+	return s.stat(ctx, s.hashToPath(hash))
+}
+
+// stat returns the size of the file by PROPFIND with depth 0
+func (s *WebDavStorage) stat(ctx context.Context, name string) (int64, error) {
+	res, err := s.propfind(ctx, name, "0")
 	if err != nil {
 		return 0, err
 	}
-	return stat.Size(), nil
-}
-
-func (s *WebDavStorage) Open(hash string) (r io.ReadCloser, err error) {
-	return s.limitedDialer.DoReader(func() (io.Reader, error) {
-		return s.cli.ReadStream(s.hashToPath(hash))
-	})
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusMultiStatus:
+	case http.StatusNotFound:
+		return 0, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	default:
+		return 0, &HTTPStatusError{Code: res.StatusCode, URL: res.Request.URL.String()}
+	}
+	var ms struct {
+		Responses []webdavListResponse `xml:"DAV: response"`
+	}
+	if err := xml.NewDecoder(res.Body).Decode(&ms); err != nil {
+		return 0, err
+	}
+	if len(ms.Responses) == 0 {
+		return 0, fmt.Errorf("Empty PROPFIND response for %q", name)
+	}
+	_, size, _, err := ms.Responses[0].parse()
+	return size, err
 }
 
-func (s *WebDavStorage) Create(hash string, r io.ReadSeeker) error {
-	return s.putFile(s.hashToPath(hash), r)
+func (s *WebDavStorage) Open(ctx context.Context, hash string) (io.ReadCloser, error) {
+	name := s.hashToPath(hash)
+	target, err := url.JoinPath(s.opt.GetEndPoint(), name)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(s.opt.GetUsername(), s.opt.GetPassword())
+	res, err := s.httpCli.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch res.StatusCode {
+	case http.StatusOK:
+		return res.Body, nil
+	case http.StatusNotFound:
+		res.Body.Close()
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	default:
+		res.Body.Close()
+		return nil, &HTTPStatusError{Code: res.StatusCode, URL: target}
+	}
 }
 
-func (s *WebDavStorage) Remove(hash string) error {
-	return s.cli.Remove(s.hashToPath(hash))
+func (s *WebDavStorage) Create(ctx context.Context, hash string, r io.ReadSeeker) error {
+	return s.putFile(ctx, s.hashToPath(hash), r)
 }
 
-func (s *WebDavStorage) WalkDir(walker func(hash string, size int64) error) error {
-	s.limitedDialer.Acquire()
-	defer s.limitedDialer.Release()
-
-	for _, dir := range Hex256 {
-		files, err := s.cli.ReadDir(path.Join("download", dir))
-		if err != nil {
-			continue
-		}
-		for _, f := range files {
-			if !f.IsDir() {
-				if hash := f.Name(); len(hash) >= 2 && hash[:2] == dir {
-					if err := walker(hash, f.Size()); err != nil {
-						return err
-					}
-				}
-			}
-		}
+func (s *WebDavStorage) Remove(ctx context.Context, hash string) error {
+	target, err := url.JoinPath(s.opt.GetEndPoint(), s.hashToPath(hash))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, target, nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(s.opt.GetUsername(), s.opt.GetPassword())
+	res, err := s.httpCli.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return &os.PathError{Op: "remove", Path: s.hashToPath(hash), Err: os.ErrNotExist}
+	default:
+		return &HTTPStatusError{Code: res.StatusCode, URL: target}
 	}
-	return nil
 }
 
 func copyHeader(key string, dst, src http.Header) {
@@ -310,7 +383,12 @@ func (s *WebDavStorage) ServeDownload(rw http.ResponseWriter, req *http.Request,
 	if err != nil {
 		return 0, err
 	}
-	tgReq, err := http.NewRequestWithContext(req.Context(), http.MethodGet, target, nil)
+	method := http.MethodGet
+	if req.Method == http.MethodHead {
+		// do not download the content for HEAD requests, so they will not be counted as hits
+		method = http.MethodHead
+	}
+	tgReq, err := http.NewRequestWithContext(req.Context(), method, target, nil)
 	if err != nil {
 		return 0, err
 	}
@@ -438,14 +516,82 @@ func (s *WebDavStorage) ServeMeasure(rw http.ResponseWriter, req *http.Request,
 	}
 }
 
+func (s *WebDavStorage) CheckHealth(ctx context.Context) error {
+	if _, err := s.stat(ctx, "measure"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+const webdavQuotaPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:quota-available-bytes/><D:quota-used-bytes/></D:prop></D:propfind>`
+
+type webdavQuotaMultistatus struct {
+	Responses []struct {
+		Propstats []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				Available string `xml:"DAV: quota-available-bytes"`
+				Used      string `xml:"DAV: quota-used-bytes"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// Capacity queries the quota properties defined in RFC 4331 on the endpoint.
+// ErrCapacityUnknown will be returned if the server does not support them
+func (s *WebDavStorage) Capacity(ctx context.Context) (c Capacity, err error) {
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", s.opt.GetEndPoint(), strings.NewReader(webdavQuotaPropfind))
+	if err != nil {
+		return
+	}
+	req.SetBasicAuth(s.opt.GetUsername(), s.opt.GetPassword())
+	req.Header.Set("Depth", "0")
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	if !s.limitedDialer.AcquireWithContext(ctx) {
+		return c, ctx.Err()
+	}
+	defer s.limitedDialer.Release()
+	res, err := s.httpCli.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusMultiStatus {
+		return c, &HTTPStatusError{Code: res.StatusCode}
+	}
+	var ms webdavQuotaMultistatus
+	if err = xml.NewDecoder(res.Body).Decode(&ms); err != nil {
+		return
+	}
+	for _, r := range ms.Responses {
+		for _, ps := range r.Propstats {
+			if !strings.Contains(ps.Status, " 200 ") || ps.Prop.Available == "" {
+				continue
+			}
+			if c.Free, err = strconv.ParseInt(strings.TrimSpace(ps.Prop.Available), 10, 64); err != nil {
+				return
+			}
+			if ps.Prop.Used != "" {
+				if c.Used, err = strconv.ParseInt(strings.TrimSpace(ps.Prop.Used), 10, 64); err != nil {
+					return
+				}
+				c.Total = c.Used + c.Free
+			}
+			return c, nil
+		}
+	}
+	return c, ErrCapacityUnknown
+}
+
 func (s *WebDavStorage) createMeasureFile(ctx context.Context, size int) (err error) {
 	t := path.Join("measure", strconv.Itoa(size))
 	tsz := (int64)(size) * MbChunkSize
 	if size == 0 {
 		tsz = 2
 	}
-	if stat, err := s.cli.Stat(t); err == nil {
-		sz := stat.Size()
+	if sz, err := s.stat(ctx, t); err == nil {
 		if sz == tsz {
 			return nil
 		}
@@ -456,7 +602,7 @@ func (s *WebDavStorage) createMeasureFile(ctx context.Context, size int) (err er
 		log.Errorf("Cannot get stat of %s: %v", t, err)
 	}
 	log.Infof("Creating measure file at %q", t)
-	if err = s.putFile(t, io.NewSectionReader(EmptyReader, 0, tsz)); err != nil {
+	if err = s.putFile(ctx, t, io.NewSectionReader(EmptyReader, 0, tsz)); err != nil {
 		log.Errorf("Cannot create measure file %q: %v", t, err)
 		return
 	}
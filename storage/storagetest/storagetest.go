@@ -0,0 +1,415 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+// Package storagetest provides a conformance test suite for storage.Storage implementations
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/LiterMC/go-openbmclapi/storage"
+	"github.com/LiterMC/go-openbmclapi/utils"
+)
+
+// Options adjusts the conformance tests for a storage
+type Options struct {
+	// Client is used to follow the redirects responded by ServeDownload and ServeMeasure.
+	// http.DefaultClient will be used if it's nil
+	Client *http.Client
+	// NoMeasure skips the ServeMeasure test
+	NoMeasure bool
+}
+
+func (o Options) client() *http.Client {
+	if o.Client != nil {
+		return o.Client
+	}
+	return http.DefaultClient
+}
+
+// Run runs the conformance tests as sub tests of t.
+// newStorage is called once for each sub test, it must return an initialized storage without any file
+func Run(t *testing.T, newStorage func(t *testing.T) storage.Storage, opts Options) {
+	t.Run("RoundTrip", func(t *testing.T) {
+		testRoundTrip(t, newStorage(t))
+	})
+	t.Run("WalkDir", func(t *testing.T) {
+		testWalkDir(t, newStorage(t))
+	})
+	t.Run("ServeDownload", func(t *testing.T) {
+		testServeDownload(t, newStorage(t), opts)
+	})
+	if !opts.NoMeasure {
+		t.Run("ServeMeasure", func(t *testing.T) {
+			testServeMeasure(t, newStorage(t), opts)
+		})
+	}
+	t.Run("Concurrent", func(t *testing.T) {
+		testConcurrent(t, newStorage(t), opts)
+	})
+}
+
+// File is a test file with its content and hash
+type File struct {
+	Hash string
+	Data []byte
+}
+
+// NewFile generates a file with pseudo-random content, the same seed always generates the same file
+func NewFile(seed int64, size int) File {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	sum := sha1.Sum(data)
+	return File{
+		Hash: hex.EncodeToString(sum[:]),
+		Data: data,
+	}
+}
+
+// Create creates the file on the storage, and fails the test if there is an error
+func (f File) Create(t testing.TB, s storage.Storage) {
+	t.Helper()
+	if err := s.Create(context.Background(), f.Hash, bytes.NewReader(f.Data)); err != nil {
+		t.Fatalf("Cannot create %s: %v", f.Hash, err)
+	}
+}
+
+var testSizes = []int{1, 17, 4096 + 3, 300 * 1024}
+
+func checkContent(s storage.Storage, f File) error {
+	size, err := s.Size(context.Background(), f.Hash)
+	if err != nil {
+		return fmt.Errorf("Size(%s): %w", f.Hash, err)
+	}
+	if size != (int64)(len(f.Data)) {
+		return fmt.Errorf("Size(%s): expected %d, got %d", f.Hash, len(f.Data), size)
+	}
+	r, err := s.Open(context.Background(), f.Hash)
+	if err != nil {
+		return fmt.Errorf("Open(%s): %w", f.Hash, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("Read(%s): %w", f.Hash, err)
+	}
+	if !bytes.Equal(data, f.Data) {
+		return fmt.Errorf("Open(%s): content mismatch, got %d bytes", f.Hash, len(data))
+	}
+	return nil
+}
+
+func testRoundTrip(t *testing.T, s storage.Storage) {
+	files := make([]File, len(testSizes))
+	for i, size := range testSizes {
+		files[i] = NewFile((int64)(i), size)
+		files[i].Create(t, s)
+	}
+	for _, f := range files {
+		if err := checkContent(s, f); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// create an existing file again should not break it
+	files[0].Create(t, s)
+	if err := checkContent(s, files[0]); err != nil {
+		t.Errorf("After created again: %v", err)
+	}
+
+	for _, f := range files {
+		if err := s.Remove(context.Background(), f.Hash); err != nil {
+			t.Errorf("Remove(%s): %v", f.Hash, err)
+		}
+		if _, err := s.Size(context.Background(), f.Hash); err == nil {
+			t.Errorf("Size(%s) should fail after removed", f.Hash)
+		}
+		if r, err := s.Open(context.Background(), f.Hash); err == nil {
+			r.Close()
+			t.Errorf("Open(%s) should fail after removed", f.Hash)
+		}
+	}
+	if _, err := s.Size(context.Background(), NewFile(-1, 8).Hash); err == nil {
+		t.Errorf("Size should fail for a file that never exists")
+	}
+	if err := s.Remove(context.Background(), files[0].Hash); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Remove(%s) of a removed file should return os.ErrNotExist, got %v", files[0].Hash, err)
+	}
+}
+
+func walkAll(s storage.Storage) (map[string]int64, error) {
+	found := make(map[string]int64)
+	err := s.WalkDir(context.Background(), func(hash string, size int64) error {
+		if _, ok := found[hash]; ok {
+			return fmt.Errorf("WalkDir: %s is reported twice", hash)
+		}
+		found[hash] = size
+		return nil
+	})
+	return found, err
+}
+
+func testWalkDir(t *testing.T, s storage.Storage) {
+	found, err := walkAll(s)
+	if err != nil {
+		t.Fatalf("WalkDir on empty storage: %v", err)
+	}
+	if len(found) != 0 {
+		t.Fatalf("WalkDir on empty storage reported %v", found)
+	}
+
+	expect := make(map[string]int64)
+	for i := 0; i < 40; i++ {
+		f := NewFile((int64)(i), 1+i*37)
+		f.Create(t, s)
+		expect[f.Hash] = (int64)(len(f.Data))
+	}
+	if found, err = walkAll(s); err != nil {
+		t.Fatalf("WalkDir: %v", err)
+	}
+	if !maps.Equal(found, expect) {
+		t.Errorf("WalkDir: expected %d files, got %d files\nexpected: %v\ngot: %v", len(expect), len(found), expect, found)
+	}
+
+	errStop := errors.New("stop")
+	calls := 0
+	if err = s.WalkDir(context.Background(), func(string, int64) error {
+		calls++
+		return errStop
+	}); !errors.Is(err, errStop) {
+		t.Errorf("WalkDir should return the walker's error, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Walker should not be called after it returned an error, called %d times", calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls = 0
+	if err = s.WalkDir(ctx, func(string, int64) error {
+		calls++
+		return nil
+	}); !errors.Is(err, context.Canceled) {
+		t.Errorf("WalkDir with a canceled context should return context.Canceled, got %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("Walker should not be called with a canceled context, called %d times", calls)
+	}
+}
+
+// response is the result of a ServeDownload or ServeMeasure call, with the redirect followed
+type response struct {
+	Status   int
+	Body     []byte
+	Redirect bool
+}
+
+func doServe(opts Options, req *http.Request, serve func(rw http.ResponseWriter, req *http.Request) error) (res response, err error) {
+	rw := httptest.NewRecorder()
+	if err = serve(rw, req); err != nil {
+		return
+	}
+	res.Status = rw.Code
+	res.Body = rw.Body.Bytes()
+	if req.Method == http.MethodHead && len(res.Body) != 0 {
+		return res, fmt.Errorf("HEAD response should not have a body, got %d bytes", len(res.Body))
+	}
+	if rw.Code/100 != 3 {
+		return
+	}
+	res.Redirect = true
+	location := rw.Header().Get("Location")
+	if location == "" {
+		return res, fmt.Errorf("Redirect response %d without Location", rw.Code)
+	}
+	tgReq, err := http.NewRequestWithContext(req.Context(), req.Method, location, nil)
+	if err != nil {
+		return
+	}
+	if rg := req.Header.Get("Range"); rg != "" {
+		tgReq.Header.Set("Range", rg)
+	}
+	resp, err := opts.client().Do(tgReq)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	res.Status = resp.StatusCode
+	res.Body, err = io.ReadAll(resp.Body)
+	return
+}
+
+func serveDownload(s storage.Storage, opts Options, method string, rangeH string, f File) (res response, n int64, err error) {
+	req := httptest.NewRequest(method, "/download/"+f.Hash, nil)
+	if rangeH != "" {
+		req.Header.Set("Range", rangeH)
+	}
+	res, err = doServe(opts, req, func(rw http.ResponseWriter, req *http.Request) (err error) {
+		n, err = s.ServeDownload(rw, req, f.Hash, (int64)(len(f.Data)))
+		return
+	})
+	return
+}
+
+// checkDownload checks the response and the returned byte count of a ServeDownload call.
+// The byte count must equal the size of the content that is sent, or will be sent after redirected.
+// It is not checked for HEAD requests which are redirected
+func checkDownload(s storage.Storage, opts Options, method string, rangeH string, f File, expect []byte) error {
+	res, n, err := serveDownload(s, opts, method, rangeH, f)
+	if err != nil {
+		return fmt.Errorf("%s %s (Range=%q): %w", method, f.Hash, rangeH, err)
+	}
+	expectStatus := http.StatusOK
+	if rangeH != "" {
+		expectStatus = http.StatusPartialContent
+	}
+	if res.Status != expectStatus {
+		return fmt.Errorf("%s %s (Range=%q): expected status %d, got %d", method, f.Hash, rangeH, expectStatus, res.Status)
+	}
+	if method == http.MethodHead {
+		if !res.Redirect && n != 0 {
+			return fmt.Errorf("HEAD %s (Range=%q): expected 0 bytes are counted, got %d", f.Hash, rangeH, n)
+		}
+		return nil
+	}
+	if !bytes.Equal(res.Body, expect) {
+		return fmt.Errorf("GET %s (Range=%q): content mismatch, expected %d bytes, got %d bytes", f.Hash, rangeH, len(expect), len(res.Body))
+	}
+	if n != (int64)(len(expect)) {
+		return fmt.Errorf("GET %s (Range=%q): expected %d bytes are counted, got %d", f.Hash, rangeH, len(expect), n)
+	}
+	return nil
+}
+
+func testServeDownload(t *testing.T, s storage.Storage, opts Options) {
+	f := NewFile(1, 300*1024)
+	f.Create(t, s)
+
+	if err := checkDownload(s, opts, http.MethodGet, "", f, f.Data); err != nil {
+		t.Error(err)
+	}
+	if err := checkDownload(s, opts, http.MethodGet, "bytes=100-1123", f, f.Data[100:1124]); err != nil {
+		t.Error(err)
+	}
+	if err := checkDownload(s, opts, http.MethodGet, "bytes=-10", f, f.Data[len(f.Data)-10:]); err != nil {
+		t.Error(err)
+	}
+	if err := checkDownload(s, opts, http.MethodHead, "", f, nil); err != nil {
+		t.Error(err)
+	}
+	if err := checkDownload(s, opts, http.MethodHead, "bytes=0-9", f, nil); err != nil {
+		t.Error(err)
+	}
+
+	missing := NewFile(2, 10)
+	if res, _, err := serveDownload(s, opts, http.MethodGet, "", missing); err == nil && res.Status/100 == 2 {
+		t.Errorf("Serving a missing file should fail, got status %d", res.Status)
+	}
+}
+
+func testServeMeasure(t *testing.T, s storage.Storage, opts Options) {
+	for _, size := range []int{1, 2} {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			req := httptest.NewRequest(method, "/measure/"+strconv.Itoa(size), nil)
+			res, err := doServe(opts, req, func(rw http.ResponseWriter, req *http.Request) error {
+				return s.ServeMeasure(rw, req, size)
+			})
+			if err != nil {
+				t.Errorf("%s measure %d: %v", method, size, err)
+				continue
+			}
+			if res.Status != http.StatusOK {
+				t.Errorf("%s measure %d: expected status 200, got %d", method, size, res.Status)
+				continue
+			}
+			if method == http.MethodGet && len(res.Body) != size*utils.MbChunkSize {
+				t.Errorf("GET measure %d: expected %d bytes, got %d", size, size*utils.MbChunkSize, len(res.Body))
+			}
+		}
+	}
+}
+
+func testConcurrent(t *testing.T, s storage.Storage, opts Options) {
+	const (
+		workers        = 8
+		filesPerWorker = 6
+	)
+	shared := NewFile(-1, 64*1024)
+	shared.Create(t, s)
+
+	var (
+		wg     sync.WaitGroup
+		mux    sync.Mutex
+		expect = map[string]int64{shared.Hash: (int64)(len(shared.Data))}
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < filesPerWorker; i++ {
+				f := NewFile((int64)(w*filesPerWorker+i), 1024+w*100+i)
+				if err := s.Create(context.Background(), f.Hash, bytes.NewReader(f.Data)); err != nil {
+					t.Errorf("Create(%s): %v", f.Hash, err)
+					continue
+				}
+				if err := checkContent(s, f); err != nil {
+					t.Error(err)
+				}
+				if err := checkDownload(s, opts, http.MethodGet, "", f, f.Data); err != nil {
+					t.Error(err)
+				}
+				if err := checkDownload(s, opts, http.MethodGet, "", shared, shared.Data); err != nil {
+					t.Error(err)
+				}
+				if i%2 == 0 {
+					if err := s.Remove(context.Background(), f.Hash); err != nil {
+						t.Errorf("Remove(%s): %v", f.Hash, err)
+					}
+					continue
+				}
+				mux.Lock()
+				expect[f.Hash] = (int64)(len(f.Data))
+				mux.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	found, err := walkAll(s)
+	if err != nil {
+		t.Fatalf("WalkDir: %v", err)
+	}
+	if !maps.Equal(found, expect) {
+		t.Errorf("WalkDir after concurrent access: expected %d files, got %d files", len(expect), len(found))
+	}
+}
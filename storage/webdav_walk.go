@@ -0,0 +1,295 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/LiterMC/go-openbmclapi/log"
+	. "github.com/LiterMC/go-openbmclapi/utils"
+)
+
+// maxWalkConcurrency is the max number of folders that will be listed at the same time
+const maxWalkConcurrency = 16
+
+var errInfinityDepthUnsupported = errors.New("PROPFIND with infinity depth is not supported")
+
+const webdavListPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/></D:prop></D:propfind>`
+
+type webdavListResponse struct {
+	Href      string `xml:"DAV: href"`
+	Propstats []struct {
+		Status string `xml:"DAV: status"`
+		Prop   struct {
+			ContentLength string `xml:"DAV: getcontentlength"`
+			ResourceType  struct {
+				Collection *struct{} `xml:"DAV: collection"`
+			} `xml:"DAV: resourcetype"`
+		} `xml:"DAV: prop"`
+	} `xml:"DAV: propstat"`
+}
+
+// parse returns the path, the size and whether it is a folder
+func (r *webdavListResponse) parse() (p string, size int64, isDir bool, err error) {
+	u, err := url.Parse(r.Href)
+	if err != nil {
+		return
+	}
+	p = strings.TrimSuffix(u.Path, "/")
+	for _, ps := range r.Propstats {
+		if !strings.Contains(ps.Status, " 200 ") {
+			continue
+		}
+		if ps.Prop.ResourceType.Collection != nil {
+			isDir = true
+		}
+		if ps.Prop.ContentLength != "" {
+			if size, err = strconv.ParseInt(strings.TrimSpace(ps.Prop.ContentLength), 10, 64); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// propfind requests the properties used for listing files
+func (s *WebDavStorage) propfind(ctx context.Context, name string, depth string) (*http.Response, error) {
+	target, err := url.JoinPath(s.opt.GetEndPoint(), name)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "PROPFIND", target, strings.NewReader(webdavListPropfind))
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(s.opt.GetUsername(), s.opt.GetPassword())
+	req.Header.Set("Depth", depth)
+	req.Header.Set("Content-Type", "application/xml; charset=utf-8")
+	return s.httpCli.Do(req)
+}
+
+// decodeListResponses calls fn for each response element in the multistatus body
+func decodeListResponses(body io.Reader, fn func(r *webdavListResponse) error) error {
+	dec := xml.NewDecoder(body)
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Space != "DAV:" || se.Name.Local != "response" {
+			continue
+		}
+		var r webdavListResponse
+		if err := dec.DecodeElement(&r, &se); err != nil {
+			return err
+		}
+		if err := fn(&r); err != nil {
+			return err
+		}
+	}
+}
+
+// WalkDir lists the files under the download folder.
+// It tries to list everything with a single PROPFIND request with `Depth: infinity` first,
+// and lists each prefix folder in parallel if the server refuses it.
+// Unlike a missing folder, any listing error will stop the walk and be returned
+func (s *WebDavStorage) WalkDir(ctx context.Context, walker func(hash string, size int64) error) error {
+	if !s.noInfinityDepth.Load() {
+		err := s.walkInfinity(ctx, walker)
+		if !errors.Is(err, errInfinityDepthUnsupported) {
+			return err
+		}
+		log.Debugf("%s does not support PROPFIND with infinity depth, listing folders in parallel", s.String())
+		s.noInfinityDepth.Store(true)
+	}
+	return s.walkPrefixes(ctx, walker)
+}
+
+func (s *WebDavStorage) walkInfinity(ctx context.Context, walker func(hash string, size int64) error) error {
+	res, err := s.propfind(ctx, "download/", "infinity")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusMultiStatus:
+	case http.StatusNotFound:
+		// the download folder does not exist yet
+		return nil
+	case http.StatusBadRequest, http.StatusForbidden, http.StatusNotImplemented:
+		// RFC 4918 9.1: servers may reject infinity depth with 403 and a propfind-finite-depth precondition
+		return errInfinityDepthUnsupported
+	default:
+		return &HTTPStatusError{Code: res.StatusCode}
+	}
+
+	var (
+		files     int
+		sawPrefix bool
+	)
+	if err := decodeListResponses(res.Body, func(r *webdavListResponse) error {
+		p, size, isDir, err := r.parse()
+		if err != nil {
+			return err
+		}
+		name, dir := path.Base(p), path.Dir(p)
+		if isDir {
+			if len(name) == 2 && path.Base(dir) == "download" {
+				sawPrefix = true
+			}
+			return nil
+		}
+		if len(name) < 2 || path.Base(dir) != name[:2] || path.Base(path.Dir(dir)) != "download" {
+			return nil
+		}
+		files++
+		return walker(name, size)
+	}); err != nil {
+		return err
+	}
+	if files == 0 && sawPrefix {
+		// some servers silently treat infinity as depth 1
+		return errInfinityDepthUnsupported
+	}
+	return nil
+}
+
+// prefixWalkState is shared by the workers of walkPrefixes
+type prefixWalkState struct {
+	walker func(hash string, size int64) error
+
+	mux  sync.Mutex // the walker is called with mux locked
+	err  error
+	stop chan struct{}
+}
+
+// failLocked records the first error and stops the other workers
+func (w *prefixWalkState) failLocked(err error) {
+	if w.err == nil {
+		w.err = err
+		close(w.stop)
+	}
+}
+
+func (s *WebDavStorage) walkPrefixes(ctx context.Context, walker func(hash string, size int64) error) error {
+	workers := s.opt.MaxConn
+	if workers <= 0 || workers > maxWalkConcurrency {
+		workers = maxWalkConcurrency
+	}
+
+	state := &prefixWalkState{
+		walker: walker,
+		stop:   make(chan struct{}, 0),
+	}
+	prefixes := make(chan string, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for dir := range prefixes {
+				s.walkPrefix(ctx, dir, state)
+			}
+		}()
+	}
+SEND:
+	for _, dir := range Hex256 {
+		select {
+		case prefixes <- dir:
+		case <-state.stop:
+			break SEND
+		case <-ctx.Done():
+			break SEND
+		}
+	}
+	close(prefixes)
+	wg.Wait()
+	if state.err == nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return state.err
+}
+
+func (s *WebDavStorage) walkPrefix(ctx context.Context, dir string, state *prefixWalkState) {
+	files, err := s.listPrefix(ctx, dir)
+
+	state.mux.Lock()
+	defer state.mux.Unlock()
+	if state.err != nil {
+		return
+	}
+	if err != nil {
+		state.failLocked(fmt.Errorf("Cannot list folder %q: %w", dir, err))
+		return
+	}
+	for _, f := range files {
+		if err := state.walker(f.hash, f.size); err != nil {
+			state.failLocked(err)
+			return
+		}
+	}
+}
+
+type webdavFileInfo struct {
+	hash string
+	size int64
+}
+
+// listPrefix lists the files under a prefix folder, a missing folder is treated as empty
+func (s *WebDavStorage) listPrefix(ctx context.Context, dir string) (files []webdavFileInfo, err error) {
+	res, err := s.propfind(ctx, path.Join("download", dir)+"/", "1")
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusMultiStatus:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		return nil, &HTTPStatusError{Code: res.StatusCode}
+	}
+	err = decodeListResponses(res.Body, func(r *webdavListResponse) error {
+		p, size, isDir, err := r.parse()
+		if err != nil {
+			return err
+		}
+		if hash := path.Base(p); !isDir && len(hash) >= 2 && hash[:2] == dir && path.Base(path.Dir(p)) == dir {
+			files = append(files, webdavFileInfo{hash: hash, size: size})
+		}
+		return nil
+	})
+	return
+}
@@ -0,0 +1,156 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+func newTestWebDavStorage(t *testing.T, files map[string]int64, wrap func(http.Handler) http.Handler) *WebDavStorage {
+	t.Helper()
+	root := t.TempDir()
+	for hash, size := range files {
+		dir := filepath.Join(root, "download", hash[:2])
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Cannot create folder: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, hash), make([]byte, size), 0644); err != nil {
+			t.Fatalf("Cannot create file: %v", err)
+		}
+	}
+	// an empty prefix folder, and a file does not belong to its folder
+	os.MkdirAll(filepath.Join(root, "download", "ff"), 0755)
+	os.WriteFile(filepath.Join(root, "download", "ff", "0123"), nil, 0644)
+
+	var handler http.Handler = &webdav.Handler{
+		FileSystem: webdav.Dir(root),
+		LockSystem: webdav.NewMemLS(),
+	}
+	if wrap != nil {
+		handler = wrap(handler)
+	}
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	return initTestStorage(t, new(WebDavStorage), &WebDavStorageOption{
+		MaxConn:      4,
+		FullEndPoint: srv.URL + "/",
+	})
+}
+
+func TestWebDavWalkDir(t *testing.T) {
+	files := map[string]int64{
+		"0a1b2c": 10,
+		"0a3d4e": 0,
+		"9f8e7d": 1234,
+		"c0ffee": 7,
+	}
+	refuseInfinity := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.Method == "PROPFIND" && req.Header.Get("Depth") == "infinity" {
+				rw.WriteHeader(http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+	capInfinity := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.Header.Get("Depth") == "infinity" {
+				req.Header.Set("Depth", "1")
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+
+	data := []struct {
+		name       string
+		wrap       func(http.Handler) http.Handler
+		noInfinity bool
+	}{
+		{"infinity", nil, false},
+		{"refused", refuseInfinity, true},
+		{"capped", capInfinity, true},
+	}
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			s := newTestWebDavStorage(t, files, d.wrap)
+			found, err := walkTestFiles(s)
+			if err != nil {
+				t.Fatalf("WalkDir: %v", err)
+			}
+			if !maps.Equal(found, files) {
+				t.Errorf("Expected %v, got %v", files, found)
+			}
+			if s.noInfinityDepth.Load() != d.noInfinity {
+				t.Errorf("Expected noInfinityDepth to be %v", d.noInfinity)
+			}
+		})
+	}
+}
+
+func TestWebDavWalkDirError(t *testing.T) {
+	files := map[string]int64{
+		"0a1b2c": 10,
+		"9f8e7d": 1234,
+	}
+	s := newTestWebDavStorage(t, files, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if req.Method == "PROPFIND" {
+				if req.Header.Get("Depth") == "infinity" {
+					rw.WriteHeader(http.StatusNotImplemented)
+					return
+				}
+				if strings.HasPrefix(req.URL.Path, "/download/9f") {
+					rw.WriteHeader(http.StatusInternalServerError)
+					return
+				}
+			}
+			next.ServeHTTP(rw, req)
+		})
+	})
+	if _, err := walkTestFiles(s); err == nil {
+		t.Fatalf("Expected listing error to be returned")
+	}
+
+	errStop := errors.New("stop")
+	s = newTestWebDavStorage(t, files, nil)
+	calls := 0
+	err := s.WalkDir(context.Background(), func(string, int64) error {
+		calls++
+		return errStop
+	})
+	if err != errStop {
+		t.Errorf("Expected walker error to be returned as is, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("Walker should not be called after it returned an error, called %d times", calls)
+	}
+}
@@ -0,0 +1,167 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// WeightScale is the scale of the weights returned by AdaptWeights,
+// so the weights can be adjusted finer than the configured integers
+const WeightScale = 100
+
+// WindowStats is the summary of a ServeWindow
+type WindowStats struct {
+	Requests int64
+	Errors   int64
+	// Latency is the average latency of the successful requests
+	Latency time.Duration
+}
+
+// ErrorRate returns the ratio of the failed requests
+func (s WindowStats) ErrorRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return (float64)(s.Errors) / (float64)(s.Requests)
+}
+
+type serveBucket struct {
+	requests int64
+	errors   int64
+	latency  time.Duration // sum of the successful requests
+}
+
+// ServeWindow records the serve results of a storage over a sliding time window.
+// The window is divided into buckets, and the oldest bucket is dropped as time goes by
+type ServeWindow struct {
+	mux     sync.Mutex
+	span    time.Duration // duration of each bucket
+	buckets []serveBucket
+	current int
+	start   time.Time // when the current bucket started
+}
+
+// NewServeWindow creates a window that covers the given duration with n buckets
+func NewServeWindow(window time.Duration, n int) *ServeWindow {
+	if n <= 0 {
+		n = 1
+	}
+	return &ServeWindow{
+		span:    window / (time.Duration)(n),
+		buckets: make([]serveBucket, n),
+	}
+}
+
+// advanceLocked moves to the bucket of now, clearing the buckets that are out of the window
+func (w *ServeWindow) advanceLocked(now time.Time) {
+	if w.start.IsZero() {
+		w.start = now
+		return
+	}
+	passed := (int)(now.Sub(w.start) / w.span)
+	if passed <= 0 {
+		return
+	}
+	n := len(w.buckets)
+	for i := 0; i < passed && i < n; i++ {
+		w.current = (w.current + 1) % n
+		w.buckets[w.current] = serveBucket{}
+	}
+	w.start = w.start.Add((time.Duration)(passed) * w.span)
+}
+
+// Record adds a request to the window, err should be nil if the request succeeded
+func (w *ServeWindow) Record(latency time.Duration, err error) {
+	w.recordAt(time.Now(), latency, err)
+}
+
+func (w *ServeWindow) recordAt(now time.Time, latency time.Duration, err error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.advanceLocked(now)
+	b := &w.buckets[w.current]
+	b.requests++
+	if err != nil {
+		b.errors++
+	} else {
+		b.latency += latency
+	}
+}
+
+// Stats summarizes the requests in the window
+func (w *ServeWindow) Stats() WindowStats {
+	return w.statsAt(time.Now())
+}
+
+func (w *ServeWindow) statsAt(now time.Time) (s WindowStats) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.advanceLocked(now)
+	var latency time.Duration
+	for _, b := range w.buckets {
+		s.Requests += b.requests
+		s.Errors += b.errors
+		latency += b.latency
+	}
+	if ok := s.Requests - s.Errors; ok > 0 {
+		s.Latency = latency / (time.Duration)(ok)
+	}
+	return
+}
+
+// minScoreLatency is the lowest latency used for scoring,
+// differences below it are caused by the file sizes rather than the storages
+const minScoreLatency = time.Millisecond
+
+// AdaptWeights adjusts the base weights by the serve stats, and returns the weights scaled by WeightScale.
+// A storage is scored by its success rate squared divided by its latency,
+// and its weight is multiplied by the ratio of its score to the weighted average score,
+// which is limited between minFactor and maxFactor.
+// Storages with zero base weight or less than minRequests requests in the window keep their base weights
+func AdaptWeights(base []uint, stats []WindowStats, minFactor, maxFactor float64, minRequests int64) []uint {
+	scores := make([]float64, len(base))
+	sampled := make([]bool, len(base))
+	var sum, total float64
+	for i, w := range base {
+		s := stats[i]
+		if w == 0 || s.Requests == 0 || s.Requests < minRequests {
+			continue
+		}
+		sampled[i] = true
+		success := 1 - s.ErrorRate()
+		if success > 0 {
+			scores[i] = success * success / max(s.Latency, minScoreLatency).Seconds()
+		}
+		sum += (float64)(w) * scores[i]
+		total += (float64)(w)
+	}
+	weights := make([]uint, len(base))
+	for i, w := range base {
+		factor := 1.0
+		if sampled[i] && sum > 0 {
+			factor = min(max(scores[i]*total/sum, minFactor), maxFactor)
+		}
+		weights[i] = (uint)(math.Round((float64)(w) * factor * WeightScale))
+	}
+	return weights
+}
@@ -0,0 +1,103 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package storage
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestServeWindow(t *testing.T) {
+	w := NewServeWindow(time.Minute, 6)
+	now := time.Unix(1700000000, 0)
+	errFailed := errors.New("failed")
+
+	w.recordAt(now, time.Millisecond*10, nil)
+	w.recordAt(now.Add(time.Second*5), time.Millisecond*30, nil)
+	w.recordAt(now.Add(time.Second*15), 0, errFailed)
+	s := w.statsAt(now.Add(time.Second * 20))
+	if s.Requests != 3 || s.Errors != 1 || s.Latency != time.Millisecond*20 {
+		t.Errorf("Unexpected stats %+v", s)
+	}
+
+	// the first bucket is dropped, the second one is still in the window
+	s = w.statsAt(now.Add(time.Second * 65))
+	if s.Requests != 1 || s.Errors != 1 || s.Latency != 0 {
+		t.Errorf("Unexpected stats after the first bucket expired %+v", s)
+	}
+	s = w.statsAt(now.Add(time.Hour))
+	if s.Requests != 0 || s.Errors != 0 {
+		t.Errorf("All buckets should be expired, got %+v", s)
+	}
+	w.recordAt(now.Add(time.Hour), time.Millisecond, nil)
+	if s = w.statsAt(now.Add(time.Hour)); s.Requests != 1 {
+		t.Errorf("Expected 1 request after the window is reset, got %+v", s)
+	}
+}
+
+func TestAdaptWeights(t *testing.T) {
+	data := []struct {
+		name   string
+		base   []uint
+		stats  []WindowStats
+		expect []uint
+	}{
+		{
+			"equal",
+			[]uint{1, 1},
+			[]WindowStats{{Requests: 100, Latency: time.Millisecond * 50}, {Requests: 100, Latency: time.Millisecond * 50}},
+			[]uint{100, 100},
+		},
+		{
+			"faster",
+			[]uint{1, 1},
+			[]WindowStats{{Requests: 100, Latency: time.Millisecond * 100}, {Requests: 100, Latency: time.Millisecond * 300}},
+			[]uint{150, 50},
+		},
+		{
+			"bounded",
+			[]uint{1, 1},
+			[]WindowStats{{Requests: 100, Latency: time.Millisecond}, {Requests: 100, Latency: time.Second}},
+			[]uint{200, 50},
+		},
+		{
+			"errors",
+			[]uint{1, 1},
+			[]WindowStats{{Requests: 100, Latency: time.Millisecond * 50}, {Requests: 100, Errors: 50, Latency: time.Millisecond * 50}},
+			[]uint{160, 50},
+		},
+		{
+			"unsampled and fallback",
+			[]uint{2, 1, 0},
+			[]WindowStats{{Requests: 100, Latency: time.Millisecond * 50}, {Requests: 5, Latency: time.Second}, {Requests: 100, Latency: time.Millisecond}},
+			[]uint{200, 100, 0},
+		},
+	}
+	for _, d := range data {
+		t.Run(d.name, func(t *testing.T) {
+			got := AdaptWeights(d.base, d.stats, 0.5, 2, 10)
+			if !slices.Equal(got, d.expect) {
+				t.Errorf("Expected %v, got %v", d.expect, got)
+			}
+		})
+	}
+}
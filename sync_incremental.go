@@ -0,0 +1,131 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/LiterMC/go-openbmclapi/database"
+	"github.com/LiterMC/go-openbmclapi/filelist"
+	"github.com/LiterMC/go-openbmclapi/log"
+	"github.com/LiterMC/go-openbmclapi/storage"
+)
+
+// SyncFilesIncremental only checks and downloads the files that are added or changed since the last sync.
+// It runs a full sync instead if there is no previous file list.
+// The files removed from the list are returned with the indexes of the storages which hold them,
+// and they can be passed to GcFiles
+func (cr *Cluster) SyncFilesIncremental(ctx context.Context, files []FileInfo) (removed map[string][]int, ok bool) {
+	cr.filesetMux.RLock()
+	prev := cr.lastFileList
+	cr.filesetMux.RUnlock()
+	if prev == nil {
+		return nil, cr.SyncFiles(ctx, files, false)
+	}
+
+	log.Info("Preparing to sync changed files...")
+	if !cr.issync.CompareAndSwap(false, true) {
+		log.Warn("Another sync task is running!")
+		return nil, false
+	}
+
+	filelist.Sort(files)
+	diff := filelist.Compare(prev, files)
+	log.Infof("File list changed: %d added, %d changed, %d removed", len(diff.Added), len(diff.Changed), len(diff.Removed))
+	delta := make([]FileInfo, 0, len(diff.Added)+len(diff.Changed))
+	delta = append(delta, diff.Added...)
+	delta = append(delta, diff.Changed...)
+
+	var (
+		placement map[string][]int
+		err       error
+	)
+	if len(delta) > 0 {
+		placement, err = cr.syncFiles(ctx, delta, false)
+	}
+	if err == nil {
+		files = filelist.Synced(files, placement)
+		for _, f := range delta {
+			if config.Hijack.Enable && !strings.HasPrefix(f.Path, "/openbmclapi/download/") {
+				cr.fileMapDB.Set(database.Record{
+					Path: f.Path,
+					Hash: f.Hash,
+					Size: f.Size,
+				})
+			}
+		}
+
+		cr.filesetMux.Lock()
+		var (
+			fileset      map[string]int64
+			fileStorages map[string][]int
+		)
+		fileset, fileStorages, removed = diff.Apply(files, placement, cr.fileStorages)
+		cr.fileset = fileset
+		cr.fileStorages = fileStorages
+		cr.lastFileList = files
+		cr.filesetMux.Unlock()
+
+		if err := cr.saveFilesetManifest(files, fileStorages); err != nil {
+			log.Errorf("Cannot save fileset manifest: %v", err)
+		}
+	}
+	cr.issync.Store(false)
+	if err == nil {
+		go cr.drainStorages(ctx)
+	}
+	return removed, true
+}
+
+// GcFiles removes the files which are no longer in the file list from the storages which hold them.
+// Unlike Gc, it does not walk the storages
+func (cr *Cluster) GcFiles(ctx context.Context, removed map[string][]int) {
+	if len(removed) == 0 {
+		return
+	}
+	log.Infof("Removing %d outdated files", len(removed))
+	count := 0
+	for hash, holders := range removed {
+		if ctx.Err() != nil {
+			log.Warn("Garbage collector interrupted")
+			return
+		}
+		if _, ok := cr.CachedFileSize(hash); ok {
+			// the file has been added back
+			continue
+		}
+		if len(holders) == 0 {
+			holders = cr.storageIndexes
+		}
+		for _, i := range holders {
+			if cr.storageOpts[i].Mode == storage.ModeReadOnly {
+				continue
+			}
+			if err := cr.storages[i].Remove(ctx, hash); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Errorf("Cannot remove %s from %s: %v", hash, cr.storages[i].String(), err)
+			}
+		}
+		count++
+	}
+	log.Infof("Garbage collect finished, %d outdated files removed", count)
+}
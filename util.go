@@ -88,18 +88,6 @@ func bytesToUnit(size float64) string {
 	return fmt.Sprintf("%.1f%sB", size, string(unit))
 }
 
-func getHashMethod(l int) (hashMethod crypto.Hash, err error) {
-	switch l {
-	case 32:
-		hashMethod = crypto.MD5
-	case 40:
-		hashMethod = crypto.SHA1
-	default:
-		err = fmt.Errorf("Unknown hash length %d", l)
-	}
-	return
-}
-
 func parseCertCommonName(body []byte) (string, error) {
 	cert, err := x509.ParseCertificate(body)
 	if err != nil {
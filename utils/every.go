@@ -0,0 +1,36 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+// Every reports true once every N calls of Next, starting from the first call.
+// It reports true for every call if N is not positive
+type Every struct {
+	N     int
+	count int
+}
+
+func (e *Every) Next() bool {
+	if e.N <= 1 {
+		return true
+	}
+	ok := e.count == 0
+	e.count = (e.count + 1) % e.N
+	return ok
+}
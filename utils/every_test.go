@@ -0,0 +1,50 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package utils_test
+
+import (
+	"slices"
+	"testing"
+
+	. "github.com/LiterMC/go-openbmclapi/utils"
+)
+
+func TestEvery(t *testing.T) {
+	var data = []struct {
+		N      int
+		Expect []bool
+	}{
+		{3, []bool{true, false, false, true, false, false, true}},
+		{2, []bool{true, false, true, false, true}},
+		{1, []bool{true, true, true, true}},
+		{0, []bool{true, true, true, true}},
+		{-1, []bool{true, true, true, true}},
+	}
+	for _, d := range data {
+		e := Every{N: d.N}
+		got := make([]bool, len(d.Expect))
+		for i := range got {
+			got[i] = e.Next()
+		}
+		if !slices.Equal(got, d.Expect) {
+			t.Errorf("Every %d: expected %v, got %v", d.N, d.Expect, got)
+		}
+	}
+}
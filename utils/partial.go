@@ -0,0 +1,187 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"crypto"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PartialDownload is a temporary file being downloaded.
+// It keeps the hash state of the written data, so a failed download can be resumed with a Range request
+// without reading the written part again
+type PartialDownload struct {
+	fd      *os.File
+	hw      hash.Hash
+	written int64
+}
+
+func NewPartialDownload(hashMethod crypto.Hash) (*PartialDownload, error) {
+	fd, err := os.CreateTemp("", "*.downloading")
+	if err != nil {
+		return nil, err
+	}
+	return &PartialDownload{
+		fd: fd,
+		hw: hashMethod.New(),
+	}, nil
+}
+
+func (p *PartialDownload) Path() string {
+	return p.fd.Name()
+}
+
+// Written returns the size of the data that has been downloaded
+func (p *PartialDownload) Written() int64 {
+	return p.written
+}
+
+// Write appends data to the file, only the data that has been written to the file will be hashed
+func (p *PartialDownload) Write(buf []byte) (n int, err error) {
+	n, err = p.fd.Write(buf)
+	p.hw.Write(buf[:n])
+	p.written += (int64)(n)
+	return
+}
+
+// Sum returns the hex encoded hash of the written data
+func (p *PartialDownload) Sum(buf []byte) string {
+	return hex.EncodeToString(p.hw.Sum(buf[:0]))
+}
+
+// Reset discards the written data, so the file will be downloaded from the beginning
+func (p *PartialDownload) Reset() error {
+	p.hw.Reset()
+	p.written = 0
+	if _, err := p.fd.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return p.fd.Truncate(0)
+}
+
+// Close closes the file and keeps it
+func (p *PartialDownload) Close() error {
+	return p.fd.Close()
+}
+
+// Remove closes and removes the file
+func (p *PartialDownload) Remove() {
+	p.fd.Close()
+	os.Remove(p.fd.Name())
+}
+
+// PrepareRequest sets the headers of req, so the download will be resumed from the written data
+func (p *PartialDownload) PrepareRequest(req *http.Request) {
+	if p.written > 0 {
+		// the offset is on the decoded data, so the content must not be encoded
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", p.written))
+	} else {
+		req.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+}
+
+// ReadResponse appends the body of res to the file, and checks the size and the hash of the file.
+// res should be the response of a request prepared by PrepareRequest.
+// It restarts from the beginning if the server does not support the Range request.
+// The downloaded data is kept when the transfer is interrupted, but it is discarded if the check failed
+func (p *PartialDownload) ReadResponse(
+	res *http.Response,
+	size int64, hash string, buf []byte,
+	wrapper func(io.Reader) io.Reader,
+) (err error) {
+	resume := p.written > 0
+	ce := strings.ToLower(res.Header.Get("Content-Encoding"))
+	switch res.StatusCode {
+	case http.StatusOK:
+		if resume {
+			if err = p.Reset(); err != nil {
+				return
+			}
+		}
+	case http.StatusPartialContent:
+		if start, ok := ParseContentRangeStart(res.Header.Get("Content-Range")); !resume || !ok || start != p.written || ce != "" {
+			p.Reset()
+			return fmt.Errorf("Unexpected partial content %q", res.Header.Get("Content-Range"))
+		}
+	default:
+		if res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			p.Reset()
+		}
+		return NewHTTPStatusErrorFromResponse(res)
+	}
+	var r io.Reader
+	switch ce {
+	case "":
+		r = res.Body
+	case "gzip":
+		if r, err = gzip.NewReader(res.Body); err != nil {
+			return
+		}
+	case "deflate":
+		if r, err = zlib.NewReader(res.Body); err != nil {
+			return
+		}
+	default:
+		return fmt.Errorf("Unexpected Content-Encoding %q", ce)
+	}
+	if wrapper != nil {
+		r = wrapper(r)
+	}
+
+	if _, err = io.CopyBuffer(p, r, buf); err != nil {
+		return
+	}
+	if t := p.written; size >= 0 && t != size {
+		if t > size {
+			p.Reset()
+		}
+		return fmt.Errorf("File size wrong, got %d, expect %d", t, size)
+	} else if hs := p.Sum(buf); hs != hash {
+		p.Reset()
+		return fmt.Errorf("File hash not match, got %s, expect %s", hs, hash)
+	}
+	return
+}
+
+// ParseContentRangeStart returns the first byte position of a Content-Range header like `bytes 100-199/200`
+func ParseContentRangeStart(v string) (start int64, ok bool) {
+	v, ok = strings.CutPrefix(v, "bytes ")
+	if !ok {
+		return
+	}
+	v, _, ok = strings.Cut(v, "-")
+	if !ok {
+		return
+	}
+	start, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return start, true
+}
@@ -0,0 +1,175 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package utils_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/LiterMC/go-openbmclapi/utils"
+)
+
+func TestParseContentRangeStart(t *testing.T) {
+	var data = []struct {
+		S     string
+		Start int64
+		Ok    bool
+	}{
+		{"bytes 0-99/100", 0, true},
+		{"bytes 100-199/200", 100, true},
+		{"bytes 100-199/*", 100, true},
+		{"bytes */200", 0, false},
+		{"bytes -199/200", 0, false},
+		{"100-199/200", 0, false},
+		{"", 0, false},
+	}
+	for _, d := range data {
+		start, ok := ParseContentRangeStart(d.S)
+		if ok != d.Ok || start != d.Start {
+			t.Errorf("ParseContentRangeStart(%q): expected %d, %v, got %d, %v", d.S, d.Start, d.Ok, start, ok)
+		}
+	}
+}
+
+// partialTestServer serves data, the first response is dropped after half of the body is sent,
+// and the resumed requests are handled by serveRange
+func partialTestServer(t *testing.T, data []byte, serveRange http.HandlerFunc) *httptest.Server {
+	var dropped atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Range") != "" {
+			serveRange(rw, req)
+			return
+		}
+		if dropped.CompareAndSwap(false, true) {
+			rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			rw.WriteHeader(http.StatusOK)
+			rw.Write(data[:len(data)/2])
+			rw.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func fetchPartial(t *testing.T, p *PartialDownload, url string, data []byte) error {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatalf("Cannot create request: %v", err)
+	}
+	p.PrepareRequest(req)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Cannot send request: %v", err)
+	}
+	defer res.Body.Close()
+	sum := sha1.Sum(data)
+	return p.ReadResponse(res, (int64)(len(data)), hex.EncodeToString(sum[:]), make([]byte, 1024), nil)
+}
+
+func newTestPartialDownload(t *testing.T) *PartialDownload {
+	p, err := NewPartialDownload(crypto.SHA1)
+	if err != nil {
+		t.Fatalf("Cannot create partial download: %v", err)
+	}
+	t.Cleanup(p.Remove)
+	return p
+}
+
+func TestPartialDownloadResume(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	half := (int64)(len(data) / 2)
+
+	var cases = []struct {
+		Name    string
+		Serve   http.HandlerFunc
+		Ok      bool
+		Written int64 // the expected written size after the resumed request
+	}{
+		{"resume", func(rw http.ResponseWriter, req *http.Request) {
+			http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(data))
+		}, true, (int64)(len(data))},
+		{"range not supported", func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write(data)
+		}, true, (int64)(len(data))},
+		{"range not satisfiable", func(rw http.ResponseWriter, req *http.Request) {
+			rw.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		}, false, 0},
+		{"unexpected range", func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Set("Content-Range", "bytes 0-"+strconv.Itoa(len(data)-1)+"/"+strconv.Itoa(len(data)))
+			rw.WriteHeader(http.StatusPartialContent)
+			rw.Write(data)
+		}, false, 0},
+		{"hash mismatch", func(rw http.ResponseWriter, req *http.Request) {
+			bad := bytes.ToUpper(data)
+			http.ServeContent(rw, req, "", time.Time{}, bytes.NewReader(bad))
+		}, false, 0},
+	}
+	for _, d := range cases {
+		t.Run(d.Name, func(t *testing.T) {
+			var rangeH atomic.Value
+			srv := partialTestServer(t, data, func(rw http.ResponseWriter, req *http.Request) {
+				rangeH.Store(req.Header.Get("Range"))
+				d.Serve(rw, req)
+			})
+			p := newTestPartialDownload(t)
+			if err := fetchPartial(t, p, srv.URL, data); err == nil {
+				t.Fatalf("The dropped download should fail")
+			}
+			if p.Written() != half {
+				t.Fatalf("Expected %d bytes are kept after the connection is dropped, got %d", half, p.Written())
+			}
+			err := fetchPartial(t, p, srv.URL, data)
+			if expect := "bytes=" + strconv.Itoa(int(half)) + "-"; rangeH.Load() != expect {
+				t.Errorf("Expected Range header %q, got %v", expect, rangeH.Load())
+			}
+			if d.Ok != (err == nil) {
+				t.Errorf("Expected ok=%v, got error %v", d.Ok, err)
+			}
+			if p.Written() != d.Written {
+				t.Errorf("Expected %d bytes written, got %d", d.Written, p.Written())
+			}
+			if !d.Ok {
+				return
+			}
+			if err := p.Close(); err != nil {
+				t.Fatalf("Cannot close partial download: %v", err)
+			}
+			got, err := os.ReadFile(p.Path())
+			if err != nil {
+				t.Fatalf("Cannot read downloaded file: %v", err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("Downloaded data mismatch")
+			}
+		})
+	}
+}
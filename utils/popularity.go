@@ -0,0 +1,132 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"sync"
+	"time"
+)
+
+const popularityShards = 256
+
+type popularityEntry struct {
+	count uint32
+	epoch int64 // the half life period when the count is updated
+}
+
+// decayed returns the count halved for each half life passed since the entry is updated
+func (e popularityEntry) decayed(epoch int64) uint32 {
+	n := epoch - e.epoch
+	if n <= 0 {
+		return e.count
+	}
+	if n >= 32 {
+		return 0
+	}
+	return e.count >> n
+}
+
+type popularityShard struct {
+	mux     sync.Mutex
+	entries map[string]popularityEntry
+	swept   int64 // the epoch of the last sweep
+}
+
+// sweepLocked drops the entries whose count have decayed to zero
+func (s *popularityShard) sweepLocked(epoch int64) {
+	s.swept = epoch
+	for hash, e := range s.entries {
+		if e.decayed(epoch) == 0 {
+			delete(s.entries, hash)
+		}
+	}
+}
+
+// Popularity counts the accesses of each hash.
+// The counts are halved every half life, so the recent accesses weigh more.
+// The hashes are sharded by their first byte, and each entry is decayed when it is accessed,
+// so a hit does not need to walk the other hashes
+type Popularity struct {
+	halfLife   time.Duration
+	maxEntries int // the max number of hashes in each shard
+	shards     [popularityShards]popularityShard
+}
+
+// NewPopularity creates a counter which counts at most maxEntries hashes
+func NewPopularity(halfLife time.Duration, maxEntries int) *Popularity {
+	return &Popularity{
+		halfLife:   halfLife,
+		maxEntries: max(maxEntries/popularityShards, 1),
+	}
+}
+
+func (p *Popularity) epoch(now time.Time) int64 {
+	return now.UnixNano() / (int64)(p.halfLife)
+}
+
+func (p *Popularity) shard(hash string) *popularityShard {
+	if len(hash) < 2 {
+		return &p.shards[0]
+	}
+	return &p.shards[HexTo256(hash)]
+}
+
+// Hit records an access of the hash
+func (p *Popularity) Hit(hash string) {
+	p.hitAt(hash, time.Now())
+}
+
+func (p *Popularity) hitAt(hash string, now time.Time) {
+	epoch := p.epoch(now)
+	s := p.shard(hash)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.entries == nil {
+		s.entries = make(map[string]popularityEntry)
+	}
+	e, ok := s.entries[hash]
+	if !ok && len(s.entries) >= p.maxEntries {
+		// the decayed entries are only dropped when the shard is full, at most once per half life
+		if s.swept == epoch {
+			return
+		}
+		s.sweepLocked(epoch)
+		if len(s.entries) >= p.maxEntries {
+			return
+		}
+	}
+	c := e.decayed(epoch)
+	if c < ^uint32(0) {
+		c++
+	}
+	s.entries[hash] = popularityEntry{count: c, epoch: epoch}
+}
+
+// Count returns the decayed access count of the hash
+func (p *Popularity) Count(hash string) uint32 {
+	return p.countAt(hash, time.Now())
+}
+
+func (p *Popularity) countAt(hash string, now time.Time) uint32 {
+	s := p.shard(hash)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.entries[hash].decayed(p.epoch(now))
+}
@@ -0,0 +1,119 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testHalfLife = time.Hour
+
+// testEpochStart is at the start of a half life
+var testEpochStart = time.Unix(0, 0).Add(testHalfLife * 1000)
+
+func TestPopularityDecay(t *testing.T) {
+	p := NewPopularity(testHalfLife, 1024)
+	const hash = "0123456789abcdef"
+	for i := 0; i < 8; i++ {
+		p.hitAt(hash, testEpochStart)
+	}
+	var data = []struct {
+		After time.Duration
+		Count uint32
+	}{
+		{0, 8},
+		{testHalfLife - 1, 8},
+		{testHalfLife, 4},
+		{testHalfLife * 3, 1},
+		{testHalfLife * 4, 0},
+		{testHalfLife * 100, 0},
+	}
+	for _, d := range data {
+		if c := p.countAt(hash, testEpochStart.Add(d.After)); c != d.Count {
+			t.Errorf("Count after %v: expected %d, got %d", d.After, d.Count, c)
+		}
+	}
+
+	// a hit should be added to the decayed count
+	p.hitAt(hash, testEpochStart.Add(testHalfLife))
+	if c := p.countAt(hash, testEpochStart.Add(testHalfLife)); c != 5 {
+		t.Errorf("Count after hit: expected 5, got %d", c)
+	}
+	if c := p.countAt(hash, testEpochStart.Add(testHalfLife*2)); c != 2 {
+		t.Errorf("Count after decay: expected 2, got %d", c)
+	}
+}
+
+func TestPopularityCap(t *testing.T) {
+	// two hashes for each shard
+	p := NewPopularity(testHalfLife, popularityShards*2)
+	p.hitAt("aa01", testEpochStart)
+	p.hitAt("aa02", testEpochStart)
+	p.hitAt("aa02", testEpochStart)
+	p.hitAt("aa03", testEpochStart)
+	p.hitAt("bb01", testEpochStart)
+	if c := p.countAt("aa03", testEpochStart); c != 0 {
+		t.Errorf("Hash should not be counted when the shard is full, got %d", c)
+	}
+	if c := p.countAt("bb01", testEpochStart); c != 1 {
+		t.Errorf("Hash in another shard should be counted, got %d", c)
+	}
+	p.hitAt("aa02", testEpochStart)
+	if c := p.countAt("aa02", testEpochStart); c != 3 {
+		t.Errorf("Counted hash should still be counted when the shard is full, expected 3, got %d", c)
+	}
+
+	// aa01 is decayed to zero, so its entry can be reused
+	now := testEpochStart.Add(testHalfLife)
+	p.hitAt("aa03", now)
+	if c := p.countAt("aa03", now); c != 1 {
+		t.Errorf("Hash should be counted after the decayed hashes are dropped, got %d", c)
+	}
+	if c := p.countAt("aa02", now); c != 1 {
+		t.Errorf("Hash aa02: expected 1, got %d", c)
+	}
+	p.hitAt("aa04", now)
+	if c := p.countAt("aa04", now); c != 0 {
+		t.Errorf("Hash should not be counted when the shard is still full, got %d", c)
+	}
+}
+
+func TestPopularityConcurrent(t *testing.T) {
+	p := NewPopularity(testHalfLife, 1024)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				p.Hit(strconv.FormatInt((int64)(j%16), 16) + "0")
+			}
+		}()
+	}
+	wg.Wait()
+	for j := 0; j < 16; j++ {
+		if c := p.Count(strconv.FormatInt((int64)(j), 16) + "0"); c == 0 {
+			t.Errorf("Hash %x0 should be counted", j)
+		}
+	}
+}
@@ -20,7 +20,11 @@
 package utils
 
 import (
+	"crypto"
+	_ "crypto/md5"
+	_ "crypto/sha1"
 	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
 )
@@ -48,3 +52,16 @@ func WalkCacheDir(cacheDir string, walker func(hash string, size int64) (err err
 	}
 	return nil
 }
+
+// GetHashMethod returns the hash method by the length of the hex encoded hash
+func GetHashMethod(l int) (hashMethod crypto.Hash, err error) {
+	switch l {
+	case 32:
+		hashMethod = crypto.MD5
+	case 40:
+		hashMethod = crypto.SHA1
+	default:
+		err = fmt.Errorf("Unknown hash length %d", l)
+	}
+	return
+}
@@ -0,0 +1,88 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DailyWindow is a time of day range in local time, such as "01:00-07:30".
+// The range can cross midnight, such as "23:00-06:00"
+type DailyWindow struct {
+	Start, End int // minutes since midnight
+}
+
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(strings.TrimSpace(s), ":")
+	if !ok {
+		return 0, fmt.Errorf("Time %q is not in HH:MM format", s)
+	}
+	hour, err := strconv.Atoi(h)
+	if err != nil || hour < 0 || hour > 24 {
+		return 0, fmt.Errorf("Invalid hour in %q", s)
+	}
+	minute, err := strconv.Atoi(m)
+	if err != nil || minute < 0 || minute >= 60 || hour == 24 && minute != 0 {
+		return 0, fmt.Errorf("Invalid minute in %q", s)
+	}
+	return hour*60 + minute, nil
+}
+
+func (w DailyWindow) Contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.Start < w.End {
+		return w.Start <= m && m < w.End
+	}
+	return m >= w.Start || m < w.End
+}
+
+func (w DailyWindow) String() string {
+	return fmt.Sprintf("%02d:%02d-%02d:%02d", w.Start/60, w.Start%60, w.End/60, w.End%60)
+}
+
+func (w DailyWindow) MarshalYAML() (any, error) {
+	return w.String(), nil
+}
+
+func (w *DailyWindow) UnmarshalYAML(n *yaml.Node) (err error) {
+	var v string
+	if err = n.Decode(&v); err != nil {
+		return
+	}
+	start, end, ok := strings.Cut(v, "-")
+	if !ok {
+		return fmt.Errorf("Daily window %q is not in HH:MM-HH:MM format", v)
+	}
+	if w.Start, err = parseClock(start); err != nil {
+		return
+	}
+	if w.End, err = parseClock(end); err != nil {
+		return
+	}
+	if w.Start == w.End || w.Start == 24*60 && w.End == 0 {
+		return fmt.Errorf("Daily window %q is empty", v)
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+/**
+ * OpenBmclAPI (Golang Edition)
+ * Copyright (C) 2024 Kevin Z <zyxkad@gmail.com>
+ * All rights reserved
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as published
+ *  by the Free Software Foundation, either version 3 of the License, or
+ *  (at your option) any later version.
+ *
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+ *
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package utils_test
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	. "github.com/LiterMC/go-openbmclapi/utils"
+)
+
+func TestDailyWindowUnmarshal(t *testing.T) {
+	var data = []struct {
+		S      string
+		Window DailyWindow
+		Ok     bool
+	}{
+		{"01:00-07:30", DailyWindow{Start: 60, End: 450}, true},
+		{" 23:00 - 06:00 ", DailyWindow{Start: 1380, End: 360}, true},
+		{"22:00-24:00", DailyWindow{Start: 1320, End: 1440}, true},
+		{"24:00-06:00", DailyWindow{Start: 1440, End: 360}, true},
+		{"00:00-24:00", DailyWindow{Start: 0, End: 1440}, true},
+		{"7:5-8:00", DailyWindow{Start: 425, End: 480}, true},
+		{"01:00-01:00", DailyWindow{}, false},
+		{"24:00-00:00", DailyWindow{}, false},
+		{"24:30-06:00", DailyWindow{}, false},
+		{"25:00-06:00", DailyWindow{}, false},
+		{"01:60-06:00", DailyWindow{}, false},
+		{"-01:00-06:00", DailyWindow{}, false},
+		{"01:00", DailyWindow{}, false},
+		{"0100-0600", DailyWindow{}, false},
+		{"", DailyWindow{}, false},
+	}
+	for _, d := range data {
+		var w DailyWindow
+		err := yaml.Unmarshal(([]byte)(`"`+d.S+`"`), &w)
+		if d.Ok != (err == nil) {
+			t.Errorf("Unmarshal %q: expected ok=%v, got error %v", d.S, d.Ok, err)
+			continue
+		}
+		if d.Ok && w != d.Window {
+			t.Errorf("Unmarshal %q: expected %v, got %v", d.S, d.Window, w)
+		}
+	}
+}
+
+func TestDailyWindowMarshal(t *testing.T) {
+	w := DailyWindow{Start: 1380, End: 360}
+	buf, err := yaml.Marshal(w)
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	var w2 DailyWindow
+	if err := yaml.Unmarshal(buf, &w2); err != nil || w2 != w {
+		t.Errorf("Expected %v after round trip, got %v, %v", w, w2, err)
+	}
+}
+
+func TestDailyWindowContains(t *testing.T) {
+	clock := func(hour, minute int) time.Time {
+		return time.Date(2024, 1, 1, hour, minute, 0, 0, time.Local)
+	}
+	var data = []struct {
+		Window DailyWindow
+		Time   time.Time
+		In     bool
+	}{
+		{DailyWindow{Start: 60, End: 450}, clock(0, 59), false},
+		{DailyWindow{Start: 60, End: 450}, clock(1, 0), true},
+		{DailyWindow{Start: 60, End: 450}, clock(7, 29), true},
+		{DailyWindow{Start: 60, End: 450}, clock(7, 30), false},
+		// 23:00-06:00 wraps past midnight
+		{DailyWindow{Start: 1380, End: 360}, clock(22, 59), false},
+		{DailyWindow{Start: 1380, End: 360}, clock(23, 0), true},
+		{DailyWindow{Start: 1380, End: 360}, clock(0, 0), true},
+		{DailyWindow{Start: 1380, End: 360}, clock(5, 59), true},
+		{DailyWindow{Start: 1380, End: 360}, clock(6, 0), false},
+		{DailyWindow{Start: 1380, End: 360}, clock(12, 0), false},
+		// 22:00-24:00 ends at midnight
+		{DailyWindow{Start: 1320, End: 1440}, clock(21, 59), false},
+		{DailyWindow{Start: 1320, End: 1440}, clock(23, 59), true},
+		{DailyWindow{Start: 1320, End: 1440}, clock(0, 0), false},
+		// 24:00-06:00 is the same as 00:00-06:00
+		{DailyWindow{Start: 1440, End: 360}, clock(0, 0), true},
+		{DailyWindow{Start: 1440, End: 360}, clock(6, 0), false},
+		{DailyWindow{Start: 1440, End: 360}, clock(23, 59), false},
+		// 00:00-24:00 is the whole day
+		{DailyWindow{Start: 0, End: 1440}, clock(0, 0), true},
+		{DailyWindow{Start: 0, End: 1440}, clock(23, 59), true},
+	}
+	for _, d := range data {
+		if in := d.Window.Contains(d.Time); in != d.In {
+			t.Errorf("%v contains %s: expected %v, got %v", d.Window, d.Time.Format("15:04"), d.In, in)
+		}
+	}
+}